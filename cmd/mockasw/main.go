@@ -0,0 +1,51 @@
+// Fake ASW API server for testing the proxy offline.
+// Run the proxy against it with: totsugeki-proxy -api-url http://127.0.0.1:21620/api/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/optix2000/totsugeki/mockasw"
+)
+
+func main() {
+	var listen = flag.String("listen", "127.0.0.1:21620", "Address to listen on.")
+	var latency = flag.Duration("latency", 0, "Latency added to every request.")
+	var handshakeLatency = flag.Duration("handshake-latency", 0, "Latency added to the first request of every connection, to simulate TCP and TLS handshakes.")
+	var failureRate = flag.Float64("failure-rate", 0, "Fraction of requests to fail, 0 to 1.")
+	var failureStatus = flag.Int("failure-status", http.StatusServiceUnavailable, "Status code returned by failed requests.")
+	var seed = flag.Int64("seed", time.Now().UnixNano(), "Seed for failure injection.")
+	flag.Parse()
+
+	server := mockasw.NewServer(*listen, mockasw.Options{
+		Latency:          *latency,
+		HandshakeLatency: *handshakeLatency,
+		FailureRate:      *failureRate,
+		FailureStatus:    *failureStatus,
+		Seed:             *seed,
+	})
+	server.Server.Handler = middleware.Logger(server.Server.Handler)
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		server.Server.Close()
+	}()
+
+	fmt.Printf("Started mock ASW server on %v.\n", *listen)
+	err := server.Server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Served %d requests over %d connections.\n", server.Requests(), server.Connections())
+}
@@ -0,0 +1,128 @@
+// Headless version of totsugeki that only runs the proxy. Doesn't launch GGST, and only patches it on Linux with -patch,
+// so it builds and runs on any OS. Useful for Proton, or for running the proxy on a home server or in a container for a whole LAN.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/optix2000/totsugeki/proxy"
+)
+
+// Filled in at build time
+var Version string = "(unknown version)"
+
+const GGStriveAPIURL = "https://ggst-game.guiltygear.com/api/"
+const PatchedAPIURL = "http://127.0.0.1:21611/api/"
+
+func main() {
+	if code, ok := proxy.RunSubcommand(os.Args); ok {
+		os.Exit(code)
+	}
+
+	var listen = flag.String("listen", "127.0.0.1:21611", "Address to listen on. Use 0.0.0.0:21611 to serve the whole LAN.")
+	var apiURL = flag.String("api-url", GGStriveAPIURL, "URL of the GGST API to proxy to.")
+	var patchedURL = flag.String("patched-url", PatchedAPIURL, "URL GGST uses to reach this proxy. Must match what GGST was patched with.")
+	var ungaBunga = flag.Bool("unga-bunga", false, "UNSAFE: Enable all unsafe speedups for maximum speed. Please read https://github.com/optix2000/totsugeki/blob/master/UNSAFE_SPEEDUPS.md")
+	var iKnowWhatImDoing = flag.Bool("i-know-what-im-doing", false, "UNSAFE: Suppress any UNSAFE warnings. I hope you know what you're doing...")
+	var patch = flag.Bool("patch", false, "Patch GGST running under Wine/Proton on this machine to use -patched-url. Linux only.")
+	var ver = flag.Bool("version", false, "Print the version number and exit.")
+	var options proxy.StriveAPIProxyOptions
+	options.BindFlags(flag.CommandLine)
+
+	flag.Parse()
+
+	if *ver {
+		fmt.Printf("totsugeki-proxy %v\n", Version)
+		os.Exit(0)
+	}
+
+	logger, err := options.NewLogger()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	options.Logger = logger
+	options.RatingFormatter, err = options.NewRatingFormatter()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	options.RatingProvider, err = options.NewRatingProvider()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	if *patch && !patchSupported {
+		fmt.Println("-patch is only supported on Linux. Use totsugeki.exe on Windows.")
+		os.Exit(2)
+	}
+	if *patch && len(*patchedURL) > len(GGStriveAPIURL) {
+		fmt.Printf("-patched-url must be at most %d characters to fit in GGST\n", len(GGStriveAPIURL))
+		os.Exit(2)
+	}
+	if *patch {
+		options.PatcherStatus = &proxy.PatcherStatus{}
+	}
+
+	if *ungaBunga {
+		options.UngaBunga()
+	}
+
+	if !*iKnowWhatImDoing && options.Unsafe() {
+		logger.Warn("Unsafe feature used. Make sure you understand the implications: https://github.com/optix2000/totsugeki/blob/master/UNSAFE_SPEEDUPS.md")
+	}
+
+	server := proxy.CreateStriveProxy(*listen, *apiURL, *patchedURL, &options)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *patch {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchGGST(ctx, logger.With("subsystem", "patcher"), *patchedURL, options.PatcherStatus)
+		}()
+	}
+
+	// Watch for signal to do graceful shutdown
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		cancel()
+		// A second signal stops waiting for stats uploads
+		shutdownCtx, force := context.WithCancel(context.Background())
+		go func() {
+			<-sig
+			logger.Warn("Forcing shutdown...")
+			force()
+		}()
+		server.Shutdown(shutdownCtx)
+		force()
+	}()
+
+	server.StartAdminServer()
+	logger.Info("Started Proxy Server", "listen", *listen, "version", Version)
+	err = server.Server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Proxy server stopped", "err", err)
+		os.Exit(1)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,79 @@
+package main
+
+// Patches GGST running under Wine/Proton on this machine, like totsugeki.exe does on Windows.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/optix2000/totsugeki/patcher"
+	"github.com/optix2000/totsugeki/proxy"
+)
+
+const patchSupported = true
+
+const PatchRetries = 3
+
+// Patch GGST as it starts, until ctx is cancelled
+func watchGGST(ctx context.Context, logger *slog.Logger, patchedURL string, status *proxy.PatcherStatus) {
+	var patchedPid uint32 = 1
+	for ctx.Err() == nil {
+		pid, err := patcher.GetProc(patcher.GGStriveExe)
+		if errors.Is(err, patcher.ErrProcessNotFound) {
+			if patchedPid != 0 {
+				logger.Info("Waiting for GGST process...")
+				status.Set(proxy.PatcherWaiting, 0, 0, nil)
+				patchedPid = 0
+			}
+			cancelableSleep(ctx, 2*time.Second)
+			continue
+		}
+		if err != nil {
+			logger.Error("Could not look for GGST", "err", err)
+			cancelableSleep(ctx, 5*time.Second)
+			continue
+		}
+		if pid == patchedPid {
+			cancelableSleep(ctx, 5*time.Second)
+			continue
+		}
+
+		for retry := 0; retry < PatchRetries && ctx.Err() == nil; retry++ {
+			cancelableSleep(ctx, time.Second) // Give GGST some time to finish loading
+			offset, err := patcher.PatchProc(pid, patcher.GGStriveExe, patcher.APIOffsetAddr, []byte(GGStriveAPIURL), []byte(patchedURL))
+			if errors.Is(err, patcher.ErrOffsetMismatch) {
+				logger.Warn("Offset found at unknown location. This version of Totsugeki has not been tested with this version of GGST and may cause issues.", "pid", pid, "offset", fmt.Sprintf("0x%x", offset))
+				status.Set(proxy.PatcherPatched, pid, offset, err)
+				patchedPid = pid
+				break
+			}
+			if errors.Is(err, patcher.ErrProcessAlreadyPatched) {
+				logger.Info("GGST is already patched", "pid", pid, "offset", fmt.Sprintf("0x%x", offset))
+				status.Set(proxy.PatcherAlreadyPatched, pid, offset, nil)
+				patchedPid = pid
+				break
+			}
+			if err != nil {
+				logger.Error("Could not patch GGST. Totsugeki needs to run as the same user as Steam.", "pid", pid, "offset", fmt.Sprintf("0x%x", offset), "attempt", retry+1, "err", err)
+				status.Set(proxy.PatcherFailed, pid, offset, err)
+				continue
+			}
+			logger.Info("Patched GGST", "pid", pid, "offset", fmt.Sprintf("0x%x", offset))
+			status.Set(proxy.PatcherPatched, pid, offset, nil)
+			patchedPid = pid
+			break
+		}
+		if patchedPid != pid {
+			cancelableSleep(ctx, 5*time.Second) // Try again later instead of hammering a GGST that can't be patched
+		}
+	}
+}
+
+func cancelableSleep(ctx context.Context, delay time.Duration) {
+	wait, waitCancel := context.WithTimeout(ctx, delay)
+	<-wait.Done()
+	waitCancel()
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+// Patching is only done here on Linux. totsugeki.exe patches GGST on Windows.
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/optix2000/totsugeki/proxy"
+)
+
+const patchSupported = false
+
+func watchGGST(ctx context.Context, logger *slog.Logger, patchedURL string, status *proxy.PatcherStatus) {
+}
@@ -49,10 +49,227 @@ type StatGetRespPayload struct {
 	JSON     RawJSON
 }
 
-type RawJSON map[string]interface{}
-
 type StatGetResponse struct {
 	_msgpack struct{} `msgpack:",as_array"`
 	Header   StatGetRespHeader
 	Payload  StatGetRespPayload
+	original *statGetRespOriginal // Encoding ASW sent. nil if not decoded.
+}
+
+// Every request is [header, payload] and every response is [header, payload]. Typed payloads only decode if the
+// layout matches exactly. Use UnmarshalAny for anything that has to keep working if ASW adds or removes fields.
+
+type Request[P any] struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Header   StatReqHeader
+	Payload  P
+}
+
+type Response[P any] struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Header   StatGetRespHeader
+	Payload  P
+}
+
+// ResultPayload is the payload of responses that only return a result code, like statistics/set and tus/write.
+type ResultPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Result   int      // Always 0 on success
+}
+
+// sys/get_env
+
+type GetEnvReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 256
+}
+
+type GetEnvRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	Unk2     int      // Always 1
+	APIURL   string   // URL GGST uses for everything after this call. The proxy rewrites it to point at itself.
+	Unk3     string   // Always empty
+}
+
+type GetEnvRequest = Request[GetEnvReqPayload]
+type GetEnvResponse = Response[GetEnvRespPayload]
+
+// user/login
+
+type LoginReqPayload struct {
+	_msgpack   struct{} `msgpack:",as_array"`
+	Platform   int      // 1 on Steam
+	SteamID    string   // Decimal Steam ID
+	SteamIDHex string   // Steam ID in hex
+	Unk1       int      // Always 256
+	Ticket     string   // Steam auth ticket
+}
+
+type LoginRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	UserID   string   // 18 digit User ID used in every request header after this
+	Name     string
+	Unk2     int // Always 1
+}
+
+type LoginRequest = Request[LoginReqPayload]
+type LoginResponse = Response[LoginRespPayload]
+
+// statistics/set and tus/write. Uploads R-Code and replay data.
+
+// StatSetReqPayload uploads R-Code stats. Each item replaces what statistics/get returns for the same type and page.
+type StatSetReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Items    []StatSetItem
+}
+
+type StatSetItem struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Type     int      // Same as StatGetReqPayload.Type
+	Page     int      // Same as StatGetReqPayload.Page
+	JSON     RawJSON
+}
+
+// TusWriteReqPayload writes to server side storage. The data isn't decoded.
+type TusWriteReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Slot     int      // Which storage slot is written
+	Data     []byte
+}
+
+type StatSetRequest = Request[StatSetReqPayload]
+type StatSetResponse = Response[ResultPayload]
+type TusWriteRequest = Request[TusWriteReqPayload]
+type TusWriteResponse = Response[ResultPayload]
+
+// Player lists. catalog/get_follow and catalog/get_block return the same layout.
+
+type PlayerListRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	Count    int      // Players in the list
+	Players  []ListedPlayer
+}
+
+type ListedPlayer struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	UserID   string   // 18 digit User ID
+	Name     string
 }
+
+// catalog/get_follow
+
+type GetFollowReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	Unk2     int      // Always 1
+	Unk3     int      // Always 1
+}
+
+type GetFollowRespPayload = PlayerListRespPayload // Followed players
+
+type GetFollowRequest = Request[GetFollowReqPayload]
+type GetFollowResponse = Response[GetFollowRespPayload]
+
+// catalog/get_block
+
+type GetBlockReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 1
+	Unk2     int      // Always 1
+}
+
+type GetBlockRespPayload = PlayerListRespPayload // Blocked players
+
+type GetBlockRequest = Request[GetBlockReqPayload]
+type GetBlockResponse = Response[GetBlockRespPayload]
+
+// catalog/get_replay
+
+type GetReplayReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 1
+	Unk2     int      // Always 0
+	PageSize int      // Seems to be replays per page. Always 5.
+	Query    ReplayQuery
+}
+
+// ReplayQuery is the replay search filter. The title screen asks for the first 3 pages with the defaults.
+type ReplayQuery struct {
+	_msgpack   struct{} `msgpack:",as_array"`
+	Unk1       int      // -1
+	Unk2       int      // 0
+	Character1 int      // Character filter. 99 for any.
+	Character2 int      // Character filter. 99 for any.
+	Unk3       []interface{}
+	Unk4       int // -1
+	Unk5       int // -1
+	Page       int // 0 for first page
+	Unk6       int // 0
+	Unk7       int // 1
+}
+
+// GetReplayRespPayload is the replay list. Replays are left generic as their layout varies between versions. See ParseReplays.
+type GetReplayRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	Count    int      // Replays in the list
+	Replays  []interface{}
+}
+
+type GetReplayRequest = Request[GetReplayReqPayload]
+type GetReplayResponse = Response[GetReplayRespPayload]
+
+// sys/get_news
+
+type GetNewsRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	News     []interface{}
+}
+
+type GetNewsResponse = Response[GetNewsRespPayload]
+
+// lobby/get_vip_status
+
+type GetVIPStatusReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     string   // Always empty
+}
+
+type GetVIPStatusRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	Status   int      // 0 if not VIP
+}
+
+type GetVIPStatusRequest = Request[GetVIPStatusReqPayload]
+type GetVIPStatusResponse = Response[GetVIPStatusRespPayload]
+
+// item/get_item
+
+type GetItemReqPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 5
+}
+
+type GetItemRespPayload struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Unk1     int      // Always 0
+	Items    []interface{}
+}
+
+type GetItemRequest = Request[GetItemReqPayload]
+type GetItemResponse = Response[GetItemRespPayload]
+
+// follow/follow_user, follow/unfollow_user, follow/block_user, follow/unblock_user
+
+type FollowReqPayload struct {
+	_msgpack    struct{} `msgpack:",as_array"`
+	OtherUserID string   // 18 digit User ID of the other player
+}
+
+type FollowRequest = Request[FollowReqPayload]
+type FollowResponse = Response[ResultPayload]
@@ -0,0 +1,258 @@
+package ggst
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	testReqHeader  = StatReqHeader{UserID: "210611081234567890", Hash: "abcdefghjklmn", Unk3: 2, Version: "0.1.1", Unk4: 3}
+	testRespHeader = StatGetRespHeader{Hash: "62a3f8e2c1d0b", Timestamp: "2024/01/02 03:04:05", Version1: "0.1.1", Version2: "0.0.2", Version3: "0.0.2"}
+)
+
+func testStats(t testing.TB, values ...interface{}) RawJSON {
+	var j RawJSON
+	for i := 0; i < len(values); i += 2 {
+		if err := j.Set(values[i].(string), values[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return j
+}
+
+// A replay list item as ParseReplays expects it
+func testReplayItem(id int64, floor int, characters [2]int, players [2]ReplayPlayer, winner int, timestamp string) []interface{} {
+	return []interface{}{
+		id, 0, floor, characters[0], characters[1],
+		[]interface{}{players[0].UserID, players[0].Name, "76561198000000001", "0110000100000001"},
+		[]interface{}{players[1].UserID, players[1].Name, "76561198000000002", "0110000100000002"},
+		winner, timestamp, 0, 12, 0, 3,
+	}
+}
+
+var (
+	testPlayer1 = ReplayPlayer{UserID: "210611081234567890", Name: "Player One"}
+	testPlayer2 = ReplayPlayer{UserID: "210611089876543210", Name: "プレイヤー2"}
+)
+
+type golden struct {
+	file     string
+	endpoint string // Classify the fixture as a request to this endpoint. Responses if empty.
+	want     interface{}
+}
+
+func goldens(t testing.TB) []golden {
+	return []golden{
+		{"get_env_request", "sys/get_env", &GetEnvRequest{Header: testReqHeader, Payload: GetEnvReqPayload{Unk1: 256}}},
+		{"get_env_response", "", &GetEnvResponse{Header: testRespHeader, Payload: GetEnvRespPayload{Unk2: 1, APIURL: "https://ggst-game.guiltygear.com/api/"}}},
+		{"login_request", "user/login", &LoginRequest{Header: StatReqHeader{Unk3: 2, Version: "0.1.1", Unk4: 3}, Payload: LoginReqPayload{Platform: 1, SteamID: "76561198000000001", SteamIDHex: "110000100000001", Unk1: 256, Ticket: "14000000abcdef"}}},
+		{"login_response", "", &LoginResponse{Header: testRespHeader, Payload: LoginRespPayload{UserID: "210611081234567890", Name: "Player One", Unk2: 1}}},
+		{"statistics_get_request", "statistics/get", &StatGetRequest{Header: testReqHeader, Payload: StatGetReqPayload{Type: 7, Unk2: -1, Page: -1, Unk3: -1, Unk4: -1}}},
+		{"statistics_get_response", "", &StatGetResponse{Header: testRespHeader, Payload: StatGetRespPayload{JSON: testStats(t, "NAME", "Player One", "SOLLv", 12, "KYKLv", 3)}}},
+		{"statistics_set_request", "statistics/set", &StatSetRequest{Header: testReqHeader, Payload: StatSetReqPayload{Items: []StatSetItem{
+			{Type: 7, Page: -1, JSON: testStats(t, "NAME", "Player One", "SOLLv", 13)},
+			{Type: 2, Page: 0, JSON: testStats(t, "TotalBattle", 41, "TotalWin", 20)},
+		}}}},
+		{"statistics_set_response", "", &StatSetResponse{Header: testRespHeader}},
+		{"tus_write_request", "tus/write", &TusWriteRequest{Header: testReqHeader, Payload: TusWriteReqPayload{Slot: 3, Data: []byte{0x00, 0x01, 0xfe, 0xff}}}},
+		{"tus_write_response", "", &TusWriteResponse{Header: testRespHeader}},
+		{"get_follow_request", "catalog/get_follow", &GetFollowRequest{Header: testReqHeader, Payload: GetFollowReqPayload{Unk2: 1, Unk3: 1}}},
+		{"get_follow_response", "", &GetFollowResponse{Header: testRespHeader, Payload: GetFollowRespPayload{Count: 2, Players: []ListedPlayer{
+			{UserID: testPlayer2.UserID, Name: testPlayer2.Name},
+			{UserID: "210611080000000001", Name: "Someone"},
+		}}}},
+		{"get_block_request", "catalog/get_block", &GetBlockRequest{Header: testReqHeader, Payload: GetBlockReqPayload{Unk1: 1, Unk2: 1}}},
+		{"get_block_response", "", &GetBlockResponse{Header: testRespHeader, Payload: GetBlockRespPayload{Players: []ListedPlayer{}}}},
+		{"get_replay_request", "catalog/get_replay", &GetReplayRequest{Header: testReqHeader, Payload: GetReplayReqPayload{Unk1: 1, PageSize: 5, Query: ReplayQuery{
+			Unk1: -1, Character1: 99, Character2: 99, Unk3: []interface{}{}, Unk4: -1, Unk5: -1, Unk7: 1,
+		}}}},
+		{"get_replay_response", "", &GetReplayResponse{Header: testRespHeader, Payload: GetReplayRespPayload{Count: 3, Replays: []interface{}{
+			testReplayItem(1234567890123, 10, [2]int{0, 1}, [2]ReplayPlayer{testPlayer1, testPlayer2}, 1, "2024-01-02 03:04:05"),
+			testReplayItem(1234567890124, 99, [2]int{20, 2}, [2]ReplayPlayer{testPlayer2, testPlayer1}, 2, "2024-01-02 03:07:30"),
+			[]interface{}{"not a replay"},
+		}}}},
+		{"get_news_response", "", &GetNewsResponse{Header: testRespHeader, Payload: GetNewsRespPayload{News: []interface{}{}}}},
+		{"get_vip_status_request", "lobby/get_vip_status", &GetVIPStatusRequest{Header: testReqHeader}},
+		{"get_vip_status_response", "", &GetVIPStatusResponse{Header: testRespHeader}},
+		{"get_item_request", "item/get_item", &GetItemRequest{Header: testReqHeader, Payload: GetItemReqPayload{Unk1: 5}}},
+		{"get_item_response", "", &GetItemResponse{Header: testRespHeader, Payload: GetItemRespPayload{Items: []interface{}{[]interface{}{1001, 1}, []interface{}{70000, 3}}}}},
+		{"follow_user_request", "follow/follow_user", &FollowRequest{Header: testReqHeader, Payload: FollowReqPayload{OtherUserID: testPlayer2.UserID}}},
+		{"follow_user_response", "", &FollowResponse{Header: testRespHeader}},
+	}
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", name+".hex")
+}
+
+// Fixtures are hex so they diff well. They're written by hand, see testdata/README.md.
+func readGolden(t testing.TB, name string) []byte {
+	t.Helper()
+	return readHex(t, goldenPath(name))
+}
+
+func readHex(t testing.TB, path string) []byte {
+	t.Helper()
+	text, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGoldenRoundTrip(t *testing.T) {
+	for _, g := range goldens(t) {
+		t.Run(g.file, func(t *testing.T) {
+			encoded, err := Marshal(g.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := readGolden(t, g.file)
+			if !bytes.Equal(encoded, data) {
+				t.Errorf("encoded = %x, want %x", encoded, data)
+			}
+
+			// Decoding into the typed message and encoding it again gives the same bytes
+			decoded := reflect.New(reflect.TypeOf(g.want).Elem()).Interface()
+			err = Unmarshal(data, decoded)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			again, err := Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("round trip = %x, want %x", again, data)
+			}
+
+			// So does decoding without knowing the layout
+			generic, err := UnmarshalAny(data)
+			if err != nil {
+				t.Fatalf("UnmarshalAny: %v", err)
+			}
+			again, err = Marshal(generic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("generic round trip = %x, want %x", again, data)
+			}
+		})
+	}
+}
+
+// Every fixture says where it came from
+func TestGoldenSources(t *testing.T) {
+	readme, err := os.ReadFile(filepath.Join("testdata", "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join("testdata", "*", "*.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, _ := filepath.Glob(filepath.Join("testdata", "*.hex"))
+	for _, file := range append(files, more...) {
+		name, _ := filepath.Rel("testdata", file)
+		if !bytes.Contains(readme, []byte("`"+filepath.ToSlash(name)+"`")) {
+			t.Errorf("%s isn't listed in testdata/README.md", name)
+		}
+	}
+}
+
+// Real ASW traffic decodes into the typed messages and encodes back to the same bytes
+func TestCapturedRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "captured", "*.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skip("no captured traffic in testdata/captured, see testdata/README.md")
+	}
+	types := make(map[string]reflect.Type)
+	for _, g := range goldens(t) {
+		types[g.file] = reflect.TypeOf(g.want).Elem()
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".hex")
+		t.Run(name, func(t *testing.T) {
+			// Several captures of the same message are name.1.hex, name.2.hex, ...
+			typ, ok := types[strings.SplitN(name, ".", 2)[0]]
+			if !ok {
+				t.Fatalf("no message type for %s", name)
+			}
+			data := readHex(t, file)
+			decoded := reflect.New(typ).Interface()
+			err := Unmarshal(data, decoded)
+			if err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			again, err := Marshal(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("round trip = %x, want %x", again, data)
+			}
+		})
+	}
+}
+
+// Requests are classified into the same typed payload
+func TestGoldenClassify(t *testing.T) {
+	for _, g := range goldens(t) {
+		if g.endpoint == "" {
+			continue
+		}
+		t.Run(g.file, func(t *testing.T) {
+			data := readGolden(t, g.file)
+			c, err := ClassifyRequest("/api/"+g.endpoint, []byte("data="+hex.EncodeToString(data)+"\x00"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := reflect.ValueOf(g.want).Elem().FieldByName("Payload").Addr().Interface()
+			if reflect.TypeOf(c.Payload) != reflect.TypeOf(want) {
+				t.Fatalf("payload is %T, want %T", c.Payload, want)
+			}
+			gotPayload, _ := Marshal(c.Payload)
+			wantPayload, _ := Marshal(want)
+			if !bytes.Equal(gotPayload, wantPayload) {
+				t.Errorf("payload = %x, want %x", gotPayload, wantPayload)
+			}
+			if c.Header != reflect.ValueOf(g.want).Elem().FieldByName("Header").Interface().(StatReqHeader) {
+				t.Errorf("header = %+v", c.Header)
+			}
+			if c.HeaderData+c.PayloadData != hex.EncodeToString(data) {
+				t.Errorf("HeaderData + PayloadData = %s, want %x", c.HeaderData+c.PayloadData, data)
+			}
+		})
+	}
+}
+
+// Payloads that don't match the typed layout are still classified, generically
+func TestClassifyChangedLayout(t *testing.T) {
+	data, err := Marshal([]interface{}{testReqHeader, []interface{}{testPlayer2.UserID, "new field"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ClassifyRequest("/api/follow/follow_user", []byte("data="+hex.EncodeToString(data)+"\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Kind != Follow {
+		t.Errorf("kind = %v, want %v", c.Kind, Follow)
+	}
+	if _, ok := c.Payload.([]interface{}); !ok {
+		t.Errorf("payload is %T, want []interface{}", c.Payload)
+	}
+}
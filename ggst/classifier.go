@@ -0,0 +1,207 @@
+package ggst
+
+// Works out what a request is asking for from its payload, so handlers don't have to match on hex strings.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type RequestKind int
+
+const (
+	UnknownRequest RequestKind = iota
+	GetEnv
+	Login
+	StatGet
+	StatSet
+	TusWrite
+	GetNews
+	GetFollow
+	GetBlock
+	GetReplay
+	GetVIPStatus
+	GetItem
+	Follow
+)
+
+func (k RequestKind) String() string {
+	switch k {
+	case UnknownRequest:
+		return "unknown"
+	case GetEnv:
+		return "sys/get_env"
+	case Login:
+		return "user/login"
+	case StatGet:
+		return "statistics/get"
+	case StatSet:
+		return "statistics/set"
+	case TusWrite:
+		return "tus/write"
+	case GetNews:
+		return "sys/get_news"
+	case GetFollow:
+		return "catalog/get_follow"
+	case GetBlock:
+		return "catalog/get_block"
+	case GetReplay:
+		return "catalog/get_replay"
+	case GetVIPStatus:
+		return "lobby/get_vip_status"
+	case GetItem:
+		return "item/get_item"
+	case Follow:
+		return "follow"
+	}
+	return fmt.Sprintf("RequestKind(%d)", int(k))
+}
+
+// Endpoint kind and a constructor for its typed payload. nil payload means it's only decoded generically.
+var requestKinds = map[string]struct {
+	kind    RequestKind
+	payload func() interface{}
+}{
+	"sys/get_env":          {GetEnv, func() interface{} { return &GetEnvReqPayload{} }},
+	"user/login":           {Login, func() interface{} { return &LoginReqPayload{} }},
+	"statistics/get":       {StatGet, func() interface{} { return &StatGetReqPayload{} }},
+	"statistics/set":       {StatSet, func() interface{} { return &StatSetReqPayload{} }},
+	"tus/write":            {TusWrite, func() interface{} { return &TusWriteReqPayload{} }},
+	"sys/get_news":         {GetNews, nil},
+	"catalog/get_follow":   {GetFollow, func() interface{} { return &GetFollowReqPayload{} }},
+	"catalog/get_block":    {GetBlock, func() interface{} { return &GetBlockReqPayload{} }},
+	"catalog/get_replay":   {GetReplay, func() interface{} { return &GetReplayReqPayload{} }},
+	"lobby/get_vip_status": {GetVIPStatus, func() interface{} { return &GetVIPStatusReqPayload{} }},
+	"item/get_item":        {GetItem, func() interface{} { return &GetItemReqPayload{} }},
+	"follow/follow_user":   {Follow, func() interface{} { return &FollowReqPayload{} }},
+	"follow/unfollow_user": {Follow, func() interface{} { return &FollowReqPayload{} }},
+	"follow/block_user":    {Follow, func() interface{} { return &FollowReqPayload{} }},
+	"follow/unblock_user":  {Follow, func() interface{} { return &FollowReqPayload{} }},
+}
+
+// StatGetType is StatGetReqPayload.Type
+type StatGetType int
+
+const (
+	StatGetVsStats      StatGetType = 1 // Tension use, RC usage, perfects, etc
+	StatGetBattleRecord StatGetType = 2 // Battle Record/Battle Chart
+	StatGetSinglePlayer StatGetType = 6 // Mission, story, etc
+	StatGetLevels       StatGetType = 7 // Levels, Floor, Name, etc. First call on the title screen and R-Code.
+	StatGetUnknown8     StatGetType = 8
+	StatGetNews         StatGetType = 9
+)
+
+func (t StatGetType) String() string {
+	switch t {
+	case StatGetVsStats:
+		return "vs stats"
+	case StatGetBattleRecord:
+		return "battle record"
+	case StatGetSinglePlayer:
+		return "single player"
+	case StatGetLevels:
+		return "levels"
+	case StatGetUnknown8:
+		return "unknown 8"
+	case StatGetNews:
+		return "news"
+	}
+	return fmt.Sprintf("type %d", int(t))
+}
+
+// ClassifiedRequest is a decoded API request
+type ClassifiedRequest struct {
+	Endpoint    string // Path without /api/
+	Kind        RequestKind
+	Header      StatReqHeader
+	Payload     interface{} // Typed payload pointer like *StatGetReqPayload. Generic []interface{} if the endpoint isn't mapped or the layout changed.
+	Data        string      // Hex of the msgpack in the data field, without the trailing \0
+	HeaderData  string      // Hex of the header part of Data
+	PayloadData string      // Hex of the payload part of Data
+}
+
+// ClassifyRequest decodes the data field of a raw request body for the API endpoint at path
+func ClassifyRequest(path string, body []byte) (*ClassifiedRequest, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	data := strings.TrimRight(form.Get("data"), "\x00") // Clean up input
+	if data == "" {
+		return nil, errors.New("ggst: request has no data")
+	}
+	msg, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ClassifiedRequest{
+		Endpoint: strings.TrimPrefix(path, "/api/"),
+		Data:     data,
+	}
+
+	// Decode straight from a bytes.Reader so how much of msg the header used is known
+	rd := bytes.NewReader(msg)
+	dec := msgpack.NewDecoder(rd)
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n != 2 {
+		return nil, fmt.Errorf("ggst: request has %d parts, expected 2", n)
+	}
+	err = dec.Decode(&c.Header)
+	if err != nil {
+		return nil, fmt.Errorf("ggst: could not decode request header: %w", err)
+	}
+	split := 2 * (len(msg) - rd.Len())
+	c.HeaderData, c.PayloadData = data[:split], data[split:]
+	payload := msg[len(msg)-rd.Len():]
+
+	known, ok := requestKinds[c.Endpoint]
+	if ok {
+		c.Kind = known.kind
+	}
+	if ok && known.payload != nil {
+		typed := known.payload()
+		if Unmarshal(payload, typed) == nil {
+			c.Payload = typed
+			return c, nil
+		}
+	}
+	c.Payload, err = UnmarshalAny(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ggst: could not decode request payload: %w", err)
+	}
+	return c, nil
+}
+
+// StatGet returns the payload if this is a statistics/get request
+func (c *ClassifiedRequest) StatGet() (*StatGetReqPayload, bool) {
+	p, ok := c.Payload.(*StatGetReqPayload)
+	return p, ok
+}
+
+// String describes the request, like "statistics/get levels for other user".
+func (c *ClassifiedRequest) String() string {
+	switch p := c.Payload.(type) {
+	case *StatGetReqPayload:
+		desc := fmt.Sprintf("%s %s", c.Endpoint, StatGetType(p.Type))
+		if p.Page >= 0 {
+			desc += fmt.Sprintf(" page %d", p.Page)
+		}
+		if p.OtherUserID != "" {
+			return desc + " for other user"
+		}
+		return desc + " for self"
+	case *GetReplayReqPayload:
+		return fmt.Sprintf("%s page %d", c.Endpoint, p.Query.Page)
+	}
+	return c.Endpoint
+}
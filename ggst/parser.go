@@ -2,12 +2,15 @@ package ggst
 
 import (
 	"bytes"
-	"encoding/json"
+	"errors"
 	"io"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
 
+// RawMessage is an already encoded msgpack value. It's decoded as is and encoded as is.
+type RawMessage = msgpack.RawMessage
+
 type Decoder struct {
 	d *msgpack.Decoder
 }
@@ -24,8 +27,11 @@ type Encoder struct {
 	e *msgpack.Encoder
 }
 
+// NewEncoder encodes integers in as few bytes as possible, like ASW does
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{e: msgpack.NewEncoder(w)}
+	e := msgpack.NewEncoder(w)
+	e.UseCompactInts(true)
+	return &Encoder{e: e}
 }
 
 func (dec *Encoder) Encode(v interface{}) error {
@@ -36,37 +42,70 @@ func Unmarshal(data []byte, v interface{}) error {
 	return msgpack.Unmarshal(data, v)
 }
 
+// Marshal encodes v in the smallest form msgpack allows, which isn't always what ASW sent. Only StatGetResponse and
+// RawJSON keep the encoding they were decoded from, since statistics/get responses are the only messages Totsugeki
+// edits and passes on. Other messages are decoded to read them, and shouldn't be encoded again to send to GGST.
 func Marshal(v interface{}) ([]byte, error) {
-	return msgpack.Marshal(v)
+	var buf bytes.Buffer
+	err := NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
+// UnmarshalStatResp decodes a statistics/get response. Anything after the response is an error rather than ignored,
+// as it would be dropped when the response is encoded again. Callers pass such responses through unedited.
 func UnmarshalStatResp(data []byte) (*StatGetResponse, error) {
 	parsedResp := &StatGetResponse{}
-	err := Unmarshal(data, parsedResp)
+	rd := bytes.NewReader(data)
+	err := msgpack.NewDecoder(rd).Decode(parsedResp)
 	if err != nil {
 		return nil, err
 	}
-	return parsedResp, err
+	if rd.Len() != 0 {
+		return nil, errors.New("ggst: trailing data after response")
+	}
+	return parsedResp, nil
+}
+
+// Everything before the stats JSON, as ASW encoded it. Ints and strings are kept in the width ASW used, which
+// re-encoding can change (eg. cc 00 becomes 00).
+type statGetRespOriginal struct {
+	header StatGetRespHeader
+	unk1   int
+	prefix []byte
 }
 
-func (J *RawJSON) DecodeMsgpack(dec *msgpack.Decoder) error {
-	s, err := dec.DecodeString()
+// Same layout without the custom encoding
+type statGetResponse StatGetResponse
+
+func (r *StatGetResponse) UnmarshalMsgpack(data []byte) error {
+	err := Unmarshal(data, (*statGetResponse)(r))
 	if err != nil {
 		return err
 	}
-	jDecoder := json.NewDecoder(bytes.NewBufferString(s))
-	jDecoder.UseNumber() // Things like AccountID are very long numbers
-	err = jDecoder.Decode(J)
-	if err != nil {
-		return err
+	r.original = nil
+	// The stats are the last thing in the message
+	if encoded := r.Payload.JSON.encoded; encoded != nil && bytes.HasSuffix(data, encoded) {
+		r.original = &statGetRespOriginal{
+			header: r.Header,
+			unk1:   r.Payload.Unk1,
+			prefix: append([]byte(nil), data[:len(data)-len(encoded)]...),
+		}
 	}
 	return nil
 }
 
-func (J *RawJSON) EncodeMsgpack(enc *msgpack.Encoder) error {
-	b, err := json.Marshal(J)
+// MarshalMsgpack keeps ASW's encoding of everything that wasn't edited, so an unedited response is passed through
+// byte for byte and editing the stats only re-encodes the stats.
+func (r StatGetResponse) MarshalMsgpack() ([]byte, error) {
+	if r.original == nil || r.original.header != r.Header || r.original.unk1 != r.Payload.Unk1 {
+		return Marshal(statGetResponse(r))
+	}
+	stats, err := r.Payload.JSON.MarshalMsgpack()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return enc.EncodeString(string(b))
+	return append(append([]byte(nil), r.original.prefix...), stats...), nil
 }
@@ -0,0 +1,178 @@
+package ggst
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// statistics_get_response as ASW might encode it, with ints and strings wider than needed
+const testWideStatResp = "92" +
+	"98ad3632613366386532633164306200" + // Header, Unk1 is 0 in the smallest form
+	"b3323032342f30312f30322030333a30343a3035" +
+	"d905302e312e31" + // "0.1.1" as str8
+	"a5302e302e32a5302e302e32a0a0" +
+	"92" + "cc00" + // Payload, Unk1 is 0 as uint8
+	"da002a" + "7b224e414d45223a22506c61796572204f6e65222c22534f4c4c76223a31322c224b594b4c76223a337d" // JSON as str16
+
+func testWideStatRespData(t testing.TB) []byte {
+	data, err := hex.DecodeString(testWideStatResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStatRespKeepsEncoding(t *testing.T) {
+	data := testWideStatRespData(t)
+	resp, err := UnmarshalStatResp(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unedited, by pointer and by value
+	for _, v := range []interface{}{resp, *resp} {
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal(%T): %v", v, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("Marshal(%T) = %x, want %x", v, out, data)
+		}
+	}
+
+	// Edited, only the stats change and they stay a str16
+	err = resp.Payload.JSON.Set("SOLLv", 13)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Marshal(*resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := hex.DecodeString(testWideStatResp[:len(testWideStatResp)-len("da002a")-84] + "da002a" +
+		hex.EncodeToString([]byte(`{"NAME":"Player One","SOLLv":13,"KYKLv":3}`)))
+	if !bytes.Equal(out, want) {
+		t.Errorf("edited = %x, want %x", out, want)
+	}
+
+	// Edited header fields are encoded normally
+	resp.Header.Unk1 = 1
+	out, err = Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := UnmarshalStatResp(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Header != resp.Header {
+		t.Errorf("header = %+v, want %+v", again.Header, resp.Header)
+	}
+}
+
+func TestRawJSONKeepsWidth(t *testing.T) {
+	tests := []struct {
+		name string
+		code byte
+		n    int
+		want string
+	}{
+		{"new short", 0, 3, "a3"},
+		{"new long", 0, 40, "d928"},
+		{"fixstr grows", 0xa5, 40, "d928"},
+		{"str8 stays", 0xd9, 3, "d903"},
+		{"str16 stays", 0xda, 3, "da0003"},
+		{"str32 stays", 0xdb, 3, "db00000003"},
+		{"str8 grows", 0xd9, 300, "da012c"},
+		{"bin8 stays", 0xc4, 3, "c403"},
+		{"bin16 stays", 0xc5, 3, "c50003"},
+		{"bin8 grows", 0xc4, 300, "c5012c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(RawJSON{code: tt.code}.encodeHeader(tt.n)); got != tt.want {
+				t.Errorf("header = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Decoding a stats response and encoding it again never changes it. Editing the stats leaves everything else alone.
+// Responses that aren't encoded like ASW does are re-encoded, and that encoding is stable.
+func FuzzRoundTrip(f *testing.F) {
+	for _, g := range goldens(f) {
+		f.Add(readGolden(f, g.file))
+	}
+	f.Add(testWideStatRespData(f))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := UnmarshalStatResp(data)
+		if err != nil {
+			return
+		}
+		out, err := Marshal(*resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.original == nil {
+			// Smallest form, which decodes to the same response and encodes to itself
+			again, err := UnmarshalStatResp(out)
+			if err != nil {
+				t.Fatalf("re-encoded response doesn't decode: %v", err)
+			}
+			if again.Header != resp.Header || again.Payload.Unk1 != resp.Payload.Unk1 || !sameStats(&again.Payload.JSON, &resp.Payload.JSON) {
+				t.Fatalf("re-encoded = %+v, want %+v", again, resp)
+			}
+			twice, err := Marshal(*again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(twice, out) {
+				t.Fatalf("encoded again = %x, want %x", twice, out)
+			}
+			return
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("round trip = %x, want %x", out, data)
+		}
+
+		err = resp.Payload.JSON.Set("totsugeki", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(out, resp.original.prefix) {
+			t.Fatalf("edited = %x, want prefix %x", out, resp.original.prefix)
+		}
+		again, err := UnmarshalStatResp(out)
+		if err != nil {
+			t.Fatalf("edited response doesn't decode: %v", err)
+		}
+		if v, ok := again.Payload.JSON.Get("totsugeki"); !ok || v.(interface{ String() string }).String() != "1" {
+			t.Errorf("edited value = %v", v)
+		}
+	})
+}
+
+func sameStats(a, b *RawJSON) bool {
+	if a.Len() != b.Len() {
+		return false
+	}
+	for i, key := range a.Keys() {
+		if b.Keys()[i] != key || !bytes.Equal(a.values[key], b.values[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStatRespTrailingData(t *testing.T) {
+	data := append(testWideStatRespData(t), 0xc0)
+	if _, err := UnmarshalStatResp(data); err == nil {
+		t.Error("trailing data wasn't an error")
+	}
+}
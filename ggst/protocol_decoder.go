@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/vmihailenco/msgpack/v5"
@@ -23,6 +24,22 @@ func ParseReq(r *http.Request, v interface{}) error {
 	return nil
 }
 
+// DecodeRequestBody returns the msgpack in the data field of a raw request body
+func DecodeRequestBody(body []byte) ([]byte, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(strings.TrimRight(form.Get("data"), "\x00")) // Clean up input
+}
+
+// UnmarshalAny decodes msgpack without knowing its structure. Arrays become []interface{} and maps map[string]interface{}.
+func UnmarshalAny(data []byte) (interface{}, error) {
+	var v interface{}
+	err := msgpack.Unmarshal(data, &v)
+	return v, err
+}
+
 // BufferedResponseWriter is a wrapper around http.ResponseWriter that buffers the response for later use.
 type BufferedResponseWriter struct {
 	HttpHeader http.Header
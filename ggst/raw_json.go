@@ -0,0 +1,223 @@
+package ggst
+
+// RawJSON keeps the exact bytes ASW sent so a decode/encode with no edits is byte identical.
+// encoding/json would sort keys, reformat numbers and change escaping, which GGST could notice.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// RawJSON is a JSON object encoded as a msgpack string. Key order, number text and escaping of untouched values are kept as is.
+// The zero value is an empty object.
+type RawJSON struct {
+	encoded []byte                     // Original msgpack bytes. nil if modified or not decoded.
+	text    []byte                     // Original JSON text. nil if modified or not decoded.
+	code    byte                       // msgpack type the text was decoded from, so edits keep its str or bin encoding. 0 if not decoded.
+	keys    []string                   // Keys in order
+	rawKeys map[string]string          // Original text of each key, including quotes
+	values  map[string]json.RawMessage // Original or re-encoded text of each value
+}
+
+// Keys returns the keys in their original order
+func (j *RawJSON) Keys() []string {
+	return append([]string(nil), j.keys...)
+}
+
+func (j *RawJSON) Len() int {
+	return len(j.keys)
+}
+
+// Get decodes the value of key. Numbers are json.Number so long IDs aren't mangled.
+func (j *RawJSON) Get(key string) (interface{}, bool) {
+	raw, ok := j.values[key]
+	if !ok {
+		return nil, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber() // Things like AccountID are very long numbers
+	var v interface{}
+	if dec.Decode(&v) != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// Set replaces the value of key, or adds it to the end if it's new
+func (j *RawJSON) Set(key string, value interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(value)
+	if err != nil {
+		return err
+	}
+	raw := json.RawMessage(bytes.TrimRight(buf.Bytes(), "\n"))
+
+	if j.values == nil {
+		j.values = make(map[string]json.RawMessage)
+		j.rawKeys = make(map[string]string)
+	}
+	if _, ok := j.values[key]; !ok {
+		rawKey, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		j.keys = append(j.keys, key)
+		j.rawKeys[key] = string(rawKey)
+	}
+	j.values[key] = raw
+	j.encoded = nil
+	j.text = nil
+	return nil
+}
+
+// Delete removes key
+func (j *RawJSON) Delete(key string) {
+	if _, ok := j.values[key]; !ok {
+		return
+	}
+	delete(j.values, key)
+	delete(j.rawKeys, key)
+	for i, k := range j.keys {
+		if k == key {
+			j.keys = append(j.keys[:i:i], j.keys[i+1:]...)
+			break
+		}
+	}
+	j.encoded = nil
+	j.text = nil
+}
+
+// MarshalJSON returns the JSON object, keeping the original text if nothing changed
+func (j RawJSON) MarshalJSON() ([]byte, error) {
+	if j.text != nil {
+		return j.text, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range j.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(j.rawKeys[key])
+		buf.WriteByte(':')
+		buf.Write(j.values[key])
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON parses a JSON object, remembering key order and the original text of every key and value
+func (j *RawJSON) UnmarshalJSON(data []byte) error {
+	*j = RawJSON{
+		rawKeys: make(map[string]string),
+		values:  make(map[string]json.RawMessage),
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); ok && delim == '[' && !dec.More() { // PHP encodes empty objects as []
+		j.text = append([]byte(nil), data...)
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("ggst: RawJSON is not a JSON object")
+	}
+	for dec.More() {
+		start := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("ggst: unexpected JSON key %v", tok)
+		}
+		rawKey := strings.TrimLeft(string(data[start:dec.InputOffset()]), " \t\r\n,")
+
+		var value json.RawMessage
+		err = dec.Decode(&value)
+		if err != nil {
+			return err
+		}
+		if _, dup := j.values[key]; !dup {
+			j.keys = append(j.keys, key)
+		}
+		j.rawKeys[key] = rawKey
+		j.values[key] = value
+	}
+	_, err = dec.Token() // Closing }
+	if err != nil {
+		return err
+	}
+	j.text = append([]byte(nil), data...)
+	return nil
+}
+
+func (j *RawJSON) UnmarshalMsgpack(data []byte) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+	s, err := dec.DecodeBytes() // Accepts both str and bin
+	if err != nil {
+		return err
+	}
+	err = j.UnmarshalJSON(s)
+	if err != nil {
+		return err
+	}
+	j.code = code
+	j.encoded = append([]byte(nil), data...)
+	return nil
+}
+
+// MarshalMsgpack has a value receiver so RawJSON in messages passed by value still encode
+func (j RawJSON) MarshalMsgpack() ([]byte, error) {
+	if j.encoded != nil {
+		return j.encoded, nil
+	}
+	s, err := j.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return append(j.encodeHeader(len(s)), s...), nil
+}
+
+// Header of a str or bin of length n, the same type as the original and at least as wide.
+// Re-encoding in the smallest form could give GGST a different encoding than ASW would send.
+func (j RawJSON) encodeHeader(n int) []byte {
+	if msgpcode.IsBin(j.code) {
+		switch {
+		case j.code == msgpcode.Bin8 && n <= math.MaxUint8:
+			return []byte{msgpcode.Bin8, byte(n)}
+		case j.code != msgpcode.Bin32 && n <= math.MaxUint16:
+			return binary.BigEndian.AppendUint16([]byte{msgpcode.Bin16}, uint16(n))
+		default:
+			return binary.BigEndian.AppendUint32([]byte{msgpcode.Bin32}, uint32(n))
+		}
+	}
+	switch {
+	case (j.code == 0 || msgpcode.IsFixedString(j.code)) && n <= 31:
+		return []byte{msgpcode.FixedStrLow | byte(n)}
+	case j.code != msgpcode.Str16 && j.code != msgpcode.Str32 && n <= math.MaxUint8:
+		return []byte{msgpcode.Str8, byte(n)}
+	case j.code != msgpcode.Str32 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{msgpcode.Str16}, uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32([]byte{msgpcode.Str32}, uint32(n))
+	}
+}
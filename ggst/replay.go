@@ -0,0 +1,144 @@
+package ggst
+
+// Match results from catalog/get_replay responses. The layout follows what the community has documented about the
+// replay list and is checked strictly, so replays that don't fit are skipped instead of misread.
+
+import (
+	"errors"
+	"time"
+)
+
+type ReplayPlayer struct {
+	UserID string // 18 digit User ID
+	Name   string
+}
+
+type Replay struct {
+	ID         uint64
+	Floor      int
+	Characters [2]int // Character index of each player. Same order as ratingupdate.info.
+	Players    [2]ReplayPlayer
+	Winner     int       // 1 or 2
+	Time       time.Time // Zero if it couldn't be read
+}
+
+// Format of replay timestamps. Always UTC.
+const replayTimeLayout = "2006-01-02 15:04:05"
+
+// ParseReplays returns the replays in a catalog/get_replay response
+func ParseReplays(body []byte) ([]Replay, error) {
+	resp := &Response[[]interface{}]{}
+	err := Unmarshal(body, resp)
+	if err != nil {
+		return nil, err
+	}
+	// The list is the last element of the payload, after some counts
+	if len(resp.Payload) == 0 {
+		return nil, errors.New("ggst: empty replay response")
+	}
+	list, ok := resp.Payload[len(resp.Payload)-1].([]interface{})
+	if !ok {
+		return nil, errors.New("ggst: replay response has no list")
+	}
+
+	var replays []Replay
+	for _, item := range list {
+		fields, ok := item.([]interface{})
+		if !ok {
+			continue
+		}
+		if replay, ok := parseReplay(fields); ok {
+			replays = append(replays, replay)
+		}
+	}
+	return replays, nil
+}
+
+// [id, unknown, floor, character 1, character 2, player 1, player 2, winner, timestamp, ...]
+func parseReplay(fields []interface{}) (Replay, bool) {
+	var replay Replay
+	if len(fields) < 9 {
+		return replay, false
+	}
+	id, ok := toInt(fields[0])
+	if !ok || id <= 0 {
+		return replay, false
+	}
+	replay.ID = uint64(id)
+	floor, ok := toInt(fields[2])
+	if !ok {
+		return replay, false
+	}
+	replay.Floor = int(floor)
+	for i := 0; i < 2; i++ {
+		character, ok := toInt(fields[3+i])
+		if !ok || character < 0 || character > 99 {
+			return replay, false
+		}
+		replay.Characters[i] = int(character)
+		player, ok := parseReplayPlayer(fields[5+i])
+		if !ok {
+			return replay, false
+		}
+		replay.Players[i] = player
+	}
+	winner, ok := toInt(fields[7])
+	if !ok || (winner != 1 && winner != 2) {
+		return replay, false
+	}
+	replay.Winner = int(winner)
+	if timestamp, ok := fields[8].(string); ok {
+		replay.Time, _ = time.Parse(replayTimeLayout, timestamp)
+	}
+	return replay, true
+}
+
+// [user id, name, ...]
+func parseReplayPlayer(v interface{}) (ReplayPlayer, bool) {
+	fields, ok := v.([]interface{})
+	if !ok || len(fields) < 2 {
+		return ReplayPlayer{}, false
+	}
+	userID, ok := fields[0].(string)
+	if !ok || !IsUserID(userID) {
+		return ReplayPlayer{}, false
+	}
+	name, _ := fields[1].(string)
+	return ReplayPlayer{UserID: userID, Name: name}, true
+}
+
+// IsUserID reports whether s looks like an 18 digit User ID
+func IsUserID(s string) bool {
+	if len(s) != 18 {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Generic msgpack decoding picks the smallest int type, so accept all of them
+func toInt(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,87 @@
+package ggst
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseReplays(t *testing.T) {
+	replays, err := ParseReplays(readGolden(t, "get_replay_response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Replay{
+		{ID: 1234567890123, Floor: 10, Characters: [2]int{0, 1}, Players: [2]ReplayPlayer{testPlayer1, testPlayer2}, Winner: 1, Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{ID: 1234567890124, Floor: 99, Characters: [2]int{20, 2}, Players: [2]ReplayPlayer{testPlayer2, testPlayer1}, Winner: 2, Time: time.Date(2024, 1, 2, 3, 7, 30, 0, time.UTC)},
+	}
+	if len(replays) != len(want) {
+		t.Fatalf("got %d replays, want %d: %+v", len(replays), len(want), replays)
+	}
+	for i := range want {
+		if replays[i] != want[i] {
+			t.Errorf("replay %d = %+v, want %+v", i, replays[i], want[i])
+		}
+	}
+}
+
+// Replays that don't fit the layout are skipped, the rest are still read
+func TestParseReplaysSkipsInvalid(t *testing.T) {
+	valid := testReplayItem(1, 10, [2]int{0, 1}, [2]ReplayPlayer{testPlayer1, testPlayer2}, 1, "2024-01-02 03:04:05")
+	with := func(i int, v interface{}) []interface{} {
+		item := append([]interface{}(nil), valid...)
+		item[i] = v
+		return item
+	}
+	tests := []struct {
+		name string
+		item interface{}
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"bad timestamp still counts", with(8, "yesterday"), true},
+		{"too short", valid[:8], false},
+		{"no id", with(0, 0), false},
+		{"floor not a number", with(2, "10"), false},
+		{"character out of range", with(3, 100), false},
+		{"bad user id", with(5, []interface{}{"12345", "Player One"}), false},
+		{"player not a list", with(6, "Player Two"), false},
+		{"draw", with(7, 0), false},
+		{"not a list", "replay", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := Marshal(&GetReplayResponse{Header: testRespHeader, Payload: GetReplayRespPayload{Count: 2, Replays: []interface{}{tt.item, valid}}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			replays, err := ParseReplays(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 1
+			if tt.ok {
+				want = 2
+			}
+			if len(replays) != want {
+				t.Errorf("got %d replays, want %d", len(replays), want)
+			}
+		})
+	}
+}
+
+func TestParseReplaysInvalidResponse(t *testing.T) {
+	for name, payload := range map[string]interface{}{
+		"empty payload": []interface{}{},
+		"no list":       []interface{}{0, 3},
+	} {
+		t.Run(name, func(t *testing.T) {
+			body, err := Marshal([]interface{}{testRespHeader, payload})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseReplays(body); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/optix2000/totsugeki
 
-go 1.19
+go 1.21
 
 require (
 	github.com/blang/semver/v4 v4.0.0
@@ -1,3 +1,5 @@
+//go:build windows
+
 package main
 
 import (
@@ -7,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
@@ -31,10 +34,6 @@ import (
 var Version string = "(unknown version)"
 var UngaBungaMode string = ""
 
-const GGStriveExe = "GGST-Win64-Shipping.exe"
-
-const APIOffsetAddr uintptr = 0x34D23F8 // 1.16
-
 const PatchRetries = 3
 
 const GGStriveAPIURL = "https://ggst-game.guiltygear.com/api/"
@@ -123,7 +122,7 @@ func disableQuickEdit() {
 }
 
 // Patch GGST as it starts
-func watchGGST(noClose bool, ctx context.Context) {
+func watchGGST(noClose bool, ctx context.Context, logger *slog.Logger, status *proxy.PatcherStatus) {
 	var patchedPid uint32 = 1
 	var close bool = false
 
@@ -133,7 +132,7 @@ func watchGGST(noClose bool, ctx context.Context) {
 		case <-ctx.Done():
 			return
 		default:
-			pid, err := patcher.GetProc(GGStriveExe)
+			pid, err := patcher.GetProc(patcher.GGStriveExe)
 			if err != nil {
 				if errors.Is(err, patcher.ErrProcessNotFound) {
 					if close {
@@ -142,7 +141,8 @@ func watchGGST(noClose bool, ctx context.Context) {
 					}
 
 					if patchedPid != 0 {
-						fmt.Println("Waiting for GGST process...")
+						logger.Info("Waiting for GGST process...")
+						status.Set(proxy.PatcherWaiting, 0, 0, nil)
 						patchedPid = 0
 					}
 					cancelableSleep(ctx, 2*time.Second)
@@ -161,27 +161,32 @@ func watchGGST(noClose bool, ctx context.Context) {
 			for retry = 0; retry < PatchRetries; retry++ {
 				cancelableSleep(ctx, 1000*time.Millisecond) // Give GGST some time to finish loading. EnumProcessModules() doesn't like modules changing while it's running.
 				var offset uintptr
-				offset, err = patcher.PatchProc(pid, GGStriveExe, APIOffsetAddr, []byte(GGStriveAPIURL), []byte(PatchedAPIURL))
+				offset, err = patcher.PatchProc(pid, patcher.GGStriveExe, patcher.APIOffsetAddr, []byte(GGStriveAPIURL), []byte(PatchedAPIURL))
+				var warning error
 				if errors.Is(err, patcher.ErrOffsetMismatch) {
-					fmt.Printf("WARNING: Offset found at unknown location. This version of Totsugeki has not been tested with this version of GGST and may cause issues.\n")
+					logger.Warn("Offset found at unknown location. This version of Totsugeki has not been tested with this version of GGST and may cause issues.", "pid", pid, "offset", fmt.Sprintf("0x%x", offset))
+					warning = err
 					err = nil
 				}
 				if err != nil {
 					if errors.Is(err, patcher.ErrProcessAlreadyPatched) {
-						fmt.Printf("GGST with PID %d is already patched at offset 0x%x.\n", pid, offset)
+						logger.Info("GGST is already patched", "pid", pid, "offset", fmt.Sprintf("0x%x", offset))
+						status.Set(proxy.PatcherAlreadyPatched, pid, offset, nil)
 						if !noClose {
 							close = true
 						}
 						break
-					} else if errors.Unwrap(err) == syscall.Errno(windows.ERROR_ACCESS_DENIED) {
+					} else if errors.Is(err, windows.ERROR_ACCESS_DENIED) {
 						messageBox("Could not patch GGST. Steam/GGST may be running as Administrator. Try re-running Totsugeki as Administrator.")
 						os.Exit(1)
 					} else {
-						fmt.Printf("Error with PID %d at offset 0x%x: %v\n", pid, offset, err)
+						logger.Error("Could not patch GGST", "pid", pid, "offset", fmt.Sprintf("0x%x", offset), "attempt", retry+1, "err", err)
+						status.Set(proxy.PatcherFailed, pid, offset, err)
 						continue
 					}
 				} else {
-					fmt.Printf("Patched GGST with PID %d at offset 0x%x.\n", pid, offset)
+					logger.Info("Patched GGST", "pid", pid, "offset", fmt.Sprintf("0x%x", offset))
+					status.Set(proxy.PatcherPatched, pid, offset, warning)
 					if !noClose {
 						close = true
 					}
@@ -239,7 +244,7 @@ func autoUpdate() error {
 					return nil
 				}
 			} else {
-				fmt.Printf("New version v%v available, but cannot update from test/pre-release version v%v.\n", latestVersion, currentVersion)
+				slog.Info("New version available, but cannot update from test/pre-release version.", "latest", latestVersion.String(), "current", currentVersion.String())
 				return nil
 			}
 		}
@@ -248,7 +253,7 @@ func autoUpdate() error {
 			return errors.New("could not get executable path")
 		}
 
-		fmt.Println("New version released, downloading...")
+		slog.Info("New version released, downloading...", "version", latestVersion.String())
 		resp, err := http.Get(url)
 		if err != nil {
 			return errors.New("could not download new version")
@@ -280,22 +285,20 @@ func autoUpdate() error {
 }
 
 func main() {
+	if code, ok := proxy.RunSubcommand(os.Args); ok {
+		os.Exit(code)
+	}
+
 	var noProxy = flag.Bool("no-proxy", false, "Don't start local proxy. Useful if you want to run your own proxy.")
 	var noLaunch = flag.Bool("no-launch", false, "Don't launch GGST. Useful if you want to launch GGST through other means.")
 	var noPatch = flag.Bool("no-patch", false, "Don't patch GGST with proxy address.")
 	var noClose = flag.Bool("no-close", false, "Don't automatically close totsugeki alongside GGST.")
 	var noUpdate = flag.Bool("no-update", false, "Don't check for totsugeki updates.")
-	var unsafeAsyncStatsSet = flag.Bool("unsafe-async-stats-set", false, "UNSAFE: Asynchronously upload stats (R-Code) in the background.")
-	var unsafePredictStatsGet = flag.Bool("unsafe-predict-stats-get", false, "UNSAFE: Asynchronously precache expected statistics/get calls.")
-	var unsafeCacheNews = flag.Bool("unsafe-cache-news", false, "UNSAFE: Cache first news call and return cached version on subsequent calls.")
-	var unsafeNoNews = flag.Bool("unsafe-no-news", false, "UNSAFE: Return an empty response for news.")
-	var unsafePredictReplay = flag.Bool("unsafe-predict-replay", false, "UNSAFE: Asynchronously precache expected get_replay calls. Needs unsafe-predict-stats-get to work.")
-	var unsafeCacheEnv = flag.Bool("unsafe-cache-env", false, "UNSAFE: Cache first get_env call and return cached version on subsequent calls.")
-	var unsafeCacheFollow = flag.Bool("unsafe-cache-follow", false, "UNSAFE: Cache first get_follow and get_block calls and return cached version on subsequent calls.")
 	var ungaBunga = flag.Bool("unga-bunga", UngaBungaMode != "", "UNSAFE: Enable all unsafe speedups for maximum speed. Please read https://github.com/optix2000/totsugeki/blob/master/UNSAFE_SPEEDUPS.md")
 	var iKnowWhatImDoing = flag.Bool("i-know-what-im-doing", false, "UNSAFE: Suppress any UNSAFE warnings. I hope you know what you're doing...")
-	var ratingUpdate = flag.Bool("rating-update", false, "Display ratings from ratingupdate.info instead of character levels.")
 	var ver = flag.Bool("version", false, "Print the version number and exit.")
+	var options proxy.StriveAPIProxyOptions
+	options.BindFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -304,6 +307,24 @@ func main() {
 		os.Exit(0)
 	}
 
+	logger, err := options.NewLogger()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	options.Logger = logger
+	options.RatingFormatter, err = options.NewRatingFormatter()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	options.RatingProvider, err = options.NewRatingProvider()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
 	title, err := windows.UTF16PtrFromString(fmt.Sprintf("Totsugeki %v", Version))
 	if err == nil {
 		procSetConsoleTitle.Call(uintptr(unsafe.Pointer(title)))
@@ -325,36 +346,31 @@ func main() {
 	if !*noUpdate && Version != "(unknown version)" {
 		err := autoUpdate()
 		if err != nil {
-			fmt.Printf("Failed to update totsugeki: %v.\n", err.Error())
+			logger.Error("Failed to update totsugeki", "err", err)
 		}
 	}
 
-	if *ungaBunga { // Mash only
-		*unsafeAsyncStatsSet = true
-		*unsafePredictStatsGet = true
-		*unsafeNoNews = true
-		*unsafePredictReplay = true
-		*unsafeCacheEnv = true
-		*unsafeCacheFollow = true
+	if *ungaBunga {
+		options.UngaBunga()
 	}
 
 	// Drop process priority
 	handle := windows.CurrentProcess()
 	err = windows.SetPriorityClass(handle, windows.BELOW_NORMAL_PRIORITY_CLASS)
 	if err != nil {
-		fmt.Println(err)
+		logger.Warn("Could not lower process priority", "err", err)
 	}
 	windows.CloseHandle(handle)
 
 	// Launch GGST if it's not already running
 	if !*noLaunch {
-		_, err := patcher.GetProc(GGStriveExe)
+		_, err := patcher.GetProc(patcher.GGStriveExe)
 		if err != nil {
 			if errors.Is(err, patcher.ErrProcessNotFound) {
-				fmt.Println("Starting GGST...")
+				logger.Info("Starting GGST...")
 				err = exec.Command("rundll32", "url.dll,FileProtocolHandler", "steam://rungameid/1384160").Start()
 				if err != nil {
-					fmt.Println(err)
+					logger.Error("Could not start GGST", "err", err)
 				}
 			} else {
 				panic(err)
@@ -370,6 +386,7 @@ func main() {
 
 	// Start Patcher
 	if !*noPatch {
+		options.PatcherStatus = &proxy.PatcherStatus{}
 		wg.Add(1)
 		go func() {
 			// Raise an alert box on panic so non-technical users don't lose the output.
@@ -380,7 +397,7 @@ func main() {
 				}
 			}()
 			defer wg.Done()
-			watchGGST(*noClose, ctx)
+			watchGGST(*noClose, ctx, logger.With("subsystem", "patcher"), options.PatcherStatus)
 		}()
 	}
 
@@ -397,18 +414,10 @@ func main() {
 			}()
 			defer wg.Done()
 
-			server = proxy.CreateStriveProxy("127.0.0.1:21611", GGStriveAPIURL, PatchedAPIURL, &proxy.StriveAPIProxyOptions{
-				AsyncStatsSet:   *unsafeAsyncStatsSet,
-				PredictStatsGet: *unsafePredictStatsGet,
-				CacheNews:       *unsafeCacheNews,
-				NoNews:          *unsafeNoNews,
-				PredictReplay:   *unsafePredictReplay,
-				CacheEnv:        *unsafeCacheEnv,
-				CacheFollow:     *unsafeCacheFollow,
-				RatingUpdate:    *ratingUpdate,
-			})
-
-			fmt.Println("Started Proxy Server on port 21611.")
+			server = proxy.CreateStriveProxy("127.0.0.1:21611", GGStriveAPIURL, PatchedAPIURL, &options)
+
+			server.StartAdminServer()
+			logger.Info("Started Proxy Server", "listen", "127.0.0.1:21611")
 			err := server.Server.ListenAndServe()
 			if err != nil {
 				if !errors.Is(err, http.ErrServerClosed) {
@@ -424,12 +433,20 @@ func main() {
 			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 			<-sig
 			cancel()
-			server.Shutdown()
+			// A second signal stops waiting for stats uploads
+			shutdownCtx, force := context.WithCancel(context.Background())
+			go func() {
+				<-sig
+				logger.Warn("Forcing shutdown...")
+				force()
+			}()
+			server.Shutdown(shutdownCtx)
+			force()
 		}()
 	}
 
-	if !*iKnowWhatImDoing && (*unsafeAsyncStatsSet || *unsafePredictStatsGet || *unsafeCacheNews || *unsafeNoNews || *unsafeCacheEnv || *unsafePredictReplay || *unsafeCacheFollow) {
-		fmt.Println("WARNING: Unsafe feature used. Make sure you understand the implications: https://github.com/optix2000/totsugeki/blob/master/UNSAFE_SPEEDUPS.md")
+	if !*iKnowWhatImDoing && options.Unsafe() {
+		logger.Warn("Unsafe feature used. Make sure you understand the implications: https://github.com/optix2000/totsugeki/blob/master/UNSAFE_SPEEDUPS.md")
 	}
 
 	wg.Wait()
@@ -0,0 +1,192 @@
+// Package mockasw is a fake ASW API server for exercising the proxy without hitting ggst-game.guiltygear.com.
+// Responses have the same shape as the real API, but the contents are made up.
+package mockasw
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+type Options struct {
+	Latency          time.Duration // Added to every request. Simulates a HTTP round trip.
+	HandshakeLatency time.Duration // Added to the first request on every connection. Simulates TCP + TLS round trips.
+	FailureRate      float64       // Fraction of requests that fail with FailureStatus, 0 to 1.
+	FailureStatus    int           // Status code for failed requests. 503 if 0.
+	Seed             int64         // Seed for failure injection so runs are reproducible.
+}
+
+type Server struct {
+	Server      *http.Server
+	options     Options
+	randLock    sync.Mutex
+	rand        *rand.Rand
+	hash        uint64
+	requests    uint64
+	connections uint64
+}
+
+type connKey struct{}
+
+// Tracks if the handshake latency has been applied to a connection
+type connState struct {
+	handshakeDone bool
+}
+
+// Character codes as used in the *Lv fields of statistics/get type 7
+var characters = []string{"SOL", "KYK", "MAY", "AXL", "CHP", "POT", "FAU", "MLL", "ZAT", "RAM", "LEO", "NAG", "GIO", "ANJ", "INO", "GLD", "JKO", "COS", "BKN", "TST", "BGT"}
+
+func NewServer(listen string, options Options) *Server {
+	if options.FailureStatus == 0 {
+		options.FailureStatus = http.StatusServiceUnavailable
+	}
+	s := &Server{
+		options: options,
+		rand:    rand.New(rand.NewSource(options.Seed)),
+	}
+	s.Server = &http.Server{
+		Addr:    listen,
+		Handler: s.Handler(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			atomic.AddUint64(&s.connections, 1)
+			return context.WithValue(ctx, connKey{}, &connState{})
+		},
+	}
+	return s
+}
+
+// Requests returns the number of requests served so far
+func (s *Server) Requests() uint64 {
+	return atomic.LoadUint64(&s.requests)
+}
+
+// Connections returns the number of connections accepted so far
+func (s *Server) Connections() uint64 {
+	return atomic.LoadUint64(&s.connections)
+}
+
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(s.simulateNetwork)
+	r.Route("/api", func(r chi.Router) {
+		r.HandleFunc("/sys/get_env", s.HandleGetEnv)
+		r.HandleFunc("/user/login", s.HandleLogin)
+		r.HandleFunc("/statistics/get", s.HandleStatsGet)
+		r.HandleFunc("/statistics/set", s.HandleEmpty)
+		r.HandleFunc("/tus/write", s.HandleEmpty)
+		r.HandleFunc("/sys/get_news", s.HandleGetNews)
+		r.HandleFunc("/catalog/get_follow", s.HandleList)
+		r.HandleFunc("/catalog/get_block", s.HandleList)
+		r.HandleFunc("/catalog/get_replay", s.HandleGetReplay)
+		r.HandleFunc("/lobby/get_vip_status", s.HandleGetVIPStatus)
+		r.HandleFunc("/item/get_item", s.HandleGetItem)
+	})
+	return r
+}
+
+// Add latency and inject failures
+func (s *Server) simulateNetwork(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&s.requests, 1)
+		if conn, ok := r.Context().Value(connKey{}).(*connState); ok && !conn.handshakeDone { // Requests on a connection are never concurrent
+			conn.handshakeDone = true
+			time.Sleep(s.options.HandshakeLatency)
+		}
+		time.Sleep(s.options.Latency)
+
+		s.randLock.Lock()
+		fail := s.rand.Float64() < s.options.FailureRate
+		s.randLock.Unlock()
+		if fail {
+			w.WriteHeader(s.options.FailureStatus)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) header() ggst.StatGetRespHeader {
+	return ggst.StatGetRespHeader{
+		Hash:      fmt.Sprintf("%013x", atomic.AddUint64(&s.hash, 1)),
+		Timestamp: time.Now().UTC().Format("2006/01/02 15:04:05"),
+		Version1:  "0.1.1",
+		Version2:  "0.0.2",
+		Version3:  "0.0.2",
+	}
+}
+
+// Write a response the same way ASW does: [header, payload]
+func (s *Server) write(w http.ResponseWriter, payload interface{}) {
+	body, err := ggst.Marshal([]interface{}{s.header(), payload})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/html; charset=UTF-8")
+	header.Set("Server", "Apache")
+	header.Set("X-Powered-By", "PHP/7.2.34")
+	w.Write(body)
+}
+
+// get_env has the API URL in it, which the proxy rewrites to point at itself
+func (s *Server) HandleGetEnv(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.GetEnvRespPayload{Unk2: 1, APIURL: "http://" + r.Host + "/api/"})
+}
+
+func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.LoginRespPayload{UserID: "000000000000000001", Name: "Mock Player", Unk2: 1})
+}
+
+func (s *Server) HandleStatsGet(w http.ResponseWriter, r *http.Request) {
+	req := &ggst.StatGetRequest{}
+	err := ggst.ParseReq(r, req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stats := ggst.RawJSON{}
+	if req.Payload.Type == 7 {
+		stats.Set("NAME", "Mock Player")
+		for i, character := range characters {
+			stats.Set(character+"Lv", i+1)
+		}
+	}
+	s.write(w, &ggst.StatGetRespPayload{JSON: stats})
+}
+
+// Response to writes that don't return anything, eg. statistics/set
+func (s *Server) HandleEmpty(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.ResultPayload{})
+}
+
+func (s *Server) HandleGetNews(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.GetNewsRespPayload{News: []interface{}{}})
+}
+
+// Follow and block lists. Always empty.
+func (s *Server) HandleList(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.PlayerListRespPayload{Players: []ggst.ListedPlayer{}})
+}
+
+// Always empty
+func (s *Server) HandleGetReplay(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.GetReplayRespPayload{Replays: []interface{}{}})
+}
+
+func (s *Server) HandleGetVIPStatus(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.GetVIPStatusRespPayload{})
+}
+
+func (s *Server) HandleGetItem(w http.ResponseWriter, r *http.Request) {
+	s.write(w, &ggst.GetItemRespPayload{Items: []interface{}{}})
+}
@@ -0,0 +1,76 @@
+package patcher
+
+import "fmt"
+
+// FakeProcessMemory is an in-memory ProcessMemory so the search and patch logic can be exercised without a real process.
+type FakeProcessMemory struct {
+	Base       uintptr
+	Data       []byte
+	RegionSize uintptr // Split Data into regions of this size. Data is a single region if 0.
+	ReadLimit  int     // Return at most this many bytes per Read to simulate short reads. No limit if 0.
+	Protection uint32  // Current protection of Data. Writes fail unless this is ProtectReadWrite.
+	Reads      int     // Number of calls to Read
+}
+
+func NewFakeProcessMemory(base uintptr, data []byte) *FakeProcessMemory {
+	return &FakeProcessMemory{
+		Base:       base,
+		Data:       data,
+		Protection: ProtectReadOnly,
+	}
+}
+
+func (m *FakeProcessMemory) inRange(addr uintptr, size int) bool {
+	return addr >= m.Base && addr+uintptr(size) <= m.Base+uintptr(len(m.Data))
+}
+
+func (m *FakeProcessMemory) Regions(start uintptr, end uintptr) ([]MemoryRegion, error) {
+	regionSize := m.RegionSize
+	if regionSize == 0 {
+		regionSize = uintptr(len(m.Data))
+	}
+
+	var regions []MemoryRegion
+	for p := m.Base; p < m.Base+uintptr(len(m.Data)); p += regionSize {
+		size := regionSize
+		if p+size > m.Base+uintptr(len(m.Data)) {
+			size = m.Base + uintptr(len(m.Data)) - p
+		}
+		if p+size <= start || p >= end {
+			continue
+		}
+		regions = append(regions, MemoryRegion{BaseAddress: p, RegionSize: size})
+	}
+	return regions, nil
+}
+
+func (m *FakeProcessMemory) Read(addr uintptr, buf []byte) (int, error) {
+	m.Reads++
+	size := len(buf)
+	if m.ReadLimit > 0 && size > m.ReadLimit {
+		size = m.ReadLimit
+	}
+	if !m.inRange(addr, size) {
+		return 0, fmt.Errorf("read of %d bytes at 0x%x out of range", size, addr)
+	}
+	return copy(buf[:size], m.Data[addr-m.Base:]), nil
+}
+
+func (m *FakeProcessMemory) Write(addr uintptr, buf []byte) (int, error) {
+	if m.Protection != ProtectReadWrite {
+		return 0, fmt.Errorf("write at 0x%x to protected memory", addr)
+	}
+	if !m.inRange(addr, len(buf)) {
+		return 0, fmt.Errorf("write of %d bytes at 0x%x out of range", len(buf), addr)
+	}
+	return copy(m.Data[addr-m.Base:], buf), nil
+}
+
+func (m *FakeProcessMemory) Protect(addr uintptr, size uintptr, protect uint32) (uint32, error) {
+	if !m.inRange(addr, int(size)) {
+		return 0, fmt.Errorf("protect of %d bytes at 0x%x out of range", size, addr)
+	}
+	old := m.Protection
+	m.Protection = protect
+	return old, nil
+}
@@ -0,0 +1,162 @@
+package patcher
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Page protection values. Same values as Windows' PAGE_* constants.
+const (
+	ProtectReadOnly  uint32 = 0x02
+	ProtectReadWrite uint32 = 0x04
+)
+
+const maxChunkSize = 4096 // Just an abitrary size
+
+// A contiguous range of memory with the same attributes
+type MemoryRegion struct {
+	BaseAddress uintptr
+	RegionSize  uintptr
+}
+
+// ProcessMemory is the memory of a process that can be searched and patched.
+type ProcessMemory interface {
+	// Regions returns the readable memory regions that overlap [start, end), in ascending order.
+	Regions(start uintptr, end uintptr) ([]MemoryRegion, error)
+	// Read reads len(buf) bytes at addr. Returns the number of bytes read.
+	Read(addr uintptr, buf []byte) (int, error)
+	// Write writes buf at addr. Returns the number of bytes written.
+	Write(addr uintptr, buf []byte) (int, error)
+	// Protect sets the page protection of [addr, addr+size) and returns the previous protection.
+	Protect(addr uintptr, size uintptr, protect uint32) (uint32, error)
+}
+
+func SearchMemory(mem ProcessMemory, LPBaseOfDll uintptr, SizeOfImage uint32, value []byte, altvalue []byte) (uintptr, error) {
+	imageEnd := LPBaseOfDll + uintptr(SizeOfImage)
+	regions, err := mem.Regions(LPBaseOfDll, imageEnd)
+	if err != nil {
+		return 0, fmt.Errorf("error getting memory regions: %w", err)
+	}
+
+	// chunkRollover moves the last bit of the chunk to the beginning of the next chunk
+	// This way, if the API is across 2 chunks, it will be caught. Basically an easy but inefficient circular buffer
+	// The size of the chunkRollover is the size of the biggest thing we are looking for minus 1
+	chunkRollover := int(max(uint32(len(value)), uint32(len(altvalue)))) - 1
+	chunk := make([]byte, maxChunkSize+chunkRollover)
+
+	var kept int     // Bytes at the beginning of chunk that are left over from the previous read
+	var next uintptr // Address right after the last byte read
+	for _, region := range regions {
+		// Don't search beyond the end of the application memory
+		start := region.BaseAddress
+		if start < LPBaseOfDll {
+			start = LPBaseOfDll
+		}
+		end := region.BaseAddress + region.RegionSize
+		if end > imageEnd {
+			end = imageEnd
+		}
+		if start != next { // Only roll over between regions that are next to each other
+			kept = 0
+		}
+
+		for p := start; p < end; {
+			size := maxChunkSize
+			if uintptr(size) > end-p {
+				size = int(end - p)
+			}
+			bytesRead, err := mem.Read(p, chunk[kept:kept+size])
+			if err != nil {
+				return 0, fmt.Errorf("error reading memory at 0x%x: %w", p, err)
+			}
+			if bytesRead == 0 {
+				break
+			}
+			window := chunk[:kept+bytesRead]
+			windowStart := p - uintptr(kept)
+
+			// See if the chunk contains the API url and get its offset if its there
+			// Only gets the first instance of the API url in memory
+			if ind := bytes.Index(window, value); ind != -1 {
+				return windowStart + uintptr(ind) - LPBaseOfDll, nil
+			}
+			// If the chunk doesn't have the API address, check if its already been patched?
+			if ind := bytes.Index(window, altvalue); ind != -1 {
+				return windowStart + uintptr(ind) - LPBaseOfDll, ErrProcessAlreadyPatched
+			}
+
+			p += uintptr(bytesRead)
+			next = p
+			// Move the last bytes of the chunk to the beginning
+			kept = chunkRollover
+			if kept > len(window) {
+				kept = len(window)
+			}
+			copy(chunk, window[len(window)-kept:])
+		}
+	}
+
+	return 0, ErrAPINotFound
+}
+
+func VerifyAPIPatch(mem ProcessMemory, addr uintptr, old []byte, new []byte) error {
+	var buf = make([]byte, len(old))
+
+	// Verify we're at the correct offset
+	bytesRead, err := mem.Read(addr, buf)
+	if err != nil {
+		return fmt.Errorf("error reading memory: %w", err)
+	}
+
+	if !bytes.Equal(buf[:bytesRead], old) {
+		if bytes.Equal(buf[:min(uint32(bytesRead), uint32(len(new)))], new) {
+			return ErrProcessAlreadyPatched
+		}
+		return fmt.Errorf("%q does not match signature at offset 0x%x", buf[:bytesRead], addr)
+	}
+
+	return nil
+}
+
+// PatchMemory replaces old with new in the module loaded at base.
+// offsetAddr is where old is expected to be. If it's not there the whole module is searched.
+// Returns the offset that was patched.
+func PatchMemory(mem ProcessMemory, base uintptr, sizeOfImage uint32, offsetAddr uintptr, old []byte, new []byte) (uintptr, error) {
+	var requestedOffset = offsetAddr
+	var addr = base + offsetAddr
+
+	// Check if the API is at the offset specified
+	err := VerifyAPIPatch(mem, addr, old, new)
+	if err != nil {
+		// If the offset doesn't have the old or new API address, try searching memory
+		offsetAddr, err = SearchMemory(mem, base, sizeOfImage, old, new)
+		if err != nil {
+			return offsetAddr, err
+		}
+		addr = base + offsetAddr
+	}
+
+	// Set memory writable
+	oldProtect, err := mem.Protect(addr, uintptr(len(old)), ProtectReadWrite)
+	if err != nil {
+		return offsetAddr, fmt.Errorf("error setting memory protection: %w", err)
+	}
+
+	buf := make([]byte, len(old))
+	copy(buf, new)
+	_, err = mem.Write(addr, buf)
+	if err != nil {
+		return offsetAddr, fmt.Errorf("error writing memory: %w", err)
+	}
+
+	// re-protect memory after patching
+	_, err = mem.Protect(addr, uintptr(len(old)), oldProtect)
+	if err != nil {
+		return offsetAddr, fmt.Errorf("error setting memory protection: %w", err)
+	}
+
+	if offsetAddr != requestedOffset {
+		return offsetAddr, ErrOffsetMismatch
+	}
+	return offsetAddr, nil
+}
@@ -0,0 +1,123 @@
+package patcher
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var (
+	testOldURL = []byte("https://ggst-game.guiltygear.com/api/")
+	testNewURL = []byte("http://127.0.0.1:21611/api/")
+)
+
+const testBase uintptr = 0x140000000
+
+// Memory of size bytes with url at offset, or no URL if offset is negative
+func testMemory(size int, offset int, url []byte) []byte {
+	data := bytes.Repeat([]byte{0xcc}, size)
+	if offset >= 0 {
+		copy(data[offset:], url)
+	}
+	return data
+}
+
+func TestSearchMemory(t *testing.T) {
+	tests := []struct {
+		name       string
+		size       int
+		offset     int
+		url        []byte
+		regionSize uintptr
+		readLimit  int
+		wantOffset uintptr
+		wantErr    error
+	}{
+		{name: "first chunk", size: 3 * maxChunkSize, offset: 100, url: testOldURL, wantOffset: 100},
+		{name: "across chunks", size: 3 * maxChunkSize, offset: maxChunkSize - 10, url: testOldURL, wantOffset: maxChunkSize - 10},
+		{name: "across later chunks", size: 3 * maxChunkSize, offset: 2*maxChunkSize - 1, url: testOldURL, wantOffset: 2*maxChunkSize - 1},
+		{name: "across regions", size: 3 * maxChunkSize, offset: 1000 - 5, url: testOldURL, regionSize: 1000, wantOffset: 1000 - 5},
+		{name: "across short reads", size: 3 * maxChunkSize, offset: 500 - 20, url: testOldURL, readLimit: 500, wantOffset: 500 - 20},
+		{name: "at end", size: 2 * maxChunkSize, offset: 2*maxChunkSize - len(testOldURL), url: testOldURL, wantOffset: uintptr(2*maxChunkSize - len(testOldURL))},
+		{name: "already patched", size: 3 * maxChunkSize, offset: maxChunkSize - 3, url: testNewURL, wantOffset: maxChunkSize - 3, wantErr: ErrProcessAlreadyPatched},
+		{name: "missing", size: 3 * maxChunkSize, offset: -1, wantErr: ErrAPINotFound},
+		{name: "partial", size: 3 * maxChunkSize, offset: 3*maxChunkSize - 10, url: testOldURL, wantErr: ErrAPINotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewFakeProcessMemory(testBase, testMemory(tt.size, tt.offset, tt.url))
+			mem.RegionSize = tt.regionSize
+			mem.ReadLimit = tt.readLimit
+			offset, err := SearchMemory(mem, testBase, uint32(tt.size), testOldURL, testNewURL)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != ErrAPINotFound && offset != tt.wantOffset {
+				t.Errorf("offset = 0x%x, want 0x%x", offset, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func TestPatchMemory(t *testing.T) {
+	const size = 4 * maxChunkSize
+	tests := []struct {
+		name       string
+		offset     int
+		url        []byte
+		regionSize uintptr
+		wantOffset uintptr
+		wantErr    error
+		wantPatch  bool
+	}{
+		{name: "expected offset", offset: 0x2000, url: testOldURL, wantOffset: 0x2000, wantPatch: true},
+		{name: "different offset", offset: 0x3010, url: testOldURL, wantOffset: 0x3010, wantErr: ErrOffsetMismatch, wantPatch: true},
+		{name: "different offset across regions", offset: 0x1000 - 8, url: testOldURL, regionSize: 0x1000, wantOffset: 0x1000 - 8, wantErr: ErrOffsetMismatch, wantPatch: true},
+		{name: "already patched", offset: 0x2000, url: testNewURL, wantOffset: 0x2000, wantErr: ErrProcessAlreadyPatched},
+		{name: "already patched elsewhere", offset: 0x10, url: testNewURL, wantOffset: 0x10, wantErr: ErrProcessAlreadyPatched},
+		{name: "missing", offset: -1, wantErr: ErrAPINotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewFakeProcessMemory(testBase, testMemory(size, tt.offset, tt.url))
+			mem.RegionSize = tt.regionSize
+			offset, err := PatchMemory(mem, testBase, size, 0x2000, testOldURL, testNewURL)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != ErrAPINotFound && offset != tt.wantOffset {
+				t.Errorf("offset = 0x%x, want 0x%x", offset, tt.wantOffset)
+			}
+			if !tt.wantPatch {
+				return
+			}
+
+			want := make([]byte, len(testOldURL))
+			copy(want, testNewURL)
+			if got := mem.Data[tt.offset : tt.offset+len(testOldURL)]; !bytes.Equal(got, want) {
+				t.Errorf("patched memory = %q, want %q", got, want)
+			}
+			if mem.Protection != ProtectReadOnly {
+				t.Errorf("protection = 0x%x, want it restored to 0x%x", mem.Protection, ProtectReadOnly)
+			}
+		})
+	}
+}
+
+func TestPatchMemoryWriteError(t *testing.T) {
+	mem := &failingMemory{FakeProcessMemory: NewFakeProcessMemory(testBase, testMemory(maxChunkSize, 0x100, testOldURL))}
+	_, err := PatchMemory(mem, testBase, maxChunkSize, 0x100, testOldURL, testNewURL)
+	if !errors.Is(err, errTestWrite) {
+		t.Fatalf("err = %v, want it to wrap %v", err, errTestWrite)
+	}
+}
+
+var errTestWrite = errors.New("access denied")
+
+type failingMemory struct {
+	*FakeProcessMemory
+}
+
+func (m *failingMemory) Write(addr uintptr, buf []byte) (int, error) {
+	return 0, errTestWrite
+}
@@ -0,0 +1,206 @@
+package patcher
+
+// Linux backend for patching GGST running under Wine/Proton.
+// Wine maps the PE image of the game into a normal Linux process, so everything can be done through /proc.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A mapping from /proc/<pid>/maps
+type memoryMapping struct {
+	Start    uintptr
+	End      uintptr
+	Readable bool
+	Path     string
+}
+
+func readMappings(pid uint32) ([]memoryMapping, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("error opening maps: %w", err)
+	}
+	defer f.Close()
+
+	var mappings []memoryMapping
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: address perms offset dev inode pathname
+		// eg. 140000000-140001000 r--p 00000000 103:02 1234 /path/to/GGST-Win64-Shipping.exe
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			continue
+		}
+		start, err := strconv.ParseUint(addrs[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing mapping %q: %w", fields[0], err)
+		}
+		end, err := strconv.ParseUint(addrs[1], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing mapping %q: %w", fields[0], err)
+		}
+		mapping := memoryMapping{
+			Start:    uintptr(start),
+			End:      uintptr(end),
+			Readable: strings.HasPrefix(fields[1], "r"),
+		}
+		if len(fields) >= 6 {
+			mapping.Path = strings.Join(fields[5:], " ") // Paths can have spaces in them
+		}
+		mappings = append(mappings, mapping)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading maps: %w", err)
+	}
+	return mappings, nil
+}
+
+// Wine passes the Windows path of the exe as argv[0], eg. Z:\home\user\...\GGST-Win64-Shipping.exe
+func exeName(arg0 string) string {
+	if i := strings.LastIndexAny(arg0, `/\`); i != -1 {
+		return arg0[i+1:]
+	}
+	return arg0
+}
+
+func GetProc(proc string) (uint32, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, fmt.Errorf("error reading /proc: %w", err)
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue // Not a process
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue // Process exited or is a kernel thread
+		}
+		arg0, _, _ := bytes.Cut(cmdline, []byte{0})
+		if strings.EqualFold(exeName(string(arg0)), proc) {
+			return uint32(pid), nil
+		}
+	}
+	return 0, ErrProcessNotFound
+}
+
+// Find where Wine mapped the module and how big its image is.
+func findModule(pid uint32, mem *os.File, moduleName string) (uintptr, uint32, error) {
+	mappings, err := readMappings(pid)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var base uintptr
+	var end uintptr
+	for i, mapping := range mappings {
+		if !strings.EqualFold(filepath.Base(mapping.Path), moduleName) {
+			continue
+		}
+		base = mapping.Start
+		end = mapping.End
+		// Sections can be mapped anonymously right after the headers, so follow contiguous mappings.
+		for _, next := range mappings[i+1:] {
+			if next.Start != end || (next.Path != "" && next.Path != mapping.Path) {
+				break
+			}
+			end = next.End
+		}
+		break
+	}
+	if base == 0 {
+		return 0, 0, fmt.Errorf("couldn't find base module for %v", moduleName)
+	}
+
+	// Prefer SizeOfImage from the PE header so we search the same range as on Windows.
+	if size, err := imageSize(mem, base); err == nil {
+		return base, size, nil
+	}
+	return base, uint32(end - base), nil
+}
+
+func imageSize(mem *os.File, base uintptr) (uint32, error) {
+	var peOffset [4]byte
+	_, err := mem.ReadAt(peOffset[:], int64(base+0x3c)) // IMAGE_DOS_HEADER.e_lfanew
+	if err != nil {
+		return 0, err
+	}
+	var sizeOfImage [4]byte
+	// Skip PE signature (4) and IMAGE_FILE_HEADER (20) to get to IMAGE_OPTIONAL_HEADER.SizeOfImage (56)
+	_, err = mem.ReadAt(sizeOfImage[:], int64(base+uintptr(binary.LittleEndian.Uint32(peOffset[:]))+4+20+56))
+	if err != nil {
+		return 0, err
+	}
+	size := binary.LittleEndian.Uint32(sizeOfImage[:])
+	if size == 0 {
+		return 0, fmt.Errorf("invalid SizeOfImage at 0x%x", base)
+	}
+	return size, nil
+}
+
+// linuxProcessMemory accesses another process's memory through /proc/<pid>/mem.
+// Writes through /proc/<pid>/mem ignore page protections, so Protect doesn't need to do anything.
+type linuxProcessMemory struct {
+	pid uint32
+	mem *os.File
+}
+
+func (m *linuxProcessMemory) Regions(start uintptr, end uintptr) ([]MemoryRegion, error) {
+	mappings, err := readMappings(m.pid)
+	if err != nil {
+		return nil, err
+	}
+	var regions []MemoryRegion
+	for _, mapping := range mappings {
+		if !mapping.Readable || mapping.End <= start || mapping.Start >= end {
+			continue
+		}
+		regions = append(regions, MemoryRegion{BaseAddress: mapping.Start, RegionSize: mapping.End - mapping.Start})
+	}
+	return regions, nil
+}
+
+func (m *linuxProcessMemory) Read(addr uintptr, buf []byte) (int, error) {
+	n, err := m.mem.ReadAt(buf, int64(addr))
+	if n > 0 {
+		return n, nil // Short reads are fine
+	}
+	return n, err
+}
+
+func (m *linuxProcessMemory) Write(addr uintptr, buf []byte) (int, error) {
+	return m.mem.WriteAt(buf, int64(addr))
+}
+
+func (m *linuxProcessMemory) Protect(addr uintptr, size uintptr, protect uint32) (uint32, error) {
+	return protect, nil
+}
+
+func PatchProc(pid uint32, moduleName string, offsetAddr uintptr, old []byte, new []byte) (uintptr, error) {
+	// Needs ptrace access to the process, which is the case for processes started by the same user unless Yama is set to 2+.
+	mem, err := os.OpenFile(fmt.Sprintf("/proc/%d/mem", pid), os.O_RDWR, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error opening process memory: %w", err)
+	}
+	defer mem.Close()
+
+	base, sizeOfImage, err := findModule(pid, mem, moduleName)
+	if err != nil {
+		return 0, err
+	}
+
+	return PatchMemory(&linuxProcessMemory{pid: pid, mem: mem}, base, sizeOfImage, offsetAddr, old, new)
+}
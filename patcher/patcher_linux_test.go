@@ -0,0 +1,113 @@
+package patcher
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const (
+	testModule    = "GGST-Win64-Shipping.exe"
+	testURLOffset = 0x1234
+	testImageSize = 0x3000
+)
+
+// Runs as the child process of TestPatchProc. Maps the fake exe like Wine would and shows its contents once patched.
+func TestHelperProcess(t *testing.T) {
+	path := os.Getenv("TOTSUGEKI_TEST_MODULE")
+	if path == "" {
+		t.Skip("Only run by TestPatchProc")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, testImageSize, syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("ready")
+	bufio.NewReader(os.Stdin).ReadString('\n') // Wait for the patch
+	fmt.Printf("%s\n", data[testURLOffset:testURLOffset+len(testOldURL)])
+	os.Exit(0)
+}
+
+// A file that looks enough like a PE image for findModule, with the URL at testURLOffset
+func writeTestModule(t *testing.T) string {
+	image := make([]byte, testImageSize)
+	binary.LittleEndian.PutUint32(image[0x3c:], 0x40)                  // e_lfanew
+	binary.LittleEndian.PutUint32(image[0x40+4+20+56:], testImageSize) // SizeOfImage
+	copy(image[testURLOffset:], testOldURL)
+	path := filepath.Join(t.TempDir(), testModule)
+	err := os.WriteFile(path, image, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPatchProc(t *testing.T) {
+	path := writeTestModule(t)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Args[0] = `Z:\steamapps\common\GGST\` + testModule // What Wine passes as argv[0]
+	cmd.Env = append(os.Environ(), "TOTSUGEKI_TEST_MODULE="+path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	stdout := bufio.NewReader(stdoutPipe)
+	if line, _ := stdout.ReadString('\n'); line != "ready\n" {
+		t.Fatalf("child process failed: %q", line)
+	}
+
+	pid, err := GetProc(testModule)
+	if err != nil {
+		t.Fatalf("GetProc: %v", err)
+	}
+	if pid != uint32(cmd.Process.Pid) {
+		t.Fatalf("GetProc = %d, want %d", pid, cmd.Process.Pid)
+	}
+
+	offset, err := PatchProc(pid, testModule, testURLOffset, testOldURL, testNewURL)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skipf("No ptrace access to child process: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("PatchProc: %v", err)
+	}
+	if offset != testURLOffset {
+		t.Errorf("offset = 0x%x, want 0x%x", offset, testURLOffset)
+	}
+
+	offset, err = PatchProc(pid, testModule, testURLOffset, testOldURL, testNewURL)
+	if !errors.Is(err, ErrProcessAlreadyPatched) || offset != testURLOffset {
+		t.Errorf("second PatchProc = 0x%x, %v, want 0x%x, %v", offset, err, testURLOffset, ErrProcessAlreadyPatched)
+	}
+
+	io.WriteString(stdin, "\n")
+	line, _ := stdout.ReadString('\n')
+	if got := strings.TrimRight(line, "\x00\n"); got != string(testNewURL) {
+		t.Errorf("child memory = %q, want %q", got, testNewURL)
+	}
+	cmd.Wait()
+}
@@ -0,0 +1,138 @@
+package patcher
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// windowsProcessMemory accesses another process's memory through a handle from OpenProcess.
+type windowsProcessMemory struct {
+	proc windows.Handle
+}
+
+func (m *windowsProcessMemory) Regions(start uintptr, end uintptr) ([]MemoryRegion, error) {
+	// Information about the contents of the memory to read
+	var memoryBasicInfo windows.MemoryBasicInformation
+
+	var regions []MemoryRegion
+	for p := start; p < end; p = memoryBasicInfo.BaseAddress + memoryBasicInfo.RegionSize {
+		err := windows.VirtualQueryEx(m.proc, p, &memoryBasicInfo, unsafe.Sizeof(memoryBasicInfo))
+		if err != nil {
+			return nil, fmt.Errorf("error in VirtualQueryEx: %w", err)
+		}
+		regions = append(regions, MemoryRegion{BaseAddress: memoryBasicInfo.BaseAddress, RegionSize: memoryBasicInfo.RegionSize})
+	}
+	return regions, nil
+}
+
+func (m *windowsProcessMemory) Read(addr uintptr, buf []byte) (int, error) {
+	var bytesRead uintptr
+	err := windows.ReadProcessMemory(m.proc, addr, &buf[0], uintptr(len(buf)), &bytesRead)
+	if err != nil {
+		return int(bytesRead), fmt.Errorf("error in ReadProcessMemory: %w", err)
+	}
+	return int(bytesRead), nil
+}
+
+func (m *windowsProcessMemory) Write(addr uintptr, buf []byte) (int, error) {
+	var bytesWritten uintptr
+	err := windows.WriteProcessMemory(m.proc, addr, &buf[0], uintptr(len(buf)), &bytesWritten)
+	if err != nil {
+		return int(bytesWritten), fmt.Errorf("error in WriteProcessMemory: %w", err)
+	}
+	return int(bytesWritten), nil
+}
+
+func (m *windowsProcessMemory) Protect(addr uintptr, size uintptr, protect uint32) (uint32, error) {
+	var oldProtect uint32
+	err := windows.VirtualProtectEx(m.proc, addr, size, protect, &oldProtect)
+	if err != nil {
+		return 0, fmt.Errorf("error in VirtualProtectEx: %w", err)
+	}
+	return oldProtect, nil
+}
+
+func GetProc(proc string) (uint32, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error in CreateToolhelp32Snapshot: %w", err)
+	}
+	defer windows.CloseHandle(snapshot)
+	var pe32 windows.ProcessEntry32
+
+	pe32.Size = uint32(unsafe.Sizeof(pe32)) // NB: https://docs.microsoft.com/en-us/windows/win32/api/tlhelp32/ns-tlhelp32-processentry32
+
+	if err = windows.Process32First(snapshot, &pe32); err != nil {
+		return 0, fmt.Errorf("error in Process32First: %w", err)
+	}
+
+	for {
+		procName := windows.UTF16ToString(pe32.ExeFile[:]) // Windows strings are UTF-16
+		if procName == proc {
+			return pe32.ProcessID, nil
+		}
+		err = windows.Process32Next(snapshot, &pe32)
+		if err != nil {
+			if winErr, ok := err.(syscall.Errno); ok {
+				if winErr == windows.ERROR_NO_MORE_FILES {
+					break
+				}
+			}
+			return 0, fmt.Errorf("error in Process32Next: %w", err)
+		}
+	}
+	return 0, ErrProcessNotFound
+}
+
+func PatchProc(pid uint32, moduleName string, offsetAddr uintptr, old []byte, new []byte) (uintptr, error) {
+	proc, err := windows.OpenProcess(windows.PROCESS_VM_READ|windows.PROCESS_VM_WRITE|windows.PROCESS_VM_OPERATION|windows.PROCESS_QUERY_INFORMATION, false, pid)
+	if err != nil {
+		return 0, fmt.Errorf("error in OpenProcess: %w", err)
+	}
+	defer windows.CloseHandle(proc)
+
+	var modules [512]windows.Handle // TODO: Don't hardcode
+	var cb = uint32(unsafe.Sizeof(modules))
+	var cbNeeded uint32
+
+	err = windows.EnumProcessModules(proc, &modules[0], cb, &cbNeeded)
+	if err != nil && err != windows.ERROR_PARTIAL_COPY { // Partial copies are fine
+		return 0, fmt.Errorf("error in EnumProcessModules: %w", err)
+	}
+
+	// Look for base module
+	var i uint32
+	var module windows.Handle
+	for i = 0; i < cbNeeded/uint32(unsafe.Sizeof(modules[0])); i++ {
+		var moduleNameBuf [260]uint16 // TODO: Don't hardcode
+		err = windows.GetModuleFileNameEx(proc, modules[i], &moduleNameBuf[0], uint32(len(moduleNameBuf)))
+		if err != nil {
+			return 0, fmt.Errorf("error in GetModuleFileNameExA: %w", err)
+		}
+
+		if strings.EqualFold(filepath.Base(strings.TrimRight(windows.UTF16ToString(moduleNameBuf[:]), "\000")), moduleName) {
+			module = modules[i]
+			break
+		}
+	}
+	if module == 0 {
+		return 0, fmt.Errorf("couldn't find base module for %v", moduleName)
+	}
+
+	// Get Entrypoint so we have an idea where GGST's memory starts
+	var moduleInfo = windows.ModuleInfo{}
+
+	cb = uint32(unsafe.Sizeof(moduleInfo))
+
+	err = windows.GetModuleInformation(proc, module, &moduleInfo, cb)
+	if err != nil { // err is always set, even on success. Need to look at return value
+		return 0, fmt.Errorf("error in GetModuleInformationCall: %w", err)
+	}
+
+	return PatchMemory(&windowsProcessMemory{proc: proc}, moduleInfo.BaseOfDll, moduleInfo.SizeOfImage, offsetAddr, old, new)
+}
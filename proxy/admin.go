@@ -0,0 +1,36 @@
+package proxy
+
+// Local admin server, kept off the proxy port so GGST never sees it.
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (s *StriveAPIProxy) adminRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Method("GET", "/metrics", s.Metrics)
+	r.With(loopbackOnly).Get("/", s.HandleDashboard)
+	r.With(loopbackOnly).Get("/status", s.HandleDashboardStatus)
+	if s.notes != nil {
+		r.With(loopbackOnly).Get("/notes", s.notes.NotesPage)
+		r.With(loopbackOnly).Post("/notes", s.notes.NotesPage)
+	}
+	return r
+}
+
+// StartAdminServer serves the admin endpoints in the background if an admin address was set
+func (s *StriveAPIProxy) StartAdminServer() {
+	if s.AdminServer == nil {
+		return
+	}
+	s.logger.Info("Started admin server", "listen", s.AdminServer.Addr)
+	go func() {
+		err := s.AdminServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Admin server stopped", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Request to the admin server on port 8080 from remote, coming in on the same IP as remote like a browser on this
+// machine would. Posts the form like the notes page does.
+func adminRequest(method string, path string, remote string, form url.Values) *http.Request {
+	ip, _, _ := net.SplitHostPort(remote)
+	local := &net.TCPAddr{IP: net.ParseIP(ip), Port: 8080}
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, net.Addr(local)))
+	req.RemoteAddr = remote
+	req.Host = local.String()
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Origin", "http://"+local.String())
+	}
+	return req
+}
+
+// Pages that show player IDs or can change files only answer the same machine, even if metrics are served to the LAN
+func TestAdminLoopbackOnly(t *testing.T) {
+	tp := newTestProxy(t, newTestUpstream(t), StriveAPIProxyOptions{NotesFile: filepath.Join(t.TempDir(), "notes.json")})
+	defer tp.shutdown(t)
+	admin := tp.proxy.adminRouter()
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/"},
+		{"GET", "/status"},
+		{"GET", "/notes"},
+		{"POST", "/notes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			for remote, want := range map[string]bool{"127.0.0.1:50000": true, "[::1]:50000": true, "192.168.1.20:50000": false} {
+				req := adminRequest(tt.method, tt.path, remote, url.Values{"token": {tp.proxy.notes.token}})
+				w := httptest.NewRecorder()
+				admin.ServeHTTP(w, req)
+				if forbidden := w.Code == http.StatusForbidden; forbidden == want {
+					t.Errorf("from %s = %d", remote, w.Code)
+				}
+			}
+		})
+	}
+
+	// Metrics are for anyone who can reach the admin port
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.RemoteAddr = "192.168.1.20:50000"
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("/metrics from the LAN = %d", w.Code)
+	}
+}
+
+var testTokenInput = regexp.MustCompile(`name="token" value="([0-9a-f]+)"`)
+
+// Other sites can't post the notes form, even with a DNS name pointed at 127.0.0.1
+func TestNotesPageForgery(t *testing.T) {
+	tp := newTestProxy(t, newTestUpstream(t), StriveAPIProxyOptions{NotesFile: filepath.Join(t.TempDir(), "notes.json")})
+	defer tp.shutdown(t)
+	admin := tp.proxy.adminRouter()
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, adminRequest("GET", "/notes", "127.0.0.1:50000", nil))
+	match := testTokenInput.FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || match == nil {
+		t.Fatalf("notes page = %d, no token in:\n%s", w.Code, w.Body.String())
+	}
+	token := match[1]
+
+	tests := []struct {
+		name   string
+		edit   func(req *http.Request)
+		token  string
+		remote string
+		want   int
+	}{
+		{name: "from the page", token: token, want: http.StatusSeeOther},
+		{name: "from the page over IPv6", token: token, remote: "[::1]:50000", want: http.StatusSeeOther},
+		{name: "as localhost", token: token, edit: func(req *http.Request) {
+			req.Host = "localhost:8080"
+			req.Header.Set("Origin", "http://localhost:8080")
+		}, want: http.StatusSeeOther},
+		{name: "referer only", token: token, edit: func(req *http.Request) {
+			req.Header.Del("Origin")
+			req.Header.Set("Referer", "http://127.0.0.1:8080/notes?user_id=210611081234567890")
+		}, want: http.StatusSeeOther},
+		{name: "no token", want: http.StatusForbidden},
+		{name: "wrong token", token: strings.Repeat("0", len(token)), want: http.StatusForbidden},
+		{name: "no origin", token: token, edit: func(req *http.Request) { req.Header.Del("Origin") }, want: http.StatusForbidden},
+		{name: "null origin", token: token, edit: func(req *http.Request) { req.Header.Set("Origin", "null") }, want: http.StatusForbidden},
+		{name: "other site", token: token, edit: func(req *http.Request) { req.Header.Set("Origin", "http://example.com") }, want: http.StatusForbidden},
+		{name: "other port", token: token, edit: func(req *http.Request) { req.Header.Set("Origin", "http://127.0.0.1:8081") }, want: http.StatusForbidden},
+		{name: "rebound name", token: token, edit: func(req *http.Request) {
+			req.Host = "attacker.example:8080"
+			req.Header.Set("Origin", "http://attacker.example:8080")
+		}, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := tt.remote
+			if remote == "" {
+				remote = "127.0.0.1:50000"
+			}
+			form := url.Values{"user_id": {testOtherUserID}, "note": {"Note"}}
+			if tt.token != "" {
+				form.Set("token", tt.token)
+			}
+			req := adminRequest("POST", "/notes", remote, form)
+			if tt.edit != nil {
+				tt.edit(req)
+			}
+			w := httptest.NewRecorder()
+			admin.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("post = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	// Nor read it
+	req := adminRequest("GET", "/notes", "127.0.0.1:50000", nil)
+	req.Host = "attacker.example:8080"
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("notes page as attacker.example = %d", w.Code)
+	}
+}
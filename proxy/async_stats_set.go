@@ -3,103 +3,123 @@ package proxy
 import (
 	"bytes"
 	"context"
-	"encoding/binary"
-	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/optix2000/totsugeki/ggst"
 	"golang.org/x/time/rate"
 )
 
 // UNSAFE
 // HandleStatsSet is the handler for buffered stats/set so the stats can be flushed asynchronously from the game.
 func (s *StriveAPIProxy) HandleStatsSet(w http.ResponseWriter, r *http.Request) {
-	req := r.Clone(context.Background())
 	// https://github.com/golang/go/issues/36095
 	var b bytes.Buffer
 	b.ReadFrom(r.Body)
-	req.Body = io.NopCloser(bytes.NewReader(b.Bytes()))
-
-	s.statsQueue <- req
-
-	// Fake headers (v1.07)
-	header := w.Header()
-
-	header.Set("Content-Type", "text/html; charset=UTF-8") // GGST didn't care if this wasn't set, but why not
-	header.Set("Server", "Apache")                         // GGST didn't care if this wasn't set, but why not
-	header.Set("X-Powered-By", "PHP/7.2.34")               // GGST didn't care if this wasn't set, but why not
-
-	// Fake body (v1.07)
-	type statsSetBody struct { // 59 bytes
-		Header    [4]byte  // Unknown use. Always 0x9298ad36
-		Hash      [12]byte // Some sort of incrementing hash? Maybe a Req/Resp ID.
-		Spacer1   [2]byte  // Unknown use. Always 0x00b3
-		Timestamp [19]byte // Current time in "YYYY/MM/DD HH:MM:SS" in UTC
-		Spacer2   [1]byte  // Unknown use. Always 0xa5
-		Version1  [5]byte  // Some sort of ASCII version number. "0.1.1" in v1.16. "0.0.7" in v1.10. "0.0.6" in v1.07. "0.0.5" in v1.06, was "0.0.4" in v1.05
-		Spacer3   [1]byte  // Unknown use. Always 0xa5
-		Version2  [5]byte  // Another version number. Always "0.0.2"
-		Spacer4   [1]byte  // Unknown use. Always 0xa5
-		Version3  [5]byte  // ANOTHER version number. Always "0.0.2"
-		Footer    [4]byte  // Unknown use. 0xa0a09100
-	}
-
-	var hash [12]byte // Does it even matter if we fill this?
-	copy(hash[:], "badddeadc0de")
-
-	var timestamp [19]byte
-	copy(timestamp[:], time.Now().UTC().Format("2006/01/02 15:04:05"))
-
-	body := statsSetBody{
-		Header:    [4]byte{0x92, 0x98, 0xad, 0x36},
-		Hash:      hash,
-		Spacer1:   [2]byte{0x00, 0xb3},
-		Timestamp: timestamp,
-		Spacer2:   [1]byte{0xa5},
-		Version1:  [5]byte{0x30, 0x2e, 0x31, 0x2e, 0x31}, // 0.1.1
-		Spacer3:   [1]byte{0xa5},
-		Version2:  [5]byte{0x30, 0x2e, 0x30, 0x2e, 0x32}, // 0.0.2
-		Spacer4:   [1]byte{0xa5},
-		Version3:  [5]byte{0x30, 0x2e, 0x30, 0x2e, 0x32}, // 0.0.2
-		Footer:    [4]byte{0xa0, 0xa0, 0x91, 0x00},
-	}
-
-	err := binary.Write(w, binary.BigEndian, body)
+	entry := &StatsJournalEntry{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Header: r.Header.Clone(),
+		Body:   b.Bytes(),
+		Time:   time.Now(),
+	}
+
+	// Only lie to GGST once the stats are safe on disk
+	if s.statsJournal != nil {
+		err := s.statsJournal.Add(entry)
+		if err != nil {
+			s.statsSetLogger.Error("Could not journal stats, uploading synchronously", "endpoint", endpoint(r), "err", err)
+			r.Body = io.NopCloser(bytes.NewReader(entry.Body))
+			s.HandleCatchall(w, r)
+			return
+		}
+	}
+
+	if !s.queueStats(entry) {
+		if entry.file == "" {
+			s.statsSetLogger.Warn("Shutting down, uploading synchronously", "endpoint", endpoint(r))
+			r.Body = io.NopCloser(bytes.NewReader(entry.Body))
+			s.HandleCatchall(w, r)
+			return
+		}
+		s.statsSetLogger.Warn("Shutting down, stats will be uploaded next start", "endpoint", endpoint(r), "file", entry.file)
+	}
+
+	// Fake response based on the last real one
+	header, body, err := s.statsSetTemplate.Response(r.URL.Path)
 	if err != nil {
-		fmt.Println(err)
+		s.statsSetLogger.Error("Could not create fake response", "endpoint", endpoint(r), "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for name, values := range header {
+		w.Header()[name] = values
 	}
+	w.Write(body)
 }
 
-func (s *StriveAPIProxy) startStatsSender() chan<- *http.Request {
-	reqQueue := make(chan *http.Request, 32) // TODO: Don't hardcode size. Needs to have enough for a normal /api/stats/set burst.
+// Queue entry for the sender. Returns false if the sender is stopping, which can happen while handlers are still running
+// if shutdown is cancelled early. Never blocks past the start of shutdown, even if the queue is full.
+func (s *StriveAPIProxy) queueStats(entry *StatsJournalEntry) bool {
+	s.statsQueueLock.RLock()
+	defer s.statsQueueLock.RUnlock()
+	if s.statsQueueClosed {
+		return false
+	}
+	s.statsPending.Add(1)
+	select {
+	case s.statsQueue <- entry:
+		return true
+	case <-s.statsStopping:
+		s.statsPending.Add(-1)
+		return false
+	}
+}
+
+// Backoff between upload retries
+const (
+	statsRetryMinBackoff = 100 * time.Millisecond // GGST always waits 100ms between API calls.
+	statsRetryMaxBackoff = 5 * time.Second
+	statsRetries         = 5 // GGST retries 5 times on stats/write
+)
+
+func (s *StriveAPIProxy) startStatsSender() chan<- *StatsJournalEntry {
+	reqQueue := make(chan *StatsJournalEntry, 32) // TODO: Don't hardcode size. Needs to have enough for a normal /api/stats/set burst.
+	s.statsLogin = make(chan *ggst.ClassifiedRequest, 1)
+	s.statsStopping = make(chan struct{})
+	s.statsCtx, s.statsCancel = context.WithCancel(context.Background())
+
+	// Stats from previous runs that ASW never confirmed. They have an old login hash, so they wait for GGST to log in again.
+	var leftover []*StatsJournalEntry
+	if s.statsJournal != nil {
+		var err error
+		leftover, err = s.statsJournal.Pending()
+		if err != nil {
+			s.statsSetLogger.Error("Could not read stats journal", "err", err)
+		}
+		if len(leftover) > 0 {
+			s.statsSetLogger.Info("Stats left over from last run will be uploaded after logging in.", "count", len(leftover))
+		}
+	}
+
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		rl := rate.NewLimiter(rate.Every(100*time.Millisecond), 1) // GGST always waits 100ms between API calls.
-		fmt.Println("Started /api/statistics/set sender.")
-		for req := range reqQueue {
-			// Retry the writes, since we're now responsible for them.
-			// Loses transparency here as we don't may not react the same was as the client.
-			for i := 0; i < 5; i++ { // GGST retries 5 times on stats/write
-				newReq := req.Clone(context.Background())
-				res, err := s.proxyRequest(newReq) // TODO: Maybe capture result to fake hashes better.
-				if err != nil {
-					fmt.Println(err)
-					rl.Wait(context.Background())
-					continue
-				}
-				if res.StatusCode != http.StatusOK {
-					fmt.Println(res)
-					io.Copy(io.Discard, res.Body)
-					res.Body.Close()
-					rl.Wait(context.Background())
-					continue
+		rl := rate.NewLimiter(rate.Every(statsRetryMinBackoff), 1)
+		s.statsSetLogger.Info("Started /api/statistics/set sender.")
+		for {
+			select {
+			case c := <-s.statsLogin:
+				leftover = s.uploadLeftoverStats(leftover, c, rl)
+			case entry, ok := <-reqQueue:
+				if !ok {
+					return // Leftovers that weren't sent are still in the journal
 				}
-				fmt.Println("Asynchronously uploaded stats.")
-				io.Copy(io.Discard, res.Body)
-				res.Body.Close()
-				break
+				s.uploadStats(entry, rl)
+				s.statsPending.Add(-1)
 			}
 		}
 	}()
@@ -107,8 +127,174 @@ func (s *StriveAPIProxy) startStatsSender() chan<- *http.Request {
 	return reqQueue
 }
 
-func (s *StriveAPIProxy) stopStatsSender() {
-	if s.statsQueue != nil {
-		close(s.statsQueue)
+// Upload the leftover stats of the user that just logged in, using their new login hash from c.
+// Returns the leftovers of other users.
+func (s *StriveAPIProxy) uploadLeftoverStats(leftover []*StatsJournalEntry, c *ggst.ClassifiedRequest, rl *rate.Limiter) []*StatsJournalEntry {
+	var kept []*StatsJournalEntry
+	var entries []*StatsJournalEntry
+	for _, entry := range leftover {
+		rewritten, err := entry.WithHeader(c)
+		if err != nil {
+			s.statsSetLogger.Debug("Not uploading leftover stats yet", "file", entry.file, "err", err)
+			kept = append(kept, entry)
+			continue
+		}
+		entries = append(entries, rewritten)
+	}
+	if len(entries) == 0 {
+		return kept
+	}
+
+	s.statsSetLogger.Info("Uploading stats left over from last run.", "count", len(entries))
+	s.statsPending.Add(int64(len(entries)))
+	for _, entry := range entries {
+		s.uploadStats(entry, rl)
+		s.statsPending.Add(-1)
+	}
+	return kept
+}
+
+// StatsLoginHandler tells the stats sender when GGST has logged in, with the first request that has the new login hash
+func (s *StriveAPIProxy) StatsLoginHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/user/login" {
+			rw := &CachingResponseWriter{w: w, code: http.StatusOK}
+			next.ServeHTTP(rw, r)
+			if rw.code == http.StatusOK {
+				s.statsLoggedIn.Store(true)
+			}
+			return
+		}
+		if c := classifiedRequest(r); c != nil && c.Header.Hash != "" && s.statsLoggedIn.CompareAndSwap(true, false) {
+			select {
+			case s.statsLogin <- c:
+			default: // The sender hasn't picked up the last login yet
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Upload a journaled request. It's only removed from the journal once ASW accepts it.
+// Retries forever with backoff while shutting down, until the shutdown deadline cancels statsCtx.
+func (s *StriveAPIProxy) uploadStats(entry *StatsJournalEntry, rl *rate.Limiter) {
+	logger := s.statsSetLogger.With("endpoint", apiEndpoint(entry.Path))
+	backoff := statsRetryMinBackoff
+	// Retry the writes, since we're now responsible for them.
+	// Loses transparency here as we don't may not react the same was as the client.
+	for attempt := 1; ; attempt++ {
+		if s.statsCtx.Err() != nil {
+			s.saveUnsentStats(entry)
+			return
+		}
+		rl.Wait(s.statsCtx)
+
+		req, err := entry.Request()
+		if err != nil {
+			logger.Error("Could not create upload request", "err", err)
+			return
+		}
+		res, err := s.proxyRequest(req.WithContext(s.statsCtx)) // TODO: Maybe capture result to fake hashes better.
+		if err == nil {
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				logger.Info("Asynchronously uploaded stats.", "attempt", attempt)
+				s.statsSetTemplate.Learn(entry.Path, res.Header, body)
+				if s.statsJournal != nil {
+					s.statsJournal.Remove(entry)
+				}
+				return
+			}
+			logger.Warn("Upload failed", "attempt", attempt, "status", res.StatusCode)
+		} else if s.statsCtx.Err() == nil {
+			logger.Warn("Upload failed", "attempt", attempt, "err", err)
+		}
+
+		if attempt >= statsRetries && !s.statsDraining.Load() {
+			if entry.file != "" && s.statsJournal != nil {
+				logger.Error("Giving up on uploading stats until next start.", "file", entry.file)
+				s.statsJournal.Failed(entry)
+			} else {
+				logger.Error("Giving up on uploading stats.")
+			}
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-s.statsCtx.Done():
+		}
+		backoff *= 2
+		if backoff > statsRetryMaxBackoff {
+			backoff = statsRetryMaxBackoff
+		}
+	}
+}
+
+// Make sure stats that couldn't be uploaded before the shutdown deadline are on disk for next start.
+// Journaled stats already are. Anything else goes to a journal in the temp directory.
+func (s *StriveAPIProxy) saveUnsentStats(entry *StatsJournalEntry) {
+	s.statsUnsent.Add(1)
+	if entry.file != "" {
+		return
+	}
+	dir := filepath.Join(os.TempDir(), "totsugeki-stats-journal")
+	journal, err := NewStatsJournal(dir, s.statsSetLogger)
+	if err == nil {
+		err = journal.Add(entry)
+	}
+	if err != nil {
+		s.statsSetLogger.Error("Could not save unsent stats. They are lost.", "err", err)
+		return
+	}
+	s.statsSetLogger.Warn("Saved unsent stats. Start with -stats-journal-dir pointing here to upload them.", "dir", dir)
+}
+
+// Upload everything left in the queue, retrying until timeout or ctx is done.
+func (s *StriveAPIProxy) stopStatsSender(ctx context.Context, timeout time.Duration) {
+	if s.statsQueue == nil {
+		return
+	}
+	// Arm the deadline first so nothing below can wait past it
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	context.AfterFunc(ctx, s.statsCancel) // Abort in flight uploads. Everything left is saved by saveUnsentStats.
+
+	s.statsDraining.Store(true)
+	close(s.statsStopping) // Handlers waiting on a full queue give up and leave their stats in the journal
+	s.statsQueueLock.Lock()
+	s.statsQueueClosed = true
+	close(s.statsQueue)
+	s.statsQueueLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	progress := time.NewTicker(time.Second)
+	defer progress.Stop()
+
+	if remaining := s.statsPending.Load(); remaining > 0 {
+		s.statsSetLogger.Info("Waiting for stats uploads to finish...", "remaining", remaining, "timeout", timeout)
+	}
+	for {
+		select {
+		case <-done:
+			s.statsCancel()
+			return
+		case <-progress.C:
+			s.statsSetLogger.Info("Waiting for stats uploads to finish...", "remaining", s.statsPending.Load())
+		case <-ctx.Done():
+			<-done
+			if s.statsJournal != nil {
+				s.statsSetLogger.Warn("Gave up waiting for stats uploads. They will be uploaded next start.", "unsent", s.statsUnsent.Load(), "dir", s.statsJournal.dir)
+			} else {
+				s.statsSetLogger.Warn("Gave up waiting for stats uploads.", "unsent", s.statsUnsent.Load())
+			}
+			return
+		}
 	}
 }
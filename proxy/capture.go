@@ -0,0 +1,153 @@
+package proxy
+
+// Records every request/response pair exchanged with ASW so sessions can be diffed across game versions.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+// CaptureEntry is a single request/response pair. Capture files are newline delimited JSON with one CaptureEntry per line.
+type CaptureEntry struct {
+	Time           time.Time   `json:"time"`
+	DurationMs     float64     `json:"duration_ms"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    []byte      `json:"request_body"`
+	RequestData    interface{} `json:"request_data,omitempty"` // Decoded msgpack from the data form field
+	StatusCode     int         `json:"status_code"`
+	ResponseHeader http.Header `json:"response_header"`
+	ResponseBody   []byte      `json:"response_body"`
+	ResponseData   interface{} `json:"response_data,omitempty"` // Decoded msgpack response
+}
+
+type Recorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	enc    *json.Encoder
+	logger *slog.Logger
+}
+
+// NewRecorder appends captured traffic to path
+func NewRecorder(path string, logger *slog.Logger) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open capture file: %w", err)
+	}
+	return &Recorder{
+		file:   file,
+		enc:    json.NewEncoder(file),
+		logger: logger,
+	}, nil
+}
+
+// ReadCapture reads all entries from a capture file
+func ReadCapture(path string) ([]CaptureEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open capture file: %w", err)
+	}
+	defer file.Close()
+
+	var entries []CaptureEntry
+	dec := json.NewDecoder(file)
+	for {
+		var entry CaptureEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, fmt.Errorf("could not read capture file: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (c *Recorder) Record(entry *CaptureEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.enc.Encode(entry)
+	if err != nil {
+		c.logger.Error("Could not record request", "path", entry.Path, "err", err)
+	}
+}
+
+func (c *Recorder) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.file.Close()
+}
+
+// Transport records every request sent through next and its response, as they went over the wire. Used as the transport to
+// ASW, this includes requests Totsugeki makes on its own, like stats prediction and async stats uploads, and leaves out
+// anything Totsugeki answers or rewrites itself.
+func (c *Recorder) Transport(next http.RoundTripper) http.RoundTripper {
+	return &recordTransport{next: next, recorder: c}
+}
+
+type recordTransport struct {
+	next     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		// RoundTrippers must not modify the request
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	entry := &CaptureEntry{
+		Time:          start,
+		Method:        req.Method,
+		Path:          req.URL.Path,
+		RequestHeader: req.Header.Clone(),
+		RequestBody:   body,
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	entry.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	entry.StatusCode = resp.StatusCode
+	entry.ResponseHeader = resp.Header.Clone()
+	entry.ResponseBody = respBody
+
+	// Best effort, not everything is msgpack
+	if data, err := ggst.DecodeRequestBody(body); err == nil && len(data) > 0 {
+		entry.RequestData, _ = ggst.UnmarshalAny(data)
+	}
+	if len(respBody) > 0 {
+		entry.ResponseData, _ = ggst.UnmarshalAny(respBody)
+	}
+
+	t.recorder.Record(entry)
+	return resp, nil
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecorderTransport(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "upstream")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(append([]byte("echo "), body...))
+	}))
+	t.Cleanup(upstream.Close)
+
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	recorder, err := NewRecorder(path, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{Transport: recorder.Transport(http.DefaultTransport)}
+	resp, err := client.Post(upstream.URL+"/api/statistics/get", "application/x-www-form-urlencoded", strings.NewReader("data="+testHeaderData+"96a007ffffffff\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	recorder.Close()
+
+	// The caller still gets the whole response
+	if want := "echo data=" + testHeaderData + "96a007ffffffff\x00"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+	entries, err := ReadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d entries, want 1", len(entries))
+	}
+	entry := entries[0]
+	if entry.Method != "POST" || entry.Path != "/api/statistics/get" || entry.StatusCode != http.StatusAccepted {
+		t.Errorf("entry = %s %s %d", entry.Method, entry.Path, entry.StatusCode)
+	}
+	if !bytes.Equal(entry.ResponseBody, body) || entry.ResponseHeader.Get("X-Test") != "upstream" {
+		t.Errorf("response = %q %v, want %q", entry.ResponseBody, entry.ResponseHeader, body)
+	}
+	if string(entry.RequestBody) != "data="+testHeaderData+"96a007ffffffff\x00" || entry.RequestData == nil {
+		t.Errorf("request = %q, decoded %v", entry.RequestBody, entry.RequestData)
+	}
+}
+
+// The capture has what ASW sent, not what the proxy rewrote or answered itself, and replays through -replay
+func TestProxyRecordsUpstream(t *testing.T) {
+	upstream := newTestUpstream(t)
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{AsyncStatsSet: true, StatsJournalDir: t.TempDir(), RecordFile: path})
+
+	_, env := tp.post(t, "sys/get_env", testHeaderData+"91cd0100")
+	tp.post(t, "user/login", testHeaderData+"91a0")
+	tp.post(t, "statistics/set", testHeaderData+"91a0") // Answered by the proxy, uploaded in the background
+	upstream.waitFor(t, "statistics/set", 1)
+	tp.shutdown(t)
+
+	entries, err := ReadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]CaptureEntry)
+	for _, entry := range entries {
+		got[entry.Path] = entry
+	}
+	for _, endpoint := range []string{"sys/get_env", "user/login", "statistics/set"} {
+		if n := upstream.count(endpoint); n != 1 {
+			t.Errorf("%s sent upstream %d times, want 1", endpoint, n)
+		}
+		if _, ok := got["/api/"+endpoint]; !ok {
+			t.Errorf("%s not recorded", endpoint)
+		}
+	}
+	if len(entries) != 3 {
+		t.Errorf("%d entries, want 3", len(entries))
+	}
+	recorded := got["/api/sys/get_env"].ResponseBody
+	if !bytes.Contains(recorded, []byte(upstream.server.URL)) || bytes.Contains(recorded, []byte(testPatchedAPIURL)) {
+		t.Errorf("recorded get_env = %q, want ASW's API URL", recorded)
+	}
+	if set := got["/api/statistics/set"]; !bytes.Equal(set.RequestBody, upstream.body("statistics/set")) {
+		t.Errorf("recorded statistics/set = %q, want %q", set.RequestBody, upstream.body("statistics/set"))
+	}
+
+	// Replaying the capture gives GGST the same responses
+	replay := newTestProxy(t, upstream, StriveAPIProxyOptions{ReplayFile: path})
+	code, replayed := replay.post(t, "sys/get_env", testHeaderData+"91cd0100")
+	if code != http.StatusOK || !bytes.Equal(replayed, env) {
+		t.Errorf("replayed get_env = %d %q, want %q", code, replayed, env)
+	}
+	if n := upstream.count("sys/get_env"); n != 1 {
+		t.Errorf("get_env sent upstream %d times while replaying", n)
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+// Which ratingupdate.info rating goes in each character level. Kept in data so new characters don't need a new release.
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+//go:embed characters.json
+var defaultCharacters []byte
+
+// CharacterTable maps the 3 letter character codes in the *Lv fields of statistics/get to indexes in ratingupdate.info ratings
+type CharacterTable map[string]int
+
+// DefaultCharacterTable returns the built in table
+func DefaultCharacterTable() CharacterTable {
+	table := CharacterTable{}
+	err := json.Unmarshal(defaultCharacters, &table)
+	if err != nil {
+		panic(err) // Embedded, so only broken by a bad build
+	}
+	return table
+}
+
+// LoadCharacterTable returns the built in table with the characters in path added on top.
+// The file is a JSON object of character code to rating index, like characters.json. An empty path returns the built in table.
+// Codes in the file replace built in ones, but no two characters can end up with the same index.
+func LoadCharacterTable(path string) (CharacterTable, error) {
+	table := DefaultCharacterTable()
+	if path == "" {
+		return table, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read character table: %w", err)
+	}
+	var extra CharacterTable
+	err = json.Unmarshal(buf, &extra)
+	if err != nil {
+		return nil, fmt.Errorf("could not read character table %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for code, index := range extra {
+		if index < 0 {
+			return nil, fmt.Errorf("invalid rating index %d for %s in %s", index, code, path)
+		}
+		code = strings.ToUpper(code)
+		if seen[code] {
+			return nil, fmt.Errorf("%s is in %s more than once", code, path)
+		}
+		seen[code] = true
+		table[code] = index
+	}
+	codes := make(map[int]string)
+	for code, index := range table {
+		if other, ok := codes[index]; ok {
+			if other > code {
+				code, other = other, code
+			}
+			return nil, fmt.Errorf("%s and %s both have rating index %d after reading %s", other, code, index, path)
+		}
+		codes[index] = code
+	}
+	return table, nil
+}
+
+// LoadCharacterTable loads the table for the -characters option
+func (o *StriveAPIProxyOptions) LoadCharacterTable() (CharacterTable, error) {
+	return LoadCharacterTable(o.CharactersFile)
+}
+
+// Index returns the rating index for a character code
+func (t CharacterTable) Index(code string) (int, bool) {
+	index, ok := t[code]
+	return index, ok
+}
+
+// Code returns the character code for a rating index. The first code in order if several share the index, which only
+// happens in tables that weren't made by LoadCharacterTable.
+func (t CharacterTable) Code(index int) (string, bool) {
+	code := ""
+	for c, i := range t {
+		if i == index && (code == "" || c < code) {
+			code = c
+		}
+	}
+	return code, code != ""
+}
+
+// LevelCodes returns the character codes of the *Lv fields in a statistics/get response
+func LevelCodes(resp *ggst.StatGetResponse) []string {
+	var codes []string
+	for _, k := range resp.Payload.JSON.Keys() {
+		if strings.HasSuffix(k, "Lv") && len(k) >= 5 {
+			codes = append(codes, k[0:3])
+		}
+	}
+	return codes
+}
+
+// Unmapped counts the character codes in the statistics/get responses of a capture that aren't in the table
+func (t CharacterTable) Unmapped(entries []CaptureEntry) map[string]int {
+	unmapped := make(map[string]int)
+	for _, entry := range entries {
+		if apiEndpoint(entry.Path) != "statistics/get" {
+			continue
+		}
+		resp, err := ggst.UnmarshalStatResp(entry.ResponseBody)
+		if err != nil {
+			continue // Not every statistics/get response has levels
+		}
+		for _, code := range LevelCodes(resp) {
+			if _, ok := t[code]; !ok {
+				unmapped[code]++
+			}
+		}
+	}
+	return unmapped
+}
+
+// CheckCharactersCommand runs the check-characters subcommand, which reports character codes in a -record capture that
+// rating injection doesn't know about. Returns 1 if any are found so it can be used in scripts.
+func CheckCharactersCommand(name string, args []string) int {
+	fs := flag.NewFlagSet("check-characters", flag.ExitOnError)
+	charactersFile := fs.String("characters", "", "JSON file of extra character codes, same as the proxy option.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check-characters [-characters <file>] <capture file>\n", name)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	table, err := LoadCharacterTable(*charactersFile)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	entries, err := ReadCapture(fs.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	unmapped := table.Unmapped(entries)
+	if len(unmapped) == 0 {
+		fmt.Println("All characters are mapped.")
+		return 0
+	}
+	codes := make([]string, 0, len(unmapped))
+	for code := range unmapped {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Println("Unmapped characters. Add them to a -characters file with their ratingupdate.info rating index:")
+	for _, code := range codes {
+		fmt.Printf("  %s (seen %d times)\n", code, unmapped[code])
+	}
+	return 1
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+func writeCharacterTable(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "characters.json")
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCharacterTable(t *testing.T) {
+	defaults := DefaultCharacterTable()
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]int // Checked on top of the built in table
+		wantErr string
+	}{
+		{name: "new character", content: `{"XYZ": 21}`, want: map[string]int{"XYZ": 21, "SOL": 0, "BGT": 20}},
+		{name: "lower case", content: `{"xyz": 21}`, want: map[string]int{"XYZ": 21}},
+		{name: "replaces built in", content: `{"BGT": 22}`, want: map[string]int{"BGT": 22}},
+		{name: "moves built in", content: `{"BGT": 21, "XYZ": 20}`, want: map[string]int{"BGT": 21, "XYZ": 20}},
+		{name: "negative", content: `{"XYZ": -1}`, wantErr: "invalid rating index"},
+		{name: "not a number", content: `{"XYZ": "21"}`, wantErr: "could not read character table"},
+		{name: "not an object", content: `["XYZ"]`, wantErr: "could not read character table"},
+		{name: "same index as built in", content: `{"XYZ": 0}`, wantErr: "SOL and XYZ both have rating index 0"},
+		{name: "same index twice", content: `{"XYZ": 21, "XYY": 21}`, wantErr: "XYY and XYZ both have rating index 21"},
+		{name: "same code twice", content: `{"XYZ": 21, "xyz": 22}`, wantErr: "XYZ is in"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table, err := LoadCharacterTable(writeCharacterTable(t, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadCharacterTable() = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for code, want := range tt.want {
+				if got, ok := table.Index(code); !ok || got != want {
+					t.Errorf("%s = %d, %v, want %d", code, got, ok, want)
+				}
+			}
+			if len(table) < len(defaults) {
+				t.Errorf("%d characters, want at least the %d built in", len(table), len(defaults))
+			}
+		})
+	}
+
+	if _, err := LoadCharacterTable(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("missing file didn't fail")
+	}
+	table, err := LoadCharacterTable("")
+	if err != nil || len(table) != len(defaults) {
+		t.Errorf("no file = %d characters, %v, want the built in table", len(table), err)
+	}
+}
+
+func testLevelsEntry(t *testing.T, levels ...string) CaptureEntry {
+	var resp ggst.StatGetResponse
+	err := resp.Payload.JSON.Set("NAME", "Player One")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range levels {
+		err = resp.Payload.JSON.Set(code+"Lv", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, err := ggst.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CaptureEntry{Method: "POST", Path: "/api/statistics/get", StatusCode: http.StatusOK, ResponseBody: body}
+}
+
+func TestCheckCharacters(t *testing.T) {
+	entries := []CaptureEntry{
+		testLevelsEntry(t, "SOL", "XYZ"),
+		testLevelsEntry(t, "XYZ", "ABC"),
+		{Method: "POST", Path: "/api/statistics/get", StatusCode: http.StatusOK, ResponseBody: []byte("not msgpack")},
+		{Method: "POST", Path: "/api/sys/get_news", StatusCode: http.StatusOK, ResponseBody: testLevelsEntry(t, "DEF").ResponseBody},
+	}
+	unmapped := DefaultCharacterTable().Unmapped(entries)
+	if len(unmapped) != 2 || unmapped["XYZ"] != 2 || unmapped["ABC"] != 1 {
+		t.Errorf("Unmapped() = %v, want XYZ twice and ABC once", unmapped)
+	}
+
+	capture := writeTestCapture(t, entries...)
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"unmapped", []string{capture}, 1},
+		{"all mapped", []string{"-characters", writeCharacterTable(t, `{"XYZ": 21, "ABC": 22}`), capture}, 0},
+		{"some mapped", []string{"-characters", writeCharacterTable(t, `{"XYZ": 21}`), capture}, 1},
+		{"bad table", []string{"-characters", writeCharacterTable(t, `{"XYZ": 0}`), capture}, 2},
+		{"missing capture", []string{filepath.Join(t.TempDir(), "missing.jsonl")}, 2},
+		{"no capture", nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckCharactersCommand("totsugeki", tt.args); got != tt.want {
+				t.Errorf("check-characters %v = %d, want %d", tt.args, got, tt.want)
+			}
+		})
+	}
+}
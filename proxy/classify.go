@@ -0,0 +1,48 @@
+package proxy
+
+// Decodes each request once so handlers can look at what it is instead of re-parsing the body.
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+type contextKey int
+
+const classifiedRequestKey contextKey = iota
+
+// ClassifyHandler attaches the decoded request to the context of API requests. See classifiedRequest.
+func ClassifyHandler(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, "/api/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body)) // Reset Body for the next handlers
+
+			c, err := ggst.ClassifyRequest(r.URL.Path, body)
+			if err != nil {
+				logger.Debug("Could not classify request", "endpoint", endpoint(r), "err", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			logger.Debug("Classified request", "endpoint", endpoint(r), "request", c.String())
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), classifiedRequestKey, c)))
+		})
+	}
+}
+
+// classifiedRequest returns the request decoded by ClassifyHandler, or nil if it couldn't be decoded
+func classifiedRequest(r *http.Request) *ggst.ClassifiedRequest {
+	c, _ := r.Context().Value(classifiedRequestKey).(*ggst.ClassifiedRequest)
+	return c
+}
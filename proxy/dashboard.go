@@ -0,0 +1,226 @@
+package proxy
+
+// Status page on the admin server, for seeing what Totsugeki is doing without reading the console.
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+// How many requests and rating lookups the dashboard shows
+const (
+	dashboardRequests      = 100
+	dashboardRatingLookups = 50
+)
+
+// Fixed size list of the most recent items. Safe for concurrent use.
+type recentList[T any] struct {
+	lock  sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+func newRecentList[T any](size int) *recentList[T] {
+	return &recentList[T]{items: make([]T, size)}
+}
+
+func (l *recentList[T]) Add(item T) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.items[l.next] = item
+	l.next = (l.next + 1) % len(l.items)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Items returns the items newest first
+func (l *recentList[T]) Items() []T {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.items)
+	}
+	items := make([]T, 0, n)
+	for i := 1; i <= n; i++ {
+		items = append(items, l.items[(l.next-i+len(l.items))%len(l.items)])
+	}
+	return items
+}
+
+type RequestLogEntry struct {
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	Status   int       `json:"status"`
+	Bytes    int       `json:"bytes"`
+	Duration float64   `json:"duration_ms"`
+}
+
+// Results of RatingLookup
+const (
+	RatingLookupOK       = "ok"
+	RatingLookupNotFound = "not found"
+	RatingLookupFailed   = "failed"
+)
+
+type RatingLookup struct {
+	Time   time.Time `json:"time"`
+	UserID string    `json:"user_id"`
+	Name   string    `json:"name,omitempty"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// States of PatcherStatus
+const (
+	PatcherWaiting        = "waiting for GGST"
+	PatcherPatched        = "patched"
+	PatcherAlreadyPatched = "already patched"
+	PatcherFailed         = "failed"
+)
+
+// PatcherStatus is what the patcher last did. Set by whatever runs the patcher, so the proxy can show it.
+// Safe for concurrent use.
+type PatcherStatus struct {
+	lock    sync.Mutex
+	state   string
+	pid     uint32
+	offset  uintptr
+	err     error
+	updated time.Time
+}
+
+// Set records the patcher's state. pid and offset are 0 if unknown.
+func (p *PatcherStatus) Set(state string, pid uint32, offset uintptr, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state = state
+	p.pid = pid
+	p.offset = offset
+	p.err = err
+	p.updated = time.Now()
+}
+
+type patcherStatusJSON struct {
+	State   string    `json:"state"`
+	PID     uint32    `json:"pid,omitempty"`
+	Offset  string    `json:"offset,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func (p *PatcherStatus) snapshot() *patcherStatusJSON {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	status := &patcherStatusJSON{State: p.state, PID: p.pid, Updated: p.updated}
+	if status.State == "" {
+		status.State = "starting"
+	}
+	if p.offset != 0 {
+		status.Offset = fmt.Sprintf("0x%x", p.offset)
+	}
+	if p.err != nil {
+		status.Error = p.err.Error()
+	}
+	return status
+}
+
+type hitRate struct {
+	Request string `json:"request,omitempty"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+type upstreamStatus struct {
+	UpstreamHealth
+	Healthy bool `json:"healthy"`
+}
+
+type dashboardStatus struct {
+	Started       time.Time          `json:"started"`
+	Unsafe        []string           `json:"unsafe"`
+	Patcher       *patcherStatusJSON `json:"patcher"` // null if the patcher isn't running in this binary
+	Prediction    hitRate            `json:"prediction"`
+	Cache         []hitRate          `json:"cache"`
+	Upstream      upstreamStatus     `json:"upstream"`
+	StatsPending  int64              `json:"stats_pending"`
+	Requests      []RequestLogEntry  `json:"requests"`
+	RatingLookups []RatingLookup     `json:"rating_lookups"`
+}
+
+func (s *StriveAPIProxy) dashboardStatus() *dashboardStatus {
+	status := &dashboardStatus{
+		Started:       s.started,
+		Unsafe:        s.unsafeOptions,
+		Prediction:    hitRate{Hits: s.Metrics.PredictionHits.Sum(), Misses: s.Metrics.PredictionMisses.Sum(), Dropped: s.Metrics.PredictionDropped.Sum()},
+		StatsPending:  s.statsPending.Load(),
+		Upstream:      upstreamStatus{UpstreamHealth: s.Metrics.UpstreamHealth()},
+		Requests:      s.requestLog.Items(),
+		RatingLookups: []RatingLookup{},
+	}
+	status.Upstream.Healthy = status.Upstream.UpstreamHealth.Healthy()
+	if status.Unsafe == nil {
+		status.Unsafe = []string{}
+	}
+	if s.patcherStatus != nil {
+		status.Patcher = s.patcherStatus.snapshot()
+	}
+
+	hits := s.Metrics.CacheHits.Values()
+	misses := s.Metrics.CacheMisses.Values()
+	status.Cache = []hitRate{}
+	for request := range hits {
+		if _, ok := misses[request]; !ok {
+			misses[request] = 0
+		}
+	}
+	for request := range misses {
+		status.Cache = append(status.Cache, hitRate{Request: request, Hits: hits[request], Misses: misses[request]})
+	}
+	sort.Slice(status.Cache, func(i, j int) bool { return status.Cache[i].Request < status.Cache[j].Request })
+
+	if s.ratingUpdate != nil {
+		status.RatingLookups = s.ratingUpdate.lookups.Items()
+	}
+	return status
+}
+
+func (s *StriveAPIProxy) HandleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardPage)
+}
+
+// HandleDashboardStatus serves everything on the dashboard as JSON. The page polls it.
+func (s *StriveAPIProxy) HandleDashboardStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(s.dashboardStatus())
+	if err != nil {
+		s.logger.Error("Could not write dashboard status", "err", err)
+	}
+}
+
+// The dashboard shows player IDs, so only show it on this machine even if the admin server listens elsewhere for metrics
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func dashboardGet(t *testing.T, tp *testProxy, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = "127.0.0.1:50000"
+	w := httptest.NewRecorder()
+	tp.proxy.adminRouter().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s = %d", path, w.Code)
+	}
+	return w
+}
+
+func dashboardGetStatus(t *testing.T, tp *testProxy) *dashboardStatus {
+	t.Helper()
+	w := dashboardGet(t, tp, "/status")
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %s", w.Header().Get("Content-Type"))
+	}
+	var status struct {
+		dashboardStatus
+		Upstream map[string]interface{} `json:"upstream"` // Checked as JSON, so the field names are too
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &status.dashboardStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"requests", "errors", "last_time", "healthy"} {
+		if _, ok := status.Upstream[field]; !ok {
+			t.Errorf("upstream.%s missing from %v", field, status.Upstream)
+		}
+	}
+	return &status.dashboardStatus
+}
+
+func TestDashboard(t *testing.T) {
+	upstream := newTestUpstream(t)
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{CacheNews: true, AsyncStatsSet: true, StatsJournalDir: t.TempDir(), ShutdownTimeout: 300 * time.Millisecond})
+	defer tp.shutdown(t)
+
+	w := dashboardGet(t, tp, "/")
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), `fetch("status"`) {
+		t.Errorf("dashboard = %s:\n%s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	status := dashboardGetStatus(t, tp)
+	if status.Upstream.Requests != 0 || status.Upstream.Healthy || len(status.Requests) != 0 || len(status.Cache) != 0 {
+		t.Errorf("before any requests = %+v", status)
+	}
+	if want := []string{"unsafe-async-stats-set", "unsafe-cache-news"}; strings.Join(status.Unsafe, ",") != strings.Join(want, ",") {
+		t.Errorf("unsafe = %v, want %v", status.Unsafe, want)
+	}
+	if status.Patcher != nil {
+		t.Errorf("patcher = %+v, want null without a patcher", status.Patcher)
+	}
+
+	tp.post(t, "sys/get_news", testHeaderData+"9100")
+	tp.post(t, "sys/get_news", testHeaderData+"9100")
+	tp.post(t, "user/login", testHeaderData+"91a0")
+	status = dashboardGetStatus(t, tp)
+	if len(status.Cache) != 1 || status.Cache[0] != (hitRate{Request: "sys/get_news", Hits: 1, Misses: 1}) {
+		t.Errorf("cache = %+v, want one hit and miss of sys/get_news", status.Cache)
+	}
+	if u := status.Upstream; u.Requests != 2 || u.Errors != 0 || !u.Healthy || u.LastStatus != http.StatusOK || u.LastTime.IsZero() {
+		t.Errorf("upstream = %+v, want 2 answered and healthy", u)
+	}
+	if len(status.Requests) != 3 || status.Requests[0].Endpoint != "user/login" || status.Requests[2].Endpoint != "sys/get_news" {
+		t.Errorf("requests = %+v, want newest first", status.Requests)
+	}
+
+	// Stats queue up while ASW is down
+	upstream.fail.Store(true)
+	tp.post(t, "statistics/set", testHeaderData+"91a0")
+	upstream.waitFor(t, "statistics/set", 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for tp.proxy.Metrics.UpstreamHealth().LastStatus == http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond) // The upload's response is still on its way back
+	}
+	status = dashboardGetStatus(t, tp)
+	if status.StatsPending != 1 {
+		t.Errorf("stats pending = %d, want 1", status.StatsPending)
+	}
+	if u := status.Upstream; u.Healthy || u.LastStatus != http.StatusServiceUnavailable {
+		t.Errorf("upstream = %+v, want unhealthy with 503", u)
+	}
+}
+
+// Requests that never get a response are errors, and make the servers unhealthy
+func TestDashboardUpstreamError(t *testing.T) {
+	upstream := newTestUpstream(t)
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{})
+	defer tp.shutdown(t)
+
+	tp.post(t, "sys/get_news", testHeaderData+"9100")
+	upstream.server.Close()
+	tp.post(t, "sys/get_news", testHeaderData+"9100")
+	u := dashboardGetStatus(t, tp).Upstream
+	if u.Requests != 1 || u.Errors != 1 || u.Healthy || u.LastStatus != 0 || u.LastError == "" {
+		t.Errorf("upstream = %+v, want 1 answered, 1 failed and the error", u)
+	}
+}
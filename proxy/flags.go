@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"flag"
+	"time"
+)
+
+// BindFlags registers the command line flags for the proxy options on fs.
+// Shared by every binary that runs a StriveAPIProxy so the flags stay the same everywhere.
+func (o *StriveAPIProxyOptions) BindFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.AsyncStatsSet, "unsafe-async-stats-set", false, "UNSAFE: Asynchronously upload stats (R-Code) in the background.")
+	fs.BoolVar(&o.PredictStatsGet, "unsafe-predict-stats-get", false, "UNSAFE: Asynchronously precache expected statistics/get calls.")
+	fs.BoolVar(&o.CacheNews, "unsafe-cache-news", false, "UNSAFE: Cache first news call and return cached version on subsequent calls.")
+	fs.BoolVar(&o.NoNews, "unsafe-no-news", false, "UNSAFE: Return an empty response for news.")
+	fs.BoolVar(&o.PredictReplay, "unsafe-predict-replay", false, "UNSAFE: Asynchronously precache expected get_replay calls. Needs unsafe-predict-stats-get to work.")
+	fs.BoolVar(&o.CacheEnv, "unsafe-cache-env", false, "UNSAFE: Cache first get_env call and return cached version on subsequent calls.")
+	fs.BoolVar(&o.CacheFollow, "unsafe-cache-follow", false, "UNSAFE: Cache first get_follow and get_block calls and return cached version on subsequent calls.")
+	fs.BoolVar(&o.RatingUpdate, "rating-update", false, "Display ratings from ratingupdate.info (or -rating-source) instead of character levels.")
+	fs.StringVar(&o.RatingSource, "rating-source", DefaultRatingSource, "Where -rating-update gets ratings from. ratingupdate.info, file:<path> of a JSON file of user IDs to ratings, local for ratings computed from replays you've looked at (see -track-ratings), or a URL in the ratingupdate.info format with {id} or {hex} in place of the user ID.")
+	fs.BoolVar(&o.TrackRatings, "track-ratings", false, "Compute Glicko-2 ratings per character from replays you look at and your uploaded results. Implied by -rating-source local.")
+	fs.StringVar(&o.LocalRatingsFile, "local-ratings-file", "", "File to keep ratings from -track-ratings in. Next to the exe if empty. Implies -track-ratings.")
+	fs.StringVar(&o.RatingDisplay, "rating-display", RatingDisplayRating, "How -rating-update shows ratings. One of rating, bucket (rounded to -rating-bucket), provisional (leading 1 if unsure, e.g. 11523), deviation (rating then 3 digits of deviation, e.g. 1523085 is 1523 ±85).")
+	fs.IntVar(&o.RatingBucket, "rating-bucket", DefaultRatingBucket, "Bucket size for -rating-display bucket.")
+	fs.Float64Var(&o.RatingProvisionalDeviation, "rating-provisional-deviation", DefaultRatingProvisionalDeviation, "Deviation above which -rating-display provisional marks a rating as unsure.")
+	fs.StringVar(&o.CharactersFile, "characters", "", "JSON file mapping new character codes to ratingupdate.info rating indexes, e.g. {\"XYZ\": 21}. Added to the built in table.")
+	fs.IntVar(&o.RatingCacheSize, "rating-cache-size", DefaultRatingCacheSize, "Max players to cache ratings for.")
+	fs.DurationVar(&o.RatingCacheTTL, "rating-cache-ttl", DefaultRatingCacheTTL, "How long to use cached ratings before looking them up again.")
+	fs.DurationVar(&o.RatingNegativeTTL, "rating-negative-ttl", DefaultRatingNegativeTTL, "How long to remember players the rating source doesn't know.")
+	fs.Float64Var(&o.RatingRate, "rating-rate", DefaultRatingRate, "Max rating lookups per second.")
+	fs.IntVar(&o.RatingBurst, "rating-burst", DefaultRatingBurst, "Lookups allowed at once before -rating-rate kicks in.")
+	fs.BoolVar(&o.PersistCache, "persist-cache", false, "Save cached responses next to the exe so caching is instant from the first request after a restart.")
+	fs.StringVar(&o.CacheDir, "cache-dir", "", "Directory to save cached responses in. Implies -persist-cache.")
+	fs.DurationVar(&o.CacheNewsTTL, "cache-ttl-news", 12*time.Hour, "How long news saved by -persist-cache stays valid.")
+	fs.DurationVar(&o.CacheFollowTTL, "cache-ttl-follow", time.Hour, "How long follow/block lists saved by -persist-cache stay valid.")
+	fs.Int64Var(&o.CacheMaxSize, "cache-max-size", DefaultCacheMaxSize, "Max size in bytes of saved cached responses.")
+	fs.BoolVar(&o.History, "history", false, "Keep a history of R-Codes you and others look at and your matches, to review with the history command.")
+	fs.StringVar(&o.HistoryFile, "history-file", "", "File to keep history in. Implies -history.")
+	fs.BoolVar(&o.Notes, "notes", false, "Show your notes on players when you open their R-Code. Edit them with the notes command, or at /notes on -admin-listen.")
+	fs.StringVar(&o.NotesFile, "notes-file", "", "File to keep notes in. Implies -notes.")
+	fs.StringVar(&o.NotesHook, "notes-hook", "", "Program to run when you open the R-Code of a player with notes, e.g. to show a desktop notification. Gets TOTSUGEKI_USER_ID, TOTSUGEKI_NAME, TOTSUGEKI_NOTE and TOTSUGEKI_TAGS in its environment. Implies -notes.")
+	fs.StringVar(&o.RecordFile, "record", "", "Record all requests to and responses from the GGST servers to this file as newline delimited JSON.")
+	fs.StringVar(&o.ReplayFile, "replay", "", "Answer requests with responses from a file made with -record instead of the GGST servers.")
+	fs.BoolVar(&o.ReplayFallback, "replay-fallback", false, "With -replay, answer requests that weren't recorded with another recorded response for the same endpoint instead of a 404.")
+	fs.StringVar(&o.LogLevel, "log-level", "info", "Minimum level to log. One of debug, info, warn, error.")
+	fs.StringVar(&o.LogFile, "log-file", "", "Also append logs to this file.")
+	fs.BoolVar(&o.LogJSON, "log-json", false, "Log as JSON instead of key=value text.")
+	fs.StringVar(&o.StatsJournalDir, "stats-journal-dir", "", "Directory to keep stats from -unsafe-async-stats-set in until they're uploaded. Next to the exe if empty.")
+	fs.DurationVar(&o.ShutdownTimeout, "shutdown-timeout", DefaultShutdownTimeout, "How long to keep trying to upload stats from -unsafe-async-stats-set when closing.")
+	fs.StringVar(&o.AdminListen, "admin-listen", "", "Serve a status dashboard and Prometheus metrics on this address, e.g. 127.0.0.1:21612. Only /metrics answers other machines, the dashboard and notes are for this machine only. Disabled if empty.")
+}
+
+// UngaBunga enables all unsafe speedups.
+func (o *StriveAPIProxyOptions) UngaBunga() { // Mash only
+	o.AsyncStatsSet = true
+	o.PredictStatsGet = true
+	o.NoNews = true
+	o.PredictReplay = true
+	o.CacheEnv = true
+	o.CacheFollow = true
+}
+
+// UnsafeOptions returns the flags of the unsafe speedups that are enabled.
+func (o *StriveAPIProxyOptions) UnsafeOptions() []string {
+	var enabled []string
+	for _, option := range []struct {
+		flag    string
+		enabled bool
+	}{
+		{"unsafe-async-stats-set", o.AsyncStatsSet},
+		{"unsafe-predict-stats-get", o.PredictStatsGet},
+		{"unsafe-cache-news", o.CacheNews},
+		{"unsafe-no-news", o.NoNews},
+		{"unsafe-predict-replay", o.PredictReplay},
+		{"unsafe-cache-env", o.CacheEnv},
+		{"unsafe-cache-follow", o.CacheFollow},
+	} {
+		if option.enabled {
+			enabled = append(enabled, option.flag)
+		}
+	}
+	return enabled
+}
+
+// Unsafe returns true if any unsafe speedup is enabled.
+func (o *StriveAPIProxyOptions) Unsafe() bool {
+	return o.AsyncStatsSet || o.PredictStatsGet || o.CacheNews || o.NoNews || o.CacheEnv || o.PredictReplay || o.CacheFollow
+}
+
+// Subcommands that work the same in every binary, by name
+var subcommands = map[string]func(name string, args []string) int{
+	"check-characters": CheckCharactersCommand,
+	"history":          HistoryCommand,
+	"notes":            NotesCommand,
+}
+
+// RunSubcommand runs the subcommand named by args[1], with args being os.Args. Returns the exit code, and false if args
+// aren't a subcommand so the binary should carry on as normal.
+func RunSubcommand(args []string) (int, bool) {
+	if len(args) < 2 {
+		return 0, false
+	}
+	command, ok := subcommands[args[1]]
+	if !ok {
+		return 0, false
+	}
+	return command(args[0], args[2:]), true
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSubcommand(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.jsonl")
+	tests := []struct {
+		args   []string
+		want   int
+		wantOK bool
+	}{
+		{[]string{"totsugeki"}, 0, false},
+		{[]string{"totsugeki", "-no-launch"}, 0, false},
+		{[]string{"totsugeki", "histories"}, 0, false},
+		{[]string{"totsugeki", "check-characters"}, 2, true},
+		{[]string{"totsugeki", "check-characters", missing}, 2, true},
+		{[]string{"totsugeki", "history", "-history-file", missing}, 1, true},
+	}
+	for _, tt := range tests {
+		if got, ok := RunSubcommand(tt.args); got != tt.want || ok != tt.wantOK {
+			t.Errorf("RunSubcommand(%q) = %d, %v, want %d, %v", tt.args, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
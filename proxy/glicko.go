@@ -0,0 +1,104 @@
+package proxy
+
+// Glicko-2 as described in http://www.glicko.net/glicko/glicko2.pdf. The tracker rates every match as its own rating period.
+
+import "math"
+
+const (
+	glickoScale             = 173.7178
+	glickoDefaultRating     = 1500.0
+	glickoDefaultDeviation  = 350.0
+	glickoDefaultVolatility = 0.06
+	glickoTau               = 0.5 // How much volatility can change. 0.3 to 1.2 per the paper.
+	glickoEpsilon           = 0.000001
+)
+
+type GlickoRating struct {
+	Rating     float64 `json:"rating"`
+	Deviation  float64 `json:"deviation"`
+	Volatility float64 `json:"volatility"`
+}
+
+// NewGlickoRating returns the rating of a player with no matches
+func NewGlickoRating() GlickoRating {
+	return GlickoRating{Rating: glickoDefaultRating, Deviation: glickoDefaultDeviation, Volatility: glickoDefaultVolatility}
+}
+
+// GlickoResult is one match in a rating period
+type GlickoResult struct {
+	Opponent GlickoRating
+	Score    float64 // 1 for a win and 0 for a loss
+}
+
+// Update returns the rating after a match against opponent. score is 1 for a win and 0 for a loss.
+func (r GlickoRating) Update(opponent GlickoRating, score float64) GlickoRating {
+	return r.UpdatePeriod([]GlickoResult{{Opponent: opponent, Score: score}})
+}
+
+// UpdatePeriod returns the rating after a rating period with results. Steps 2 to 8 of the paper.
+func (r GlickoRating) UpdatePeriod(results []GlickoResult) GlickoRating {
+	mu := (r.Rating - glickoDefaultRating) / glickoScale
+	phi := r.Deviation / glickoScale
+	if len(results) == 0 {
+		r.Deviation = math.Min(glickoScale*math.Sqrt(phi*phi+r.Volatility*r.Volatility), glickoDefaultDeviation)
+		return r
+	}
+
+	var vInv, improvement float64
+	for _, result := range results {
+		muJ := (result.Opponent.Rating - glickoDefaultRating) / glickoScale
+		phiJ := result.Opponent.Deviation / glickoScale
+		g := 1 / math.Sqrt(1+3*phiJ*phiJ/(math.Pi*math.Pi))
+		e := 1 / (1 + math.Exp(-g*(mu-muJ)))
+		vInv += g * g * e * (1 - e)
+		improvement += g * (result.Score - e)
+	}
+	v := 1 / vInv
+	delta := v * improvement
+
+	sigma := r.newVolatility(phi, v, delta)
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phiNew := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	muNew := mu + phiNew*phiNew*improvement
+
+	return GlickoRating{
+		Rating:     glickoScale*muNew + glickoDefaultRating,
+		Deviation:  math.Min(glickoScale*phiNew, glickoDefaultDeviation),
+		Volatility: sigma,
+	}
+}
+
+// Step 5 of the paper, using the Illinois algorithm
+func (r GlickoRating) newVolatility(phi float64, v float64, delta float64) float64 {
+	a := math.Log(r.Volatility * r.Volatility)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(glickoTau*glickoTau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoEpsilon {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
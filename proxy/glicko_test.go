@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"math"
+	"testing"
+)
+
+// The example in section 3 of http://www.glicko.net/glicko/glicko2.pdf
+func TestGlickoPaperExample(t *testing.T) {
+	player := GlickoRating{Rating: 1500, Deviation: 200, Volatility: 0.06}
+	got := player.UpdatePeriod([]GlickoResult{
+		{Opponent: GlickoRating{Rating: 1400, Deviation: 30}, Score: 1},
+		{Opponent: GlickoRating{Rating: 1550, Deviation: 100}, Score: 0},
+		{Opponent: GlickoRating{Rating: 1700, Deviation: 300}, Score: 0},
+	})
+	if math.Abs(got.Rating-1464.06) > 0.01 || math.Abs(got.Deviation-151.52) > 0.01 || math.Abs(got.Volatility-0.05999) > 0.00001 {
+		t.Errorf("rating = %.2f ±%.2f σ %.5f, want 1464.06 ±151.52 σ 0.05999", got.Rating, got.Deviation, got.Volatility)
+	}
+}
+
+func TestGlickoUpdate(t *testing.T) {
+	player, opponent := NewGlickoRating(), NewGlickoRating()
+	won, lost := player.Update(opponent, 1), opponent.Update(player, 0)
+	if won.Rating <= glickoDefaultRating || lost.Rating >= glickoDefaultRating {
+		t.Errorf("winner %.2f, loser %.2f", won.Rating, lost.Rating)
+	}
+	if math.Abs((won.Rating-glickoDefaultRating)-(glickoDefaultRating-lost.Rating)) > 1e-9 {
+		t.Errorf("even match isn't symmetric: winner %.2f, loser %.2f", won.Rating, lost.Rating)
+	}
+	if won.Deviation >= glickoDefaultDeviation {
+		t.Errorf("deviation = %.2f, want less than %v after a match", won.Deviation, glickoDefaultDeviation)
+	}
+
+	// Not playing only makes the rating less certain
+	idle := GlickoRating{Rating: 1600, Deviation: 50, Volatility: 0.06}.UpdatePeriod(nil)
+	if idle.Rating != 1600 || idle.Deviation <= 50 {
+		t.Errorf("idle rating = %.2f ±%.2f", idle.Rating, idle.Deviation)
+	}
+}
@@ -0,0 +1,503 @@
+package proxy
+
+// Keeps R-Code snapshots and match results from proxied traffic so players can look back at them without a third party site.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+// Kinds of HistoryEntry
+const (
+	HistoryRCode = "rcode" // statistics/get levels. Name and character levels of a player.
+	HistoryStats = "stats" // Any other statistics/get, like the battle record
+	HistoryMatch = "match" // A match you played, from a catalog/get_replay replay list
+)
+
+// Results of a HistoryMatch
+const (
+	HistoryWin  = "win"
+	HistoryLoss = "loss"
+)
+
+// HistoryEntry is something seen about a player. History files are newline delimited JSON with one HistoryEntry per line.
+type HistoryEntry struct {
+	Time     time.Time      `json:"time"`
+	Kind     string         `json:"kind"`
+	Endpoint string         `json:"endpoint"`
+	UserID   string         `json:"user_id"`        // 18 digit User ID of the player this is about
+	Self     bool           `json:"self"`           // Whether the player is the one playing
+	Type     int            `json:"type,omitempty"` // statistics/get type. See ggst.StatGetType.
+	Page     int            `json:"page,omitempty"`
+	Name     string         `json:"name,omitempty"`
+	Levels   map[string]int `json:"levels,omitempty"` // Character levels by character code
+	Data     interface{}    `json:"data,omitempty"`   // JSON of other statistics/get pages as ASW sent it
+
+	// Matches
+	MatchID           uint64 `json:"match_id,omitempty"`    // Replay ID
+	Result            string `json:"result,omitempty"`      // HistoryWin or HistoryLoss for the player this is about
+	Character         string `json:"character,omitempty"`   // Character code the player this is about played
+	OpponentID        string `json:"opponent_id,omitempty"` // 18 digit User ID
+	OpponentName      string `json:"opponent_name,omitempty"`
+	OpponentCharacter string `json:"opponent_character,omitempty"` // Character code
+	Floor             int    `json:"floor,omitempty"`              // 99 is Celestial
+}
+
+// History files are rotated once they're this big, so the history command doesn't have to read years of R-Codes.
+// The previous file is kept next to it as e.g. history.1.jsonl, and anything older is deleted.
+const maxHistorySize = 16 << 20
+
+type History struct {
+	lock       sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	matches    map[uint64]bool // Replay IDs already in the history
+	characters CharacterTable
+	logger     *slog.Logger
+}
+
+// NewHistory appends history to path. characters names the characters in matches.
+func NewHistory(path string, characters CharacterTable, logger *slog.Logger) (*History, error) {
+	h := &History{
+		path:       path,
+		maxSize:    maxHistorySize,
+		matches:    make(map[uint64]bool),
+		characters: characters,
+		logger:     logger,
+	}
+	if info, err := os.Stat(path); err == nil && info.Size() >= h.maxSize {
+		err = os.Rename(path, RotatedHistoryFile(path))
+		if err != nil {
+			return nil, fmt.Errorf("could not rotate history file: %w", err)
+		}
+	}
+
+	// Replay lists are loaded over and over, so remember which matches are already kept
+	for _, file := range []string{RotatedHistoryFile(path), path} {
+		entries, err := ReadHistory(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Could not read all of the history file", "file", file, "err", err)
+		}
+		for _, entry := range entries {
+			if entry.Kind == HistoryMatch {
+				h.matches[entry.MatchID] = true
+			}
+		}
+	}
+
+	err := h.open()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Must hold lock
+func (h *History) open() error {
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open history file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not open history file: %w", err)
+	}
+	h.file = file
+	h.size = info.Size()
+	return nil
+}
+
+// RotatedHistoryFile is where the history in path is moved once it's too big
+func RotatedHistoryFile(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".1" + ext
+}
+
+// NewHistory opens the history file for -history
+func (o *StriveAPIProxyOptions) NewHistory(logger *slog.Logger) (*History, error) {
+	path := o.HistoryFile
+	if path == "" {
+		var err error
+		path, err = DefaultHistoryFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	characters := o.Characters
+	if characters == nil {
+		var err error
+		characters, err = o.LoadCharacterTable()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewHistory(path, characters, logger)
+}
+
+// Default history file is next to the exe
+func DefaultHistoryFile() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exePath), "history.jsonl"), nil
+}
+
+// ReadHistory reads all entries from a history file
+func ReadHistory(path string) ([]HistoryEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open history file: %w", err)
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+	dec := json.NewDecoder(file)
+	for {
+		var entry HistoryEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return entries, fmt.Errorf("could not read history file: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (h *History) Add(entry *HistoryEntry) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.write(entry)
+}
+
+// Must hold lock
+func (h *History) write(entry *HistoryEntry) {
+	if h.file == nil {
+		return // Rotating failed
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		h.logger.Error("Could not write history", "err", err)
+		return
+	}
+	n, err := h.file.Write(append(line, '\n'))
+	h.size += int64(n)
+	if err != nil {
+		h.logger.Error("Could not write history", "err", err)
+	}
+	if h.size < h.maxSize {
+		return
+	}
+
+	h.logger.Info("Rotating history file", "file", h.path, "old", RotatedHistoryFile(h.path))
+	h.file.Close()
+	h.file = nil
+	err = os.Rename(h.path, RotatedHistoryFile(h.path))
+	if err != nil {
+		h.logger.Error("Could not rotate history file", "err", err)
+	}
+	err = h.open()
+	if err != nil {
+		h.logger.Error("Could not write history", "err", err)
+	}
+}
+
+func (h *History) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// AddMatches records the replays that selfID played in and that aren't in the history yet. Returns how many were new.
+func (h *History) AddMatches(selfID string, replays []ggst.Replay) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	added := 0
+	for _, replay := range replays {
+		if h.matches[replay.ID] {
+			continue
+		}
+		entry := h.newMatchHistoryEntry(selfID, &replay)
+		if entry == nil {
+			continue
+		}
+		h.matches[replay.ID] = true
+		added++
+		h.write(entry)
+	}
+	return added
+}
+
+// nil if selfID didn't play in replay
+func (h *History) newMatchHistoryEntry(selfID string, replay *ggst.Replay) *HistoryEntry {
+	self := -1
+	for i, player := range replay.Players {
+		if player.UserID == selfID {
+			self = i
+		}
+	}
+	if self < 0 || replay.Players[0].UserID == replay.Players[1].UserID {
+		return nil
+	}
+	opponent := 1 - self
+
+	entry := &HistoryEntry{
+		Time:         replay.Time,
+		Kind:         HistoryMatch,
+		Endpoint:     "catalog/get_replay",
+		UserID:       selfID,
+		Self:         true,
+		Name:         replay.Players[self].Name,
+		MatchID:      replay.ID,
+		Result:       HistoryLoss,
+		OpponentID:   replay.Players[opponent].UserID,
+		OpponentName: replay.Players[opponent].Name,
+		Floor:        replay.Floor,
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if replay.Winner == self+1 {
+		entry.Result = HistoryWin
+	}
+	entry.Character = h.characterCode(replay.Characters[self])
+	entry.OpponentCharacter = h.characterCode(replay.Characters[opponent])
+	return entry
+}
+
+// Unknown characters are kept by index so they can still be told apart
+func (h *History) characterCode(index int) string {
+	if code, ok := h.characters.Code(index); ok {
+		return code
+	}
+	return fmt.Sprintf("#%d", index)
+}
+
+// HistoryHandler records statistics/get responses and your matches in catalog/get_replay responses. Needs ClassifyHandler.
+func (h *History) HistoryHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := classifiedRequest(r)
+		if c == nil || (c.Kind != ggst.StatGet && c.Kind != ggst.GetReplay) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &CachingResponseWriter{w: w, code: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if rw.code != http.StatusOK {
+			return
+		}
+
+		if c.Kind == ggst.GetReplay {
+			replays, err := ggst.ParseReplays(rw.buf.Bytes())
+			if err != nil {
+				h.logger.Debug("Could not read replays", "err", err)
+				return
+			}
+			if added := h.AddMatches(c.Header.UserID, replays); added > 0 {
+				h.logger.Info("Added matches to history", "count", added)
+			}
+			return
+		}
+
+		p, ok := c.StatGet()
+		if !ok {
+			return
+		}
+		resp, err := ggst.UnmarshalStatResp(rw.buf.Bytes())
+		if err != nil || resp.Payload.JSON.Len() == 0 {
+			return
+		}
+		entry := newStatsHistoryEntry(c.Header.UserID, p, &resp.Payload.JSON)
+		h.Add(entry)
+	})
+}
+
+func newStatsHistoryEntry(selfID string, p *ggst.StatGetReqPayload, stats *ggst.RawJSON) *HistoryEntry {
+	entry := &HistoryEntry{
+		Time:     time.Now(),
+		Kind:     HistoryStats,
+		Endpoint: "statistics/get",
+		UserID:   p.OtherUserID,
+		Self:     p.OtherUserID == "",
+		Type:     p.Type,
+		Page:     p.Page,
+	}
+	if entry.Self {
+		entry.UserID = selfID
+	}
+	if text, err := stats.MarshalJSON(); err == nil {
+		entry.Data = json.RawMessage(text)
+	}
+	if ggst.StatGetType(p.Type) != ggst.StatGetLevels {
+		return entry
+	}
+
+	entry.Kind = HistoryRCode
+	entry.Levels = make(map[string]int)
+	for _, k := range stats.Keys() {
+		v, _ := stats.Get(k)
+		if k == "NAME" {
+			entry.Name, _ = v.(string)
+		} else if strings.HasSuffix(k, "Lv") && len(k) == 5 {
+			if n, ok := v.(json.Number); ok {
+				level, err := n.Int64()
+				if err == nil {
+					entry.Levels[k[0:3]] = int(level)
+				}
+			}
+		}
+	}
+	return entry
+}
+
+// HistoryQuery picks entries to show. Empty fields match everything.
+type HistoryQuery struct {
+	Opponent  string // User ID, or part of a name. Their R-Codes and your matches against them. Only your own entries if empty.
+	Character string // 3 letter character code. Levels of it, and matches you played as it.
+	Kind      string
+}
+
+func (q *HistoryQuery) Match(entry *HistoryEntry) bool {
+	if q.Opponent == "" {
+		if !entry.Self {
+			return false
+		}
+	} else if entry.Kind == HistoryMatch {
+		if !q.matchPlayer(entry.OpponentID, entry.OpponentName) {
+			return false
+		}
+	} else if entry.Self || !q.matchPlayer(entry.UserID, entry.Name) {
+		return false
+	}
+	if q.Kind != "" && entry.Kind != q.Kind {
+		return false
+	}
+	if q.Character != "" {
+		code := strings.ToUpper(q.Character)
+		if entry.Kind == HistoryMatch {
+			return entry.Character == code
+		}
+		if _, ok := entry.Levels[code]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *HistoryQuery) matchPlayer(userID string, name string) bool {
+	return userID == q.Opponent || (name != "" && strings.Contains(strings.ToLower(name), strings.ToLower(q.Opponent)))
+}
+
+// PrintHistory writes the entries matching q as a table, oldest first
+func PrintHistory(w io.Writer, entries []HistoryEntry, q *HistoryQuery) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tPLAYER\tKIND\tDETAILS")
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+	wins, losses := 0, 0
+	for i := range entries {
+		entry := &entries[i]
+		if !q.Match(entry) {
+			continue
+		}
+		if entry.Result == HistoryWin {
+			wins++
+		} else if entry.Result == HistoryLoss {
+			losses++
+		}
+		player := entry.UserID
+		if entry.Name != "" {
+			player = fmt.Sprintf("%s (%s)", entry.Name, entry.UserID)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", entry.Time.Local().Format("2006-01-02 15:04"), player, entry.Kind, historyDetails(entry, q))
+	}
+	tw.Flush()
+	if wins+losses > 0 {
+		fmt.Fprintf(w, "\n%d matches, %d wins, %d losses\n", wins+losses, wins, losses)
+	}
+}
+
+func historyDetails(entry *HistoryEntry, q *HistoryQuery) string {
+	switch entry.Kind {
+	case HistoryRCode:
+		if q.Character != "" {
+			code := strings.ToUpper(q.Character)
+			return fmt.Sprintf("%s Lv %d", code, entry.Levels[code])
+		}
+		codes := make([]string, 0, len(entry.Levels))
+		for code := range entry.Levels {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		levels := make([]string, 0, len(codes))
+		for _, code := range codes {
+			if entry.Levels[code] > 0 {
+				levels = append(levels, fmt.Sprintf("%s %d", code, entry.Levels[code]))
+			}
+		}
+		return strings.Join(levels, ", ")
+	case HistoryStats:
+		return fmt.Sprintf("%s page %d", ggst.StatGetType(entry.Type), entry.Page)
+	case HistoryMatch:
+		return fmt.Sprintf("%s as %s vs %s (%s) as %s, floor %d", entry.Result, entry.Character, entry.OpponentName, entry.OpponentID, entry.OpponentCharacter, entry.Floor)
+	}
+	return entry.Endpoint
+}
+
+// HistoryCommand runs the history subcommand. Shared by every binary so it works the same everywhere.
+func HistoryCommand(name string, args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	file := fs.String("history-file", "", "History file to read. Next to the exe if empty. Older history is in the same name with .1 before the extension.")
+	var q HistoryQuery
+	fs.StringVar(&q.Opponent, "opponent", "", "Show this player's R-Codes and your matches against them instead of your own R-Codes. 18 digit user ID, or part of their name.")
+	fs.StringVar(&q.Character, "character", "", "Only show levels of this character, and matches you played as it, e.g. SOL.")
+	fs.StringVar(&q.Kind, "kind", "", "Only show this kind of entry. One of rcode, stats, match. Matches only come from replay lists GGST loads, so open your replays after playing to keep them.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s history [-opponent <player>] [-character <code>] [-kind <kind>]\n", name)
+		fmt.Fprintln(fs.Output(), "Matches are taken from replay lists GGST loads, not from playing them, so only matches you've seen in the replay menu (or on the title screen with -unsafe-predict-replay) are listed.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	path := *file
+	if path == "" {
+		var err error
+		path, err = DefaultHistoryFile()
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	entries, err := ReadHistory(path)
+	if err != nil {
+		fmt.Println(err)
+		if len(entries) == 0 {
+			return 1
+		}
+	}
+	PrintHistory(os.Stdout, entries, &q)
+	return 0
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+var (
+	testSelf     = ggst.ReplayPlayer{UserID: "210611081234567890", Name: "Me"}
+	testOpponent = ggst.ReplayPlayer{UserID: "210611089876543210", Name: "Rival"}
+	testStranger = ggst.ReplayPlayer{UserID: "210611080000000001", Name: "Someone"}
+)
+
+func testReplay(id uint64, p1 ggst.ReplayPlayer, c1 int, p2 ggst.ReplayPlayer, c2 int, winner int) ggst.Replay {
+	return ggst.Replay{
+		ID:         id,
+		Floor:      10,
+		Characters: [2]int{c1, c2},
+		Players:    [2]ggst.ReplayPlayer{p1, p2},
+		Winner:     winner,
+		Time:       time.Date(2024, 1, 2, 3, 4, int(id), 0, time.UTC),
+	}
+}
+
+func TestHistoryMatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := NewHistory(path, DefaultCharacterTable(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	replays := []ggst.Replay{
+		testReplay(1, testSelf, 0, testOpponent, 1, 1),     // Win as SOL
+		testReplay(2, testOpponent, 2, testSelf, 0, 1),     // Loss as SOL, from player 2
+		testReplay(3, testOpponent, 1, testStranger, 2, 1), // Not ours
+		testReplay(4, testSelf, 1, testStranger, 98, 1),    // Win as KYK against an unknown character
+	}
+	if added := history.AddMatches(testSelf.UserID, replays); added != 3 {
+		t.Errorf("added %d matches, want 3", added)
+	}
+	history.Close()
+
+	// Matches already in the file aren't added again
+	history, err = NewHistory(path, DefaultCharacterTable(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added := history.AddMatches(testSelf.UserID, replays); added != 0 {
+		t.Errorf("added %d matches again", added)
+	}
+	history.Close()
+
+	entries, err := ReadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("%d entries, want 3", len(entries))
+	}
+	want := HistoryEntry{
+		Kind: HistoryMatch, UserID: testSelf.UserID, Self: true, Name: testSelf.Name, MatchID: 2, Result: HistoryLoss,
+		Character: "SOL", OpponentID: testOpponent.UserID, OpponentName: testOpponent.Name, OpponentCharacter: "MAY", Floor: 10,
+	}
+	got := entries[1]
+	got.Time, got.Endpoint = time.Time{}, ""
+	if got.Kind != want.Kind || got.Result != want.Result || got.Character != want.Character || got.OpponentID != want.OpponentID ||
+		got.OpponentName != want.OpponentName || got.OpponentCharacter != want.OpponentCharacter || got.Floor != want.Floor || got.MatchID != want.MatchID {
+		t.Errorf("entry = %+v, want %+v", got, want)
+	}
+	if entries[2].OpponentCharacter != "#98" {
+		t.Errorf("unknown character = %q, want #98", entries[2].OpponentCharacter)
+	}
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []uint64
+	}{
+		{"all", HistoryQuery{}, []uint64{1, 2, 4}},
+		{"opponent by id", HistoryQuery{Opponent: testOpponent.UserID}, []uint64{1, 2}},
+		{"opponent by name", HistoryQuery{Opponent: "rIVAL"}, []uint64{1, 2}},
+		{"character", HistoryQuery{Character: "kyk"}, []uint64{4}},
+		{"opponent and character", HistoryQuery{Opponent: "Someone", Character: "SOL"}, nil},
+		{"other kind", HistoryQuery{Kind: HistoryRCode}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint64
+			for i := range entries {
+				if tt.query.Match(&entries[i]) {
+					got = append(got, entries[i].MatchID)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("matched %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("matched %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	PrintHistory(&out, entries, &HistoryQuery{Opponent: "Rival"})
+	if !strings.Contains(out.String(), "win as SOL vs Rival") || !strings.Contains(out.String(), "2 matches, 1 wins, 1 losses") {
+		t.Errorf("printed:\n%s", out.String())
+	}
+}
+
+// R-Codes of an opponent are found by -opponent, but not your own
+func TestHistoryQueryRCode(t *testing.T) {
+	self := HistoryEntry{Kind: HistoryRCode, UserID: testSelf.UserID, Self: true, Name: "Rival fan", Levels: map[string]int{"SOL": 5}}
+	other := HistoryEntry{Kind: HistoryRCode, UserID: testOpponent.UserID, Name: testOpponent.Name, Levels: map[string]int{"MAY": 3}}
+	q := HistoryQuery{Opponent: "rival"}
+	if q.Match(&self) || !q.Match(&other) {
+		t.Errorf("-opponent rival matched self %v, other %v", q.Match(&self), q.Match(&other))
+	}
+	q = HistoryQuery{Opponent: "rival", Character: "SOL"}
+	if q.Match(&other) {
+		t.Error("-character SOL matched an R-Code without SOL")
+	}
+}
+
+func TestHistoryRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := NewHistory(path, DefaultCharacterTable(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	history.maxSize = 1000
+	for i := uint64(1); i <= 10; i++ {
+		history.AddMatches(testSelf.UserID, []ggst.Replay{testReplay(i, testSelf, 0, testOpponent, 1, 1)})
+	}
+	history.Close()
+
+	current, err := ReadHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := ReadHistory(RotatedHistoryFile(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) == 0 || len(current) == 0 || len(old)+len(current) > 10 {
+		t.Fatalf("%d entries in the old file and %d in the new one, want some of the 10 in each", len(old), len(current))
+	}
+	if info, _ := os.Stat(RotatedHistoryFile(path)); info.Size() < 1000 {
+		t.Errorf("rotated at %d bytes, want 1000", info.Size())
+	}
+	if last := current[len(current)-1].MatchID; last != 10 {
+		t.Errorf("newest match = %d, want 10", last)
+	}
+
+	// Matches in the old file still aren't added again
+	history, err = NewHistory(path, DefaultCharacterTable(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	if added := history.AddMatches(testSelf.UserID, []ggst.Replay{testReplay(old[0].MatchID, testSelf, 0, testOpponent, 1, 1)}); added != 0 {
+		t.Errorf("match %d from the old file added again", old[0].MatchID)
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// NewLogger creates a logger from the logging options. Logs always go to stdout, and are also appended to LogFile if set.
+func (o *StriveAPIProxyOptions) NewLogger() (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(o.LogLevel))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", o.LogLevel, err)
+	}
+
+	var out io.Writer = os.Stdout
+	if o.LogFile != "" {
+		file, err := os.OpenFile(o.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open log file: %w", err)
+		}
+		out = io.MultiWriter(os.Stdout, file)
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: level}
+	if o.LogJSON {
+		return slog.New(slog.NewJSONHandler(out, handlerOptions)), nil
+	}
+	return slog.New(slog.NewTextHandler(out, handlerOptions)), nil
+}
+
+// Log every request with the endpoint, status and how long it took, and keep the latest for the dashboard
+func requestLogger(logger *slog.Logger, requests *recentList[RequestLogEntry]) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			duration := time.Since(start)
+			logger.Info("Request",
+				"endpoint", endpoint(r),
+				"status", ww.Status(),
+				"bytes", ww.BytesWritten(),
+				"duration", duration,
+			)
+			requests.Add(RequestLogEntry{
+				Time:     start,
+				Endpoint: endpoint(r),
+				Status:   ww.Status(),
+				Bytes:    ww.BytesWritten(),
+				Duration: float64(duration) / float64(time.Millisecond),
+			})
+		})
+	}
+}
+
+// API endpoint of a request, e.g. statistics/get
+func endpoint(r *http.Request) string {
+	return apiEndpoint(r.URL.Path)
+}
+
+func apiEndpoint(path string) string {
+	return strings.TrimPrefix(path, "/api/")
+}
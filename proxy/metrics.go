@@ -0,0 +1,338 @@
+package proxy
+
+// Prometheus text format metrics so users can see whether keepalives, predictions and caching are actually working.
+// Hand rolled to avoid pulling in the whole Prometheus client for a handful of counters.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Upstream latency buckets in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics is safe for concurrent use. Metrics are always collected, but only exposed if the admin server is enabled.
+type Metrics struct {
+	Requests            *CounterVec   // Requests from GGST by endpoint and status
+	UpstreamLatency     *HistogramVec // Time to response headers from the ASW servers by endpoint
+	UpstreamErrors      *CounterVec   // Upstream requests that failed without a response by endpoint
+	UpstreamConns       *CounterVec   // Upstream connections by whether they were reused from the keepalive pool
+	PredictionHits      *CounterVec   // statistics/get calls answered from predictions
+	PredictionMisses    *CounterVec   // statistics/get calls made while predicting that weren't predicted
+	PredictionDropped   *CounterVec   // Predicted calls that were never used before they expired
+	CacheHits           *CounterVec   // ResponseCache hits by request
+	CacheMisses         *CounterVec   // ResponseCache misses by request
+	RatingFetchFailures *CounterVec   // Failed rating lookups
+	StatsQueueDepth     *GaugeFunc    // Pending async statistics/set uploads
+
+	lock    sync.Mutex
+	metrics []metric
+
+	upstreamLock sync.Mutex
+	upstreamLast UpstreamHealth // Only the Last* fields
+}
+
+// UpstreamHealth is how requests to the ASW servers have been going
+type UpstreamHealth struct {
+	Requests   uint64    `json:"requests"`              // Requests the GGST servers answered
+	Errors     uint64    `json:"errors"`                // Requests that failed without a response
+	LastTime   time.Time `json:"last_time"`             // Zero if nothing was sent yet
+	LastStatus int       `json:"last_status,omitempty"` // Status of the last request, 0 if it failed
+	LastError  string    `json:"last_error,omitempty"`  // Why the last request failed
+}
+
+// Healthy is whether the last request to the GGST servers got a response other than a server error
+func (h UpstreamHealth) Healthy() bool {
+	return h.LastStatus != 0 && h.LastStatus < 500
+}
+
+// UpstreamHealth returns counts of upstream requests, and how the last one went
+func (m *Metrics) UpstreamHealth() UpstreamHealth {
+	m.upstreamLock.Lock()
+	health := m.upstreamLast
+	m.upstreamLock.Unlock()
+	health.Requests = m.UpstreamLatency.Count()
+	health.Errors = m.UpstreamErrors.Sum()
+	return health
+}
+
+func (m *Metrics) setUpstreamLast(status int, err error) {
+	m.upstreamLock.Lock()
+	defer m.upstreamLock.Unlock()
+	m.upstreamLast = UpstreamHealth{LastTime: time.Now(), LastStatus: status}
+	if err != nil {
+		m.upstreamLast.LastError = err.Error()
+	}
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.Requests = m.counter("totsugeki_requests_total", "Requests from GGST.", "endpoint", "status")
+	m.UpstreamLatency = m.histogram("totsugeki_upstream_request_duration_seconds", "Time until response headers from the GGST servers.", latencyBuckets, "endpoint")
+	m.UpstreamErrors = m.counter("totsugeki_upstream_errors_total", "Requests to the GGST servers that failed without a response.", "endpoint")
+	m.UpstreamConns = m.counter("totsugeki_upstream_connections_total", "Connections used for requests to the GGST servers.", "reused")
+	m.PredictionHits = m.counter("totsugeki_prediction_hits_total", "Calls answered from predicted statistics/get calls.")
+	m.PredictionMisses = m.counter("totsugeki_prediction_misses_total", "Calls made while predicting that weren't predicted.")
+	m.PredictionDropped = m.counter("totsugeki_prediction_dropped_total", "Predicted calls that expired without being used.")
+	m.CacheHits = m.counter("totsugeki_cache_hits_total", "Requests answered from the response cache.", "request")
+	m.CacheMisses = m.counter("totsugeki_cache_misses_total", "Cacheable requests that weren't in the response cache.", "request")
+	m.RatingFetchFailures = m.counter("totsugeki_rating_fetch_failures_total", "Failed rating lookups.")
+	m.StatsQueueDepth = m.gauge("totsugeki_stats_queue_depth", "Async statistics/set uploads waiting to be sent.")
+	return m
+}
+
+func (m *Metrics) counter(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]uint64)}
+	m.metrics = append(m.metrics, c)
+	return c
+}
+
+func (m *Metrics) histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+	m.metrics = append(m.metrics, h)
+	return h
+}
+
+func (m *Metrics) gauge(name string, help string) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help}
+	m.metrics = append(m.metrics, g)
+	return g
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, metric := range m.metrics {
+		metric.write(w)
+	}
+}
+
+// RequestHandler counts requests from GGST by endpoint and status
+func (m *Metrics) RequestHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		m.Requests.Inc(endpoint(r), strconv.Itoa(ww.Status()))
+	})
+}
+
+// Transport wraps a http.RoundTripper to measure upstream latency and connection reuse
+func (m *Metrics) Transport(next http.RoundTripper) http.RoundTripper {
+	return &metricsTransport{next: next, metrics: m}
+}
+
+type metricsTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.metrics.UpstreamConns.Inc(strconv.FormatBool(info.Reused))
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.metrics.UpstreamErrors.Inc(endpoint(req))
+		t.metrics.setUpstreamLast(0, err)
+		return res, err
+	}
+	t.metrics.UpstreamLatency.Observe(time.Since(start).Seconds(), endpoint(req))
+	t.metrics.setUpstreamLast(res.StatusCode, nil)
+	return res, err
+}
+
+// CounterVec is a counter with optional labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]uint64 // Keyed by label values joined with labelSep
+}
+
+const labelSep = "\xff"
+
+// Inc increments the counter with the given label values
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(n uint64, labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.Join(labelValues, labelSep)] += n
+}
+
+// Sum returns the total of the counter across all labels
+func (c *CounterVec) Sum() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var sum uint64
+	for _, v := range c.values {
+		sum += v
+	}
+	return sum
+}
+
+// Values returns the counter by label values joined with commas
+func (c *CounterVec) Values() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for key, v := range c.values {
+		values[strings.ReplaceAll(key, labelSep, ",")] = v
+	}
+	return values
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, key, "", ""), c.values[key])
+	}
+}
+
+// HistogramVec is a histogram with optional labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Not cumulative. Last is +Inf.
+	sum    float64
+	count  uint64
+}
+
+// Observe adds a value to the histogram with the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labelValues, labelSep)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, value) // First bucket >= value
+	hist.counts[i]++
+	hist.sum += value
+	hist.count++
+}
+
+// Count returns the number of values observed across all label values
+func (h *HistogramVec) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var count uint64
+	for _, hist := range h.values {
+		count += hist.count
+	}
+	return count
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, count := range hist.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = strconv.FormatFloat(h.buckets[i], 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, formatLabels(h.labels, key, "", ""), hist.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when metrics are scraped
+type GaugeFunc struct {
+	name string
+	help string
+	lock sync.Mutex
+	f    func() float64
+}
+
+// Set sets the function that returns the current value
+func (g *GaugeFunc) Set(f func() float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.f = f
+}
+
+func (g *GaugeFunc) Value() float64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.f == nil {
+		return 0
+	}
+	return g.f()
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.Value())
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Format labels as {name="value",...}. extraName/extraValue is appended if set, for histogram le labels.
+func formatLabels(names []string, key string, extraName string, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, labelSep) {
+			if i < len(names) {
+				pairs = append(pairs, fmt.Sprintf("%s=%q", names[i], value))
+			}
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, tp *testProxy) map[string]string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	tp.proxy.adminRouter().ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("/metrics = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	// Series to value, and HELP/TYPE lines to themselves
+	lines := make(map[string]string)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			lines[line] = line
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("bad line %q", line)
+		}
+		lines[line[:i]] = line[i+1:]
+	}
+	return lines
+}
+
+func TestMetricsScrape(t *testing.T) {
+	upstream := newTestUpstream(t)
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{CacheNews: true, AsyncStatsSet: true, StatsJournalDir: t.TempDir(), ShutdownTimeout: 300 * time.Millisecond})
+	defer tp.shutdown(t)
+
+	tp.post(t, "sys/get_news", testHeaderData+"9100")
+	tp.post(t, "sys/get_news", testHeaderData+"9100") // From the cache
+	tp.post(t, "user/login", testHeaderData+"91a0")
+	upstream.fail.Store(true)
+	tp.post(t, "sys/get_env", testHeaderData+"91cd0100")
+	tp.post(t, "statistics/set", testHeaderData+"91a0") // Stays queued while ASW is down
+	upstream.waitFor(t, "statistics/set", 1)
+
+	metrics := scrapeMetrics(t, tp)
+	want := map[string]string{
+		"# TYPE totsugeki_requests_total counter":                                                    "",
+		`totsugeki_requests_total{endpoint="sys/get_news",status="200"}`:                             "2",
+		`totsugeki_requests_total{endpoint="sys/get_env",status="503"}`:                              "1",
+		`totsugeki_requests_total{endpoint="statistics/set",status="200"}`:                           "1",
+		"# TYPE totsugeki_upstream_request_duration_seconds histogram":                               "",
+		`totsugeki_upstream_request_duration_seconds_bucket{endpoint="sys/get_news",le="+Inf"}`:      "1",
+		`totsugeki_upstream_request_duration_seconds_count{endpoint="sys/get_news"}`:                 "1",
+		`totsugeki_upstream_request_duration_seconds_count{endpoint="user/login"}`:                   "1",
+		`totsugeki_upstream_connections_total{reused="false"}`:                                       "",
+		`totsugeki_upstream_connections_total{reused="true"}`:                                        "",
+		`totsugeki_cache_hits_total{request="sys/get_news"}`:                                         "1",
+		`totsugeki_cache_misses_total{request="sys/get_news"}`:                                       "1",
+		"# TYPE totsugeki_stats_queue_depth gauge":                                                   "",
+		"totsugeki_stats_queue_depth":                                                                "1",
+		"# HELP totsugeki_prediction_hits_total Calls answered from predicted statistics/get calls.": "",
+		"totsugeki_prediction_hits_total":                                                            "0",
+	}
+	for series, value := range want {
+		got, ok := metrics[series]
+		switch {
+		case !ok:
+			t.Errorf("%s missing", series)
+		case value != "" && !strings.HasPrefix(series, "#") && got != value:
+			t.Errorf("%s = %s, want %s", series, got, value)
+		}
+	}
+}
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+// Upstream requests that fail without a response count as errors, not latency
+func TestMetricsTransportErrors(t *testing.T) {
+	m := NewMetrics()
+	client := http.Client{Transport: m.Transport(failingTransport{})}
+	_, err := client.Post("http://127.0.0.1/api/statistics/get", "application/x-www-form-urlencoded", strings.NewReader(""))
+	if err == nil {
+		t.Fatal("request didn't fail")
+	}
+	if got := m.UpstreamErrors.Values(); len(got) != 1 || got["statistics/get"] != 1 {
+		t.Errorf("errors = %v, want statistics/get once", got)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), "\ntotsugeki_upstream_errors_total{endpoint=\"statistics/get\"} 1\n") {
+		t.Errorf("metrics:\n%s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "totsugeki_upstream_request_duration_seconds_count") {
+		t.Error("failed request was timed")
+	}
+}
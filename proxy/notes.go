@@ -0,0 +1,447 @@
+package proxy
+
+// Notes and tags about other players, shown when their R-Code is opened.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+// How long -notes-hook can run for
+const notesHookTimeout = 30 * time.Second
+
+type PlayerNote struct {
+	Name    string    `json:"name,omitempty"` // Last name seen. Only informational.
+	Note    string    `json:"note,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+func (n *PlayerNote) empty() bool {
+	return n.Note == "" && len(n.Tags) == 0
+}
+
+// Notes is a JSON file of 18 digit user IDs to PlayerNote. The file is read again whenever it changes, so it can be edited by hand.
+// Safe for concurrent use.
+type Notes struct {
+	path    string
+	hook    string
+	lock    sync.Mutex
+	modTime time.Time
+	notes   map[string]*PlayerNote
+	logger  *slog.Logger
+	token   string // Put in the notes page form so only the page itself can post it
+}
+
+// NewNotes reads notes from path, if it exists. hook is run whenever a player with notes is looked at. Disabled if empty.
+func NewNotes(path string, hook string, logger *slog.Logger) (*Notes, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	n := &Notes{path: path, hook: hook, notes: make(map[string]*PlayerNote), logger: logger, token: hex.EncodeToString(token)}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	err = n.reload()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Default notes file is next to the exe
+func DefaultNotesFile() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exePath), "notes.json"), nil
+}
+
+// Must hold lock
+func (n *Notes) reload() error {
+	info, err := os.Stat(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read notes: %w", err)
+	}
+	if info.ModTime().Equal(n.modTime) {
+		return nil
+	}
+	buf, err := os.ReadFile(n.path)
+	if err != nil {
+		return fmt.Errorf("could not read notes: %w", err)
+	}
+	notes := make(map[string]*PlayerNote)
+	err = json.Unmarshal(buf, &notes)
+	if err != nil {
+		return fmt.Errorf("could not read notes %s: %w", n.path, err)
+	}
+	n.notes = notes
+	n.modTime = info.ModTime()
+	return nil
+}
+
+// Must hold lock
+func (n *Notes) save() error {
+	buf, err := json.MarshalIndent(n.notes, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := n.path + ".tmp"
+	err = os.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, n.path) // Never leave a half written file behind
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(n.path); err == nil {
+		n.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Get returns the notes on userID
+func (n *Notes) Get(userID string) (PlayerNote, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	err := n.reload()
+	if err != nil {
+		n.logger.Error("Using old notes", "err", err)
+	}
+	note, ok := n.notes[userID]
+	if !ok || note.empty() {
+		return PlayerNote{}, false
+	}
+	return *note, true
+}
+
+// All returns a copy of every note by user ID
+func (n *Notes) All() (map[string]PlayerNote, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	err := n.reload()
+	notes := make(map[string]PlayerNote, len(n.notes))
+	for id, note := range n.notes {
+		notes[id] = *note
+	}
+	return notes, err
+}
+
+// Set replaces the notes on userID. Notes with no text or tags are removed.
+func (n *Notes) Set(userID string, note PlayerNote) error {
+	if !ggst.IsUserID(userID) {
+		return fmt.Errorf("invalid user ID %q: must be 18 digits", userID)
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	err := n.reload()
+	if err != nil {
+		return err
+	}
+	if note.empty() {
+		delete(n.notes, userID)
+	} else {
+		if note.Name == "" && n.notes[userID] != nil {
+			note.Name = n.notes[userID].Name
+		}
+		note.Updated = time.Now()
+		n.notes[userID] = &note
+	}
+	return n.save()
+}
+
+// Remember the name of players with notes so they're easier to find later. Must hold lock.
+func (n *Notes) setName(userID string, name string) {
+	note, ok := n.notes[userID]
+	if !ok || name == "" || note.Name == name {
+		return
+	}
+	note.Name = name
+	err := n.save()
+	if err != nil {
+		n.logger.Error("Could not save notes", "err", err)
+	}
+}
+
+// NotesHandler shows the notes on players whose R-Code is opened. Needs ClassifyHandler.
+func (n *Notes) NotesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := classifiedRequest(r)
+		if c == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, ok := c.StatGet()
+		if !ok || ggst.StatGetType(p.Type) != ggst.StatGetLevels || p.OtherUserID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		note, ok := n.Get(p.OtherUserID)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Get the name from the response so it's current
+		rw := &CachingResponseWriter{w: w, code: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if rw.code != http.StatusOK {
+			return
+		}
+		name := note.Name
+		if resp, err := ggst.UnmarshalStatResp(rw.buf.Bytes()); err == nil {
+			if v, ok := resp.Payload.JSON.Get("NAME"); ok {
+				if s, ok := v.(string); ok && s != "" {
+					name = s
+					n.lock.Lock()
+					n.setName(p.OtherUserID, name)
+					n.lock.Unlock()
+				}
+			}
+		}
+
+		n.logger.Info("Notes on player", "user_id", p.OtherUserID, "name", name, "note", note.Note, "tags", strings.Join(note.Tags, ","))
+		if n.hook != "" {
+			go n.runHook(p.OtherUserID, name, &note)
+		}
+	})
+}
+
+// The hook gets the player in environment variables so it doesn't need to parse anything
+func (n *Notes) runHook(userID string, name string, note *PlayerNote) {
+	ctx, cancel := context.WithTimeout(context.Background(), notesHookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.hook)
+	cmd.Env = append(os.Environ(),
+		"TOTSUGEKI_USER_ID="+userID,
+		"TOTSUGEKI_NAME="+name,
+		"TOTSUGEKI_NOTE="+note.Note,
+		"TOTSUGEKI_TAGS="+strings.Join(note.Tags, ","),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		n.logger.Error("Notes hook failed", "hook", n.hook, "err", err, "output", string(out))
+	}
+}
+
+// ParseTags splits comma separated tags, dropping empty and duplicate ones
+func ParseTags(s string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Sorted by name, then user ID
+func sortedNoteIDs(notes map[string]PlayerNote) []string {
+	ids := make([]string, 0, len(notes))
+	for id := range notes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := strings.ToLower(notes[ids[i]].Name), strings.ToLower(notes[ids[j]].Name)
+		if a != b {
+			return a < b
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+var notesPage = template.Must(template.New("notes").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Totsugeki notes</title></head>
+<body>
+<h1>Notes</h1>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+<table border="1" cellpadding="4">
+<tr><th>User ID</th><th>Name</th><th>Note</th><th>Tags</th><th>Updated</th></tr>
+{{range .Players}}<tr><td><a href="?user_id={{.UserID}}">{{.UserID}}</a></td><td>{{.Name}}</td><td>{{.Note}}</td><td>{{range $i, $t := .Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</td><td>{{.Updated.Local.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+<h2>Edit</h2>
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<p><label>User ID <input name="user_id" value="{{.Edit.UserID}}" size="20" pattern="[0-9]{18}" required></label></p>
+<p><label>Note <input name="note" value="{{.Edit.Note}}" size="60"></label></p>
+<p><label>Tags <input name="tags" value="{{.Edit.Tags}}" size="40"></label> (comma separated)</p>
+<p><input type="submit" value="Save"> Save with no note and no tags to remove a player.</p>
+</form>
+</body>
+</html>
+`))
+
+type notesPagePlayer struct {
+	UserID string
+	PlayerNote
+}
+
+// NotesPage lists notes and edits them from a form
+func (n *Notes) NotesPage(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Error   string
+		Token   string
+		Players []notesPagePlayer
+		Edit    struct{ UserID, Note, Tags string }
+	}{Token: n.token}
+
+	// A site with a DNS name pointed at 127.0.0.1 could read the page from the browser otherwise
+	hosts := adminHosts(r)
+	if !hosts[r.Host] {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost {
+		// Anything on the web can post a form to localhost, so only take posts from this page
+		origin := r.Header.Get("Origin")
+		if origin == "" || origin == "null" {
+			origin = r.Header.Get("Referer")
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme != "http" || !hosts[u.Host] ||
+			subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(n.token)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		userID := strings.TrimSpace(r.PostFormValue("user_id"))
+		err = n.Set(userID, PlayerNote{Note: strings.TrimSpace(r.PostFormValue("note")), Tags: ParseTags(r.PostFormValue("tags"))})
+		if err == nil {
+			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+			return
+		}
+		data.Error = err.Error()
+		data.Edit.UserID = userID
+		data.Edit.Note = r.PostFormValue("note")
+		data.Edit.Tags = r.PostFormValue("tags")
+	}
+
+	notes, err := n.All()
+	if err != nil && data.Error == "" {
+		data.Error = err.Error()
+	}
+	for _, id := range sortedNoteIDs(notes) {
+		data.Players = append(data.Players, notesPagePlayer{UserID: id, PlayerNote: notes[id]})
+	}
+	if id := r.URL.Query().Get("user_id"); id != "" && r.Method == http.MethodGet {
+		data.Edit.UserID = id
+		data.Edit.Note = notes[id].Note
+		data.Edit.Tags = strings.Join(notes[id].Tags, ", ")
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = notesPage.Execute(w, &data)
+	if err != nil {
+		n.logger.Error("Could not render notes page", "err", err)
+	}
+}
+
+// Hosts the admin server is reached at from this machine, from the loopback address and port the request came in on
+func adminHosts(r *http.Request) map[string]bool {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(local.String())
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		return nil
+	}
+	return map[string]bool{net.JoinHostPort(host, port): true, net.JoinHostPort("localhost", port): true}
+}
+
+// NewNotes creates the notes for -notes
+func (o *StriveAPIProxyOptions) NewNotes() (*Notes, error) {
+	path := o.NotesFile
+	if path == "" {
+		var err error
+		path, err = DefaultNotesFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger := o.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return NewNotes(path, o.NotesHook, logger.With("subsystem", "notes"))
+}
+
+// NotesCommand runs the notes subcommand. Shared by every binary so it works the same everywhere.
+func NotesCommand(name string, args []string) int {
+	fs := flag.NewFlagSet("notes", flag.ExitOnError)
+	file := fs.String("notes-file", "", "Notes file to use. Next to the exe if empty.")
+	userID := fs.String("set", "", "18 digit user ID of the player to set notes on.")
+	note := fs.String("note", "", "Note to set with -set.")
+	tags := fs.String("tags", "", "Comma separated tags to set with -set.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s notes [-set <user ID> [-note <note>] [-tags <tags>]]\n", name)
+		fmt.Fprintln(fs.Output(), "Lists notes if -set isn't given. Setting no note and no tags removes the player.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	path := *file
+	if path == "" {
+		var err error
+		path, err = DefaultNotesFile()
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	n, err := NewNotes(path, "", slog.Default())
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	if *userID != "" {
+		err = n.Set(*userID, PlayerNote{Note: *note, Tags: ParseTags(*tags)})
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	notes, _ := n.All()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER ID\tNAME\tTAGS\tNOTE")
+	for _, id := range sortedNoteIDs(notes) {
+		note := notes[id]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, note.Name, strings.Join(note.Tags, ","), note.Note)
+	}
+	tw.Flush()
+	return 0
+}
@@ -3,27 +3,54 @@ package proxy
 import (
 	"bytes"
 	"context"
-	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
+	"github.com/optix2000/totsugeki/ggst"
 )
 
 type StriveAPIProxy struct {
-	Client         *http.Client
-	Server         *http.Server
-	GGStriveAPIURL string
-	PatchedAPIURL  string
-	statsQueue     chan<- *http.Request
-	wg             sync.WaitGroup
-	prediction     StatsGetPrediction
-	CacheEnv       bool
-	responseCache  *ResponseCache
+	Client           *http.Client
+	Server           *http.Server
+	AdminServer      *http.Server // Serves metrics and the dashboard. nil if disabled.
+	Metrics          *Metrics
+	GGStriveAPIURL   string
+	PatchedAPIURL    string
+	statsQueue       chan<- *StatsJournalEntry
+	statsQueueLock   sync.RWMutex // Guards sending on statsQueue against it being closed
+	statsQueueClosed bool
+	statsStopping    chan struct{}                // Closed when shutdown starts, so handlers stop waiting on a full statsQueue
+	statsLogin       chan *ggst.ClassifiedRequest // First request after each login, for uploading leftover stats
+	statsLoggedIn    atomic.Bool                  // GGST logged in and statsLogin hasn't been sent yet
+	statsJournal     *StatsJournal
+	statsSetTemplate *StatsSetTemplate
+	statsPending     atomic.Int64    // Stats queued or being uploaded
+	statsUnsent      atomic.Int64    // Stats left for next start when shutting down
+	statsDraining    atomic.Bool     // Retry until the shutdown deadline instead of giving up
+	statsCtx         context.Context // Cancelled to abort uploads at the shutdown deadline
+	statsCancel      context.CancelFunc
+	shutdownTimeout  time.Duration
+	wg               sync.WaitGroup
+	prediction       *StatsGetPrediction
+	CacheEnv         bool
+	responseCache    *ResponseCache
+	recorder         *Recorder
+	history          *History
+	tracker          *RatingTracker
+	notes            *Notes
+	ratingUpdate     *RatingUpdate
+	requestLog       *recentList[RequestLogEntry]
+	patcherStatus    *PatcherStatus
+	unsafeOptions    []string
+	started          time.Time
+	logger           *slog.Logger
+	statsSetLogger   *slog.Logger
 }
 
 type StriveAPIProxyOptions struct {
@@ -35,12 +62,50 @@ type StriveAPIProxyOptions struct {
 	CacheEnv        bool
 	CacheFollow     bool
 	RatingUpdate    bool
+	PersistCache    bool          // Persist cached responses to disk so they survive restarts
+	CacheDir        string        // Where to persist cached responses. Next to the exe if empty.
+	CacheNewsTTL    time.Duration // How long persisted news is valid for
+	CacheFollowTTL  time.Duration // How long persisted follow/block lists are valid for
+	CacheMaxSize    int64         // Max size of persisted responses in bytes
+	RecordFile      string        // Append every request/response pair to this file
+	ReplayFile      string        // Answer requests from a file made with RecordFile instead of the ASW servers
+	ReplayFallback  bool          // Answer requests missing from ReplayFile with another response for the same path instead of a 404
+	LogLevel        string        // Minimum level to log. One of debug, info, warn, error
+	LogFile         string        // Also append logs to this file
+	LogJSON         bool          // Log JSON instead of key=value text
+	Logger          *slog.Logger  // Logger for the proxy and its subsystems. slog.Default() if nil.
+	AdminListen     string        // Address to serve metrics and the dashboard on. Disabled if empty.
+	StatsJournalDir string        // Where to keep async stats until they're uploaded. Next to the exe if empty.
+	ShutdownTimeout time.Duration // How long to keep trying to upload async stats when shutting down. DefaultShutdownTimeout if 0.
+
+	RatingDisplay              string          // How ratings are shown. See RatingDisplayRating etc.
+	RatingBucket               int             // Bucket size for RatingDisplayBucket. DefaultRatingBucket if 0.
+	RatingProvisionalDeviation float64         // Deviation above which RatingDisplayProvisional marks a rating. DefaultRatingProvisionalDeviation if 0.
+	RatingFormatter            RatingFormatter // Overrides RatingDisplay if set
+	RatingCacheSize            int             // Max players to cache ratings for. DefaultRatingCacheSize if 0.
+	RatingCacheTTL             time.Duration   // How long ratings are cached. DefaultRatingCacheTTL if 0.
+	RatingNegativeTTL          time.Duration   // How long players the rating source doesn't know are remembered. DefaultRatingNegativeTTL if 0.
+	RatingRate                 float64         // Max rating lookups per second. DefaultRatingRate if 0.
+	RatingBurst                int             // Lookups allowed at once before RatingRate kicks in. DefaultRatingBurst if 0.
+	CharactersFile             string          // JSON file of extra character codes for rating injection. See LoadCharacterTable.
+	Characters                 CharacterTable  // Overrides CharactersFile if set
+	RatingSource               string          // Where ratings come from. See NewRatingProvider.
+	History                    bool            // Keep R-Code snapshots and matches in HistoryFile
+	HistoryFile                string          // Where to keep history. Next to the exe if empty.
+	RatingProvider             RatingProvider  // Overrides RatingSource if set
+	TrackRatings               bool            // Rate players from replays seen. Implied by RatingSource local.
+	LocalRatingsFile           string          // Where to keep local ratings. Next to the exe if empty.
+	Notes                      bool            // Show notes from NotesFile on players whose R-Code is opened
+	NotesFile                  string          // Where to keep notes. Next to the exe if empty.
+	NotesHook                  string          // Program to run when a player with notes is looked at. See Notes.
+	PatcherStatus              *PatcherStatus  // Shown on the dashboard. Set if the patcher runs alongside the proxy.
 }
 
+const DefaultShutdownTimeout = 30 * time.Second
+
 func (s *StriveAPIProxy) proxyRequest(r *http.Request) (*http.Response, error) {
 	apiURL, err := url.Parse(s.GGStriveAPIURL) // TODO: Const this
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	apiURL.Path = r.URL.Path
@@ -55,7 +120,7 @@ func (s *StriveAPIProxy) proxyRequest(r *http.Request) (*http.Response, error) {
 func (s *StriveAPIProxy) HandleCatchall(w http.ResponseWriter, r *http.Request) {
 	resp, err := s.proxyRequest(r)
 	if err != nil {
-		fmt.Println(err)
+		s.logger.Error("Upstream request failed", "endpoint", endpoint(r), "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -67,7 +132,7 @@ func (s *StriveAPIProxy) HandleCatchall(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(resp.StatusCode)
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
-		fmt.Println(err)
+		s.logger.Warn("Could not copy upstream response", "endpoint", endpoint(r), "err", err)
 	}
 }
 
@@ -90,16 +155,12 @@ func (s *StriveAPIProxy) CacheInvalidationHandler(next http.Handler) http.Handle
 
 // Generic handler func for cached requests
 func (s *StriveAPIProxy) HandleCachedRequest(request string, w http.ResponseWriter, r *http.Request) {
-	if s.responseCache.ResponseExists(request) {
-		resp, body := s.responseCache.GetResponse(request)
-		for name, values := range resp.Header {
-			w.Header()[name] = values
-		}
-		w.Write(body)
+	if cached, ok := s.responseCache.GetResponse(request); ok {
+		cached.Serve(w)
 	} else {
 		resp, err := s.proxyRequest(r)
 		if err != nil {
-			fmt.Println(err)
+			s.logger.Error("Upstream request failed", "endpoint", request, "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
@@ -112,40 +173,41 @@ func (s *StriveAPIProxy) HandleCachedRequest(request string, w http.ResponseWrit
 		reader := io.TeeReader(resp.Body, w) // For dumping API payloads
 		buf, err := io.ReadAll(reader)
 		if err != nil {
-			fmt.Println(err)
+			s.logger.Warn("Could not read upstream response", "endpoint", request, "err", err)
+			return
+		}
+		if resp.StatusCode == http.StatusOK { // Don't keep serving errors
+			s.responseCache.AddResponse(request, resp, buf)
 		}
-		s.responseCache.AddResponse(request, resp, buf)
 	}
 }
 
 // GGST uses the URL from this API after initial launch so we need to intercept this.
 func (s *StriveAPIProxy) HandleGetEnv(w http.ResponseWriter, r *http.Request) {
-	if s.CacheEnv && s.responseCache.ResponseExists("sys/get_env") {
-		resp, body := s.responseCache.GetResponse("sys/get_env")
-		for name, values := range resp.Header {
-			w.Header()[name] = values
-		}
-		w.Write(body)
-	} else {
-		resp, err := s.proxyRequest(r)
-		if err != nil {
-			fmt.Println(err)
-			w.WriteHeader(http.StatusInternalServerError)
+	if s.CacheEnv {
+		if cached, ok := s.responseCache.GetResponse("sys/get_env"); ok {
+			cached.Serve(w)
 			return
 		}
-		defer resp.Body.Close()
-		// Copy headers
-		for name, values := range resp.Header {
-			w.Header()[name] = values
-		}
-		w.WriteHeader(resp.StatusCode)
-		buf, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println(err)
-		}
-		buf = bytes.Replace(buf, []byte(s.GGStriveAPIURL), []byte(s.PatchedAPIURL), -1)
-		w.Write(buf)
 	}
+	resp, err := s.proxyRequest(r)
+	if err != nil {
+		s.logger.Error("Upstream request failed", "endpoint", "sys/get_env", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	// Copy headers
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.logger.Warn("Could not read upstream response", "endpoint", "sys/get_env", "err", err)
+	}
+	buf = bytes.Replace(buf, []byte(s.GGStriveAPIURL), []byte(s.PatchedAPIURL), -1)
+	w.Write(buf)
 }
 
 // UNSAFE: Cache news on first request. On every other request return the cached value.
@@ -163,21 +225,55 @@ func (s *StriveAPIProxy) HandleGetBlock(w http.ResponseWriter, r *http.Request)
 	s.HandleCachedRequest("catalog/get_block", w, r)
 }
 
-func (s *StriveAPIProxy) Shutdown() {
-	fmt.Println("Shutting down proxy...")
+// Shutdown stops the proxy and waits for pending stats uploads, up to ShutdownTimeout.
+// Cancel ctx to stop waiting early. Stats that couldn't be uploaded are kept for next start.
+func (s *StriveAPIProxy) Shutdown(ctx context.Context) {
+	s.logger.Info("Shutting down proxy...")
 
-	err := s.Server.Shutdown(context.Background())
+	s.logger.Info("Waiting for connections to complete...")
+	err := s.Server.Shutdown(ctx)
 	if err != nil {
-		fmt.Println(err)
+		s.logger.Error("Could not shut down server", "err", err)
+	}
+
+	s.stopStatsSender(ctx, s.shutdownTimeout)
+
+	if s.AdminServer != nil {
+		err = s.AdminServer.Shutdown(ctx)
+		if err != nil {
+			s.logger.Error("Could not shut down admin server", "err", err)
+		}
+	}
+
+	if s.recorder != nil {
+		err = s.recorder.Close()
+		if err != nil {
+			s.logger.Error("Could not close capture file", "err", err)
+		}
 	}
 
-	s.stopStatsSender()
+	if s.tracker != nil {
+		s.tracker.Close()
+	}
 
-	fmt.Println("Waiting for connections to complete...")
-	s.wg.Wait()
+	if s.history != nil {
+		err = s.history.Close()
+		if err != nil {
+			s.logger.Error("Could not close history file", "err", err)
+		}
+	}
 }
 
 func CreateStriveProxy(listen string, GGStriveAPIURL string, PatchedAPIURL string, options *StriveAPIProxyOptions) *StriveAPIProxy {
+	logger := options.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	metrics := NewMetrics()
+	shutdownTimeout := options.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
 
 	transport := http.Transport{
 		Proxy:               http.ProxyFromEnvironment,
@@ -186,19 +282,82 @@ func CreateStriveProxy(listen string, GGStriveAPIURL string, PatchedAPIURL strin
 		MaxConnsPerHost:     2,
 		IdleConnTimeout:     90 * time.Second, // Drop idle connection after 90 seconds to balance between being nice to ASW and keeping things fast.
 	}
+
+	// Record what ASW actually sees and sends, before anything in the proxy rewrites or answers it
+	var recorder *Recorder
+	if options.RecordFile != "" {
+		var err error
+		recorder, err = NewRecorder(options.RecordFile, logger.With("subsystem", "recorder"))
+		if err != nil {
+			logger.Error("Could not start recording", "err", err)
+		} else {
+			logger.Info("Recording traffic", "file", options.RecordFile)
+		}
+	}
+	upstream := func(rt http.RoundTripper) http.RoundTripper {
+		if recorder != nil {
+			rt = recorder.Transport(rt)
+		}
+		return metrics.Transport(rt)
+	}
+
 	client := http.Client{
-		Transport: &transport,
+		Transport: upstream(&transport),
+	}
+
+	var replay *ReplayTransport
+	if options.ReplayFile != "" {
+		var err error
+		replay, err = NewReplayTransport(options.ReplayFile, logger.With("subsystem", "replay"))
+		if err != nil {
+			panic(err) // Don't silently fall back to the real servers
+		}
+		replay.Fallback = options.ReplayFallback
+		logger.Info("Replaying recorded responses", "count", replay.Len(), "file", options.ReplayFile)
+		client.Transport = upstream(replay)
+	}
+
+	cacheOptions := ResponseCacheOptions{
+		TTLs:    make(map[string]time.Duration),
+		MaxSize: options.CacheMaxSize,
+		Logger:  logger.With("subsystem", "cache"),
+		Metrics: metrics,
+	}
+	if options.PersistCache || options.CacheDir != "" {
+		// Only persisted responses expire, so -unsafe-cache-* work the same as always without -persist-cache
+		if options.CacheNewsTTL > 0 {
+			cacheOptions.TTLs["sys/get_news"] = options.CacheNewsTTL
+		}
+		if options.CacheFollowTTL > 0 {
+			cacheOptions.TTLs["catalog/get_follow"] = options.CacheFollowTTL
+			cacheOptions.TTLs["catalog/get_block"] = options.CacheFollowTTL
+		}
+		cacheOptions.Dir = options.CacheDir
+		if cacheOptions.Dir == "" {
+			dir, err := DefaultCacheDir()
+			if err != nil {
+				logger.Error("Could not find cache directory", "err", err)
+			}
+			cacheOptions.Dir = dir
+		}
 	}
 
 	proxy := &StriveAPIProxy{
-		Client:         &client,
-		Server:         &http.Server{Addr: listen},
-		GGStriveAPIURL: GGStriveAPIURL,
-		PatchedAPIURL:  PatchedAPIURL,
-		CacheEnv:       false,
-		responseCache: &ResponseCache{
-			responses: make(map[string]*CachedResponse),
-		},
+		Client:          &client,
+		Server:          &http.Server{Addr: listen},
+		Metrics:         metrics,
+		shutdownTimeout: shutdownTimeout,
+		GGStriveAPIURL:  GGStriveAPIURL,
+		PatchedAPIURL:   PatchedAPIURL,
+		CacheEnv:        false,
+		responseCache:   NewResponseCache(cacheOptions),
+		logger:          logger.With("subsystem", "proxy"),
+		statsSetLogger:  logger.With("subsystem", "stats_set"),
+		recorder:        recorder,
+		requestLog:      newRecentList[RequestLogEntry](dashboardRequests),
+		patcherStatus:   options.PatcherStatus,
+		unsafeOptions:   options.UnsafeOptions(),
+		started:         time.Now(),
 	}
 
 	statsSet := proxy.HandleCatchall
@@ -208,28 +367,116 @@ func CreateStriveProxy(listen string, GGStriveAPIURL string, PatchedAPIURL strin
 	getFollow := proxy.HandleCatchall
 	getBlock := proxy.HandleCatchall
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(requestLogger(proxy.logger, proxy.requestLog))
+	r.Use(metrics.RequestHandler)
+	r.Use(ClassifyHandler(logger.With("subsystem", "classify")))
+
 	r.Use(proxy.CacheInvalidationHandler)
 
+	tracker, _ := options.RatingProvider.(*RatingTracker)
 	if options.RatingUpdate {
-		ru := NewRatingUpdate()
+		formatter := options.RatingFormatter
+		if formatter == nil {
+			var err error
+			formatter, err = options.NewRatingFormatter()
+			if err != nil {
+				logger.Error("Showing ratings as is", "err", err)
+				formatter = FormatRating
+			}
+		}
+		provider := options.RatingProvider
+		if provider == nil {
+			var err error
+			provider, err = options.NewRatingProvider()
+			if err != nil {
+				logger.Error("Using ratingupdate.info", "err", err)
+				provider = NewHTTPRatingProvider(ratingUpdateURL, DefaultCharacterTable())
+			}
+		}
+		if t, ok := provider.(*RatingTracker); ok {
+			tracker = t
+		}
+		ru := NewRatingUpdate(logger.With("subsystem", "rating_update"), metrics, formatter, provider, RatingCacheOptions{
+			Size:        options.RatingCacheSize,
+			TTL:         options.RatingCacheTTL,
+			NegativeTTL: options.RatingNegativeTTL,
+			Rate:        options.RatingRate,
+			Burst:       options.RatingBurst,
+		})
+		proxy.ratingUpdate = ru
 		r.Use(ru.RatingUpdateHandler)
 	}
 
+	if tracker == nil && (options.TrackRatings || options.LocalRatingsFile != "") {
+		var err error
+		tracker, err = options.NewRatingTracker()
+		if err != nil {
+			logger.Error("Could not start rating replays", "err", err)
+		}
+	}
+	if tracker != nil {
+		proxy.tracker = tracker
+		logger.Info("Rating replays", "file", tracker.path)
+		r.Use(tracker.TrackHandler)
+	}
+
+	if options.History || options.HistoryFile != "" {
+		// After rating injection so real levels are kept
+		history, err := options.NewHistory(logger.With("subsystem", "history"))
+		if err != nil {
+			logger.Error("Could not start history", "err", err)
+		} else {
+			logger.Info("Keeping history", "file", history.file.Name())
+			proxy.history = history
+			r.Use(history.HistoryHandler)
+		}
+	}
+
+	if options.Notes || options.NotesFile != "" || options.NotesHook != "" {
+		notes, err := options.NewNotes()
+		if err != nil {
+			logger.Error("Could not load notes", "err", err)
+		} else {
+			logger.Info("Showing notes", "file", notes.path)
+			proxy.notes = notes
+			r.Use(notes.NotesHandler)
+		}
+	}
+
 	if options.AsyncStatsSet {
 		statsSet = proxy.HandleStatsSet
+		proxy.statsSetTemplate = NewStatsSetTemplate(proxy.statsSetLogger)
+		r.Use(proxy.statsSetTemplate.LearnHandler)
+		r.Use(proxy.StatsLoginHandler)
+		journalDir := options.StatsJournalDir
+		if journalDir == "" {
+			dir, err := DefaultStatsJournalDir()
+			if err != nil {
+				logger.Error("Could not find stats journal directory", "err", err)
+			}
+			journalDir = dir
+		}
+		journal, err := NewStatsJournal(journalDir, proxy.statsSetLogger)
+		if err != nil {
+			logger.Error("Stats won't survive Totsugeki closing early", "err", err)
+		} else {
+			proxy.statsJournal = journal
+		}
 		proxy.statsQueue = proxy.startStatsSender()
+		metrics.StatsQueueDepth.Set(func() float64 { return float64(proxy.statsPending.Load()) })
 	}
 	if options.PredictStatsGet {
-		predictStatsTransport := transport
+		predictStatsTransport := transport.Clone()
 		predictStatsTransport.MaxIdleConns = StatsGetWorkers
 		predictStatsTransport.MaxIdleConnsPerHost = StatsGetWorkers
 		predictStatsTransport.MaxConnsPerHost = StatsGetWorkers
 		predictStatsTransport.IdleConnTimeout = 10 * time.Second // Quickly drop connections since this is a one-shot.
 		predictStatsClient := client
-		predictStatsClient.Transport = &predictStatsTransport
+		if replay == nil {
+			predictStatsClient.Transport = upstream(predictStatsTransport)
+		}
 
-		proxy.prediction = CreateStatsGetPrediction(GGStriveAPIURL, &predictStatsClient, proxy.responseCache)
+		proxy.prediction = CreateStatsGetPrediction(GGStriveAPIURL, &predictStatsClient, proxy.responseCache, logger.With("subsystem", "prediction"), metrics)
 		r.Use(proxy.prediction.StatsGetStateHandler)
 		statsGet = func(w http.ResponseWriter, r *http.Request) {
 			if !proxy.prediction.HandleGetStats(w, r) {
@@ -258,15 +505,17 @@ func CreateStriveProxy(listen string, GGStriveAPIURL string, PatchedAPIURL strin
 		proxy.CacheEnv = true
 		resp, err := client.Post(GGStriveAPIURL+"sys/get_env", "application/x-www-form-urlencoded", bytes.NewBuffer([]byte("data=9295a0a002a5302e302e360391cd0100")))
 		if err != nil {
-			fmt.Println(err)
-		}
-		buf, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Println(err)
+			logger.Error("Could not prefetch sys/get_env", "err", err)
+		} else {
+			buf, err := io.ReadAll(resp.Body)
+			if err != nil {
+				logger.Error("Could not prefetch sys/get_env", "err", err)
+			} else if resp.StatusCode == http.StatusOK {
+				buf = bytes.Replace(buf, []byte(GGStriveAPIURL), []byte(PatchedAPIURL), -1)
+				proxy.responseCache.AddResponse("sys/get_env", resp, buf)
+			}
+			resp.Body.Close()
 		}
-		buf = bytes.Replace(buf, []byte(GGStriveAPIURL), []byte(PatchedAPIURL), -1)
-		proxy.responseCache.AddResponse("sys/get_env", resp, buf)
-		resp.Body.Close()
 	}
 
 	r.Route("/api", func(r chi.Router) {
@@ -284,5 +533,9 @@ func CreateStriveProxy(listen string, GGStriveAPIURL string, PatchedAPIURL strin
 	})
 
 	proxy.Server.Handler = r
+
+	if options.AdminListen != "" {
+		proxy.AdminServer = &http.Server{Addr: options.AdminListen, Handler: proxy.adminRouter()}
+	}
 	return proxy
 }
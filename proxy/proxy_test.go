@@ -0,0 +1,352 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/optix2000/totsugeki/mockasw"
+)
+
+const testPatchedAPIURL = "http://127.0.0.1:21611/api/"
+
+// mockasw that counts requests per endpoint and can be made to fail
+type testUpstream struct {
+	server   *httptest.Server
+	lock     sync.Mutex
+	requests map[string]int
+	bodies   map[string][]byte // Last request body for each endpoint
+	fail     atomic.Bool
+}
+
+func newTestUpstream(t *testing.T) *testUpstream {
+	u := &testUpstream{requests: make(map[string]int), bodies: make(map[string][]byte)}
+	asw := mockasw.NewServer("", mockasw.Options{}).Handler()
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		u.lock.Lock()
+		u.requests[apiEndpoint(r.URL.Path)]++
+		u.bodies[apiEndpoint(r.URL.Path)] = body
+		u.lock.Unlock()
+		if u.fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		asw.ServeHTTP(w, r)
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *testUpstream) count(endpoint string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests[endpoint]
+}
+
+func (u *testUpstream) body(endpoint string) []byte {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.bodies[endpoint]
+}
+
+// Count once requests the proxy already gave up on have stopped arriving
+func (u *testUpstream) settledCount(endpoint string) int {
+	n := u.count(endpoint)
+	for {
+		time.Sleep(50 * time.Millisecond)
+		again := u.count(endpoint)
+		if again == n {
+			return n
+		}
+		n = again
+	}
+}
+
+func (u *testUpstream) waitFor(t *testing.T, endpoint string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for u.count(endpoint) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s sent upstream %d times, want %d", endpoint, u.count(endpoint), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type testProxy struct {
+	proxy  *StriveAPIProxy
+	server *httptest.Server
+}
+
+func newTestProxy(t *testing.T, upstream *testUpstream, options StriveAPIProxyOptions) *testProxy {
+	options.Logger = discardLogger()
+	p := CreateStriveProxy("", upstream.server.URL+"/api/", testPatchedAPIURL, &options)
+	server := httptest.NewServer(p.Server.Handler)
+	t.Cleanup(server.Close)
+	return &testProxy{proxy: p, server: server}
+}
+
+func (tp *testProxy) post(t *testing.T, path string, data string) (int, []byte) {
+	t.Helper()
+	resp, err := tp.server.Client().Post(tp.server.URL+"/api/"+path, "application/x-www-form-urlencoded", strings.NewReader("data="+data+"\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func (tp *testProxy) shutdown(t *testing.T) {
+	tp.server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tp.proxy.Shutdown(ctx)
+}
+
+func journalFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestProxyGetEnv(t *testing.T) {
+	upstream := newTestUpstream(t)
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{})
+
+	code, body := tp.post(t, "sys/get_env", testHeaderData+"91cd0100")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if !bytes.Contains(body, []byte(testPatchedAPIURL)) || bytes.Contains(body, []byte(upstream.server.URL)) {
+		t.Errorf("get_env = %q, want the API URL replaced with %s", body, testPatchedAPIURL)
+	}
+}
+
+func TestProxyPrediction(t *testing.T) {
+	upstream := newTestUpstream(t)
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{PredictStatsGet: true, CacheFollow: true})
+
+	tasks := ExpectedTitleScreenCalls()
+	if code, _ := tp.post(t, tasks[0].path, testHeaderData+tasks[0].data); code != http.StatusOK {
+		t.Fatalf("first call = %d", code)
+	}
+	var wg sync.WaitGroup
+	for _, task := range tasks[1:] {
+		if task.path != "statistics/get" {
+			continue
+		}
+		wg.Add(1)
+		go func(task StatsGetTask) {
+			defer wg.Done()
+			if code, body := tp.post(t, task.path, testHeaderData+task.data); code != http.StatusOK || len(body) == 0 {
+				t.Errorf("%s %s = %d %q", task.path, task.data, code, body)
+			}
+		}(task)
+	}
+	wg.Wait()
+
+	// get_follow and get_block are answered from the response cache, which only has them once they're fetched
+	deadline := time.Now().Add(5 * time.Second)
+	for tp.proxy.prediction.State() == prefetching && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	for _, task := range tasks {
+		if task.path == "statistics/get" || task.path == "catalog/get_replay" {
+			continue
+		}
+		if code, body := tp.post(t, task.path, testHeaderData+task.data); code != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s %s = %d %q", task.path, task.data, code, body)
+		}
+	}
+
+	// Everything was fetched once by the prediction, and nothing was sent again for GGST
+	for endpoint, want := range map[string]int{"statistics/get": 24, "catalog/get_follow": 1, "catalog/get_block": 1, "lobby/get_vip_status": 1, "item/get_item": 1} {
+		if got := upstream.count(endpoint); got != want {
+			t.Errorf("%s sent upstream %d times, want %d", endpoint, got, want)
+		}
+	}
+	if hits := tp.proxy.Metrics.PredictionHits.Sum(); hits != uint64(len(tasks)-5) {
+		t.Errorf("prediction hits = %d, want %d", hits, len(tasks)-5)
+	}
+	if state := tp.proxy.prediction.State(); state != idle {
+		t.Errorf("state = %v, want idle", state)
+	}
+}
+
+func TestProxyCache(t *testing.T) {
+	upstream := newTestUpstream(t)
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{CacheNews: true, CacheFollow: true})
+
+	// Errors aren't cached
+	upstream.fail.Store(true)
+	if code, _ := tp.post(t, "sys/get_news", testHeaderData+"9100"); code != http.StatusServiceUnavailable {
+		t.Errorf("get_news while ASW is down = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	upstream.fail.Store(false)
+
+	_, first := tp.post(t, "sys/get_news", testHeaderData+"9100")
+	code, second := tp.post(t, "sys/get_news", testHeaderData+"9100")
+	if code != http.StatusOK || !bytes.Equal(first, second) {
+		t.Errorf("cached get_news = %d %q, want %q", code, second, first)
+	}
+	if got := upstream.count("sys/get_news"); got != 2 {
+		t.Errorf("get_news sent upstream %d times, want 2", got)
+	}
+
+	tp.post(t, "catalog/get_follow", testHeaderData+"93000101")
+	tp.post(t, "catalog/get_follow", testHeaderData+"93000101")
+	if got := upstream.count("catalog/get_follow"); got != 1 {
+		t.Errorf("get_follow sent upstream %d times, want 1", got)
+	}
+	// Following someone changes the list
+	tp.post(t, "follow/follow_user", testHeaderData+"91a0")
+	tp.post(t, "catalog/get_follow", testHeaderData+"93000101")
+	if got := upstream.count("catalog/get_follow"); got != 2 {
+		t.Errorf("get_follow sent upstream %d times after following, want 2", got)
+	}
+}
+
+func TestProxyAsyncStatsSet(t *testing.T) {
+	upstream := newTestUpstream(t)
+	dir := t.TempDir()
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{AsyncStatsSet: true, StatsJournalDir: dir})
+
+	tp.post(t, "user/login", testHeaderData+"91a0") // Teaches the proxy what statistics/set responses look like
+	for _, path := range []string{"statistics/set", "tus/write"} {
+		if code, body := tp.post(t, path, testHeaderData+"91a0"); code != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s = %d %q", path, code, body)
+		}
+	}
+	upstream.waitFor(t, "statistics/set", 1)
+	upstream.waitFor(t, "tus/write", 1)
+
+	tp.shutdown(t)
+	if files := journalFiles(t, dir); len(files) != 0 {
+		t.Errorf("journal not empty after uploading: %v", files)
+	}
+}
+
+// Stats ASW doesn't accept before shutdown stay in the journal, and are uploaded with the new login hash once GGST logs in next start
+func TestProxyAsyncStatsSetJournal(t *testing.T) {
+	upstream := newTestUpstream(t)
+	dir := t.TempDir()
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{AsyncStatsSet: true, StatsJournalDir: dir, ShutdownTimeout: 300 * time.Millisecond})
+
+	upstream.fail.Store(true)
+	if code, _ := tp.post(t, "statistics/set", testHeaderData+"92a3616263a0"); code != http.StatusOK {
+		t.Errorf("statistics/set = %d", code)
+	}
+	tp.shutdown(t)
+	files := journalFiles(t, dir)
+	if len(files) != 1 {
+		t.Fatalf("journal = %v, want 1 entry", files)
+	}
+
+	upstream.fail.Store(false)
+	sent := upstream.settledCount("statistics/set")
+	tp = newTestProxy(t, upstream, StriveAPIProxyOptions{AsyncStatsSet: true, StatsJournalDir: dir})
+	time.Sleep(100 * time.Millisecond)
+	if got := upstream.count("statistics/set"); got != sent {
+		t.Fatalf("leftover stats sent before logging in")
+	}
+
+	tp.post(t, "user/login", testOtherHashHeaderData+"91a0")
+	tp.post(t, "statistics/get", testOtherHashHeaderData+"96a007ffffffff")
+	upstream.waitFor(t, "statistics/set", sent+1)
+	want := "data=" + testOtherHashHeaderData + "92a3616263a0\x00"
+	if got := string(upstream.body("statistics/set")); got != want {
+		t.Errorf("leftover stats sent as %q, want %q", got, want)
+	}
+	tp.shutdown(t)
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("journal entry still there after uploading: %v", err)
+	}
+}
+
+// Handlers still running after a shutdown that was cancelled early don't panic or lose stats
+func TestProxyAsyncStatsSetDuringShutdown(t *testing.T) {
+	upstream := newTestUpstream(t)
+	dir := t.TempDir()
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{AsyncStatsSet: true, StatsJournalDir: dir})
+	tp.post(t, "user/login", testHeaderData+"91a0")
+
+	const requests = 50
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			tp.proxy.Server.Handler.ServeHTTP(w, apiRequest("statistics/set", testHeaderData+"91a0"))
+			if w.Code != http.StatusOK {
+				t.Errorf("statistics/set = %d", w.Code)
+			}
+		}()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // Second Ctrl+C
+	tp.proxy.Shutdown(ctx)
+	wg.Wait()
+
+	if sent, journaled := upstream.count("statistics/set"), len(journalFiles(t, dir)); sent+journaled < requests {
+		t.Errorf("%d stats uploaded and %d journaled, want %d", sent, journaled, requests)
+	}
+}
+
+// Shutdown with ASW down and a full stats queue gives up at the deadline instead of hanging on handlers waiting to queue
+func TestProxyAsyncStatsSetFullQueueShutdown(t *testing.T) {
+	upstream := newTestUpstream(t)
+	upstream.fail.Store(true)
+	dir := t.TempDir()
+	tp := newTestProxy(t, upstream, StriveAPIProxyOptions{AsyncStatsSet: true, StatsJournalDir: dir, ShutdownTimeout: 300 * time.Millisecond})
+
+	const requests = 40 // More than the queue holds
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			tp.proxy.Server.Handler.ServeHTTP(w, apiRequest("statistics/set", testHeaderData+"91a0"))
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(journalFiles(t, dir)) < requests {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d stats journaled", len(journalFiles(t, dir)), requests)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		tp.proxy.Shutdown(context.Background())
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown hung")
+	}
+	if journaled := len(journalFiles(t, dir)); journaled != requests {
+		t.Errorf("%d stats left in the journal, want %d", journaled, requests)
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+// Caches rating lookups so looking at the same R-Codes over and over doesn't hammer the rating source.
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	DefaultRatingCacheSize   = 1000
+	DefaultRatingCacheTTL    = 10 * time.Minute
+	DefaultRatingNegativeTTL = time.Hour
+	DefaultRatingRate        = 2.0 // Lookups per second
+	DefaultRatingBurst       = 5
+)
+
+// How long a lookup can take, including waiting for the rate limit
+const ratingLookupTimeout = 10 * time.Second
+
+// ErrPlayerNotFound is returned for players the rating source doesn't know about
+var ErrPlayerNotFound = errors.New("player not found")
+
+// ErrRatingRateLimited is returned when a lookup would have to wait too long for the rate limit
+var ErrRatingRateLimited = errors.New("too many rating lookups")
+
+type RatingCacheOptions struct {
+	Size        int           // Max players cached. Least recently used are removed first. DefaultRatingCacheSize if 0.
+	TTL         time.Duration // How long ratings are used before looking them up again. DefaultRatingCacheTTL if 0.
+	NegativeTTL time.Duration // How long players that weren't found are remembered. DefaultRatingNegativeTTL if 0.
+	Rate        float64       // Max lookups per second. DefaultRatingRate if 0.
+	Burst       int           // Lookups allowed at once before Rate kicks in. DefaultRatingBurst if 0.
+	Logger      *slog.Logger  // slog.Default() if nil
+	Metrics     *Metrics      // Counts hits and misses. Not exposed anywhere if nil.
+}
+
+type ratingCacheEntry struct {
+	userID  uint64
+	ratings Ratings
+	err     error // ErrPlayerNotFound if this is a negative entry
+	expires time.Time
+}
+
+// An in flight lookup. Everyone asking for the same player waits on done.
+type ratingLookup struct {
+	done    chan struct{}
+	ratings Ratings
+	err     error
+}
+
+// RatingCache is safe for concurrent use. Ratings returned from it must not be modified.
+type RatingCache struct {
+	lock     sync.Mutex
+	entries  map[uint64]*list.Element // Values are *ratingCacheEntry
+	lru      *list.List               // Most recently used at the front
+	inflight map[uint64]*ratingLookup
+	limiter  *rate.Limiter
+	fetch    func(ctx context.Context, userID uint64) (Ratings, error)
+	options  RatingCacheOptions
+	now      func() time.Time // time.Now, except in tests
+}
+
+func NewRatingCache(fetch func(ctx context.Context, userID uint64) (Ratings, error), options RatingCacheOptions) *RatingCache {
+	if options.Size <= 0 {
+		options.Size = DefaultRatingCacheSize
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultRatingCacheTTL
+	}
+	if options.NegativeTTL <= 0 {
+		options.NegativeTTL = DefaultRatingNegativeTTL
+	}
+	if options.Rate <= 0 {
+		options.Rate = DefaultRatingRate
+	}
+	if options.Burst <= 0 {
+		options.Burst = DefaultRatingBurst
+	}
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+	if options.Metrics == nil {
+		options.Metrics = NewMetrics()
+	}
+	return &RatingCache{
+		entries:  make(map[uint64]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[uint64]*ratingLookup),
+		limiter:  rate.NewLimiter(rate.Limit(options.Rate), options.Burst),
+		fetch:    fetch,
+		options:  options,
+		now:      time.Now,
+	}
+}
+
+// Get returns the ratings of userID, looking them up if they aren't cached.
+// Concurrent calls for the same player share one lookup. If a lookup fails, expired ratings are used if there are any.
+func (c *RatingCache) Get(userID uint64) (Ratings, error) {
+	c.lock.Lock()
+	var stale *ratingCacheEntry
+	if elem, ok := c.entries[userID]; ok {
+		entry := elem.Value.(*ratingCacheEntry)
+		c.lru.MoveToFront(elem)
+		if c.now().Before(entry.expires) {
+			c.lock.Unlock()
+			c.options.Metrics.CacheHits.Inc("ratings")
+			return entry.ratings, entry.err
+		}
+		if entry.err == nil {
+			stale = entry
+		}
+	}
+	c.options.Metrics.CacheMisses.Inc("ratings")
+
+	lookup, ok := c.inflight[userID]
+	if !ok {
+		lookup = &ratingLookup{done: make(chan struct{})}
+		c.inflight[userID] = lookup
+		go c.lookup(userID, lookup)
+	}
+	c.lock.Unlock()
+
+	<-lookup.done
+	if lookup.err != nil && !errors.Is(lookup.err, ErrPlayerNotFound) && stale != nil {
+		c.options.Logger.Warn("Using expired ratings", "user_id", userID, "err", lookup.err)
+		return stale.ratings, nil
+	}
+	return lookup.ratings, lookup.err
+}
+
+// Runs without the caller's context so a request GGST gives up on doesn't fail everyone waiting on the same player
+func (c *RatingCache) lookup(userID uint64, lookup *ratingLookup) {
+	ctx, cancel := context.WithTimeout(context.Background(), ratingLookupTimeout)
+	defer cancel()
+
+	// Fails straight away if the wait would be longer than the timeout
+	if c.limiter.Wait(ctx) != nil {
+		lookup.err = ErrRatingRateLimited
+	} else {
+		lookup.ratings, lookup.err = c.fetch(ctx, userID)
+	}
+
+	c.lock.Lock()
+	delete(c.inflight, userID)
+	switch {
+	case lookup.err == nil:
+		c.add(&ratingCacheEntry{userID: userID, ratings: lookup.ratings, expires: c.now().Add(c.options.TTL)})
+	case errors.Is(lookup.err, ErrPlayerNotFound):
+		c.add(&ratingCacheEntry{userID: userID, err: lookup.err, expires: c.now().Add(c.options.NegativeTTL)})
+	}
+	c.lock.Unlock()
+	close(lookup.done)
+}
+
+// Must hold lock
+func (c *RatingCache) add(entry *ratingCacheEntry) {
+	if elem, ok := c.entries[entry.userID]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.userID] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.options.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ratingCacheEntry).userID)
+	}
+}
+
+// Len returns the number of players cached, including expired ones
+func (c *RatingCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Rating source that counts lookups. Players in missing aren't found, and lookups wait for release if it's set.
+type testRatingSource struct {
+	lock    sync.Mutex
+	fetches map[uint64]int
+	missing map[uint64]bool
+	fail    error
+	release chan struct{}
+}
+
+func newTestRatingSource() *testRatingSource {
+	return &testRatingSource{fetches: make(map[uint64]int), missing: make(map[uint64]bool)}
+}
+
+func (s *testRatingSource) fetch(ctx context.Context, userID uint64) (Ratings, error) {
+	s.lock.Lock()
+	s.fetches[userID]++
+	release, fail, missing := s.release, s.fail, s.missing[userID]
+	s.lock.Unlock()
+	if release != nil {
+		<-release
+	}
+	if fail != nil {
+		return nil, fail
+	}
+	if missing {
+		return nil, ErrPlayerNotFound
+	}
+	return Ratings{{Value: float64(userID), Deviation: 50}}, nil
+}
+
+func (s *testRatingSource) count(userID uint64) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fetches[userID]
+}
+
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestRatingCache(source *testRatingSource, options RatingCacheOptions) (*RatingCache, *testClock) {
+	clock := &testClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	if options.Rate == 0 {
+		options.Rate = 1000
+		options.Burst = 1000
+	}
+	options.Logger = discardLogger()
+	cache := NewRatingCache(source.fetch, options)
+	cache.now = clock.Now
+	return cache, clock
+}
+
+func TestRatingCacheEviction(t *testing.T) {
+	source := newTestRatingSource()
+	cache, _ := newTestRatingCache(source, RatingCacheOptions{Size: 2})
+
+	cache.Get(1)
+	cache.Get(2)
+	cache.Get(1) // 2 is now the least recently used
+	cache.Get(3)
+	if n := cache.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	cache.Get(1)
+	cache.Get(2)
+	for userID, want := range map[uint64]int{1: 1, 2: 2, 3: 1} {
+		if got := source.count(userID); got != want {
+			t.Errorf("player %d looked up %d times, want %d", userID, got, want)
+		}
+	}
+}
+
+func TestRatingCacheTTL(t *testing.T) {
+	source := newTestRatingSource()
+	cache, clock := newTestRatingCache(source, RatingCacheOptions{TTL: time.Minute, NegativeTTL: time.Hour})
+	source.missing[2] = true
+
+	ratings, err := cache.Get(1)
+	if err != nil || len(ratings) != 1 || ratings[0].Value != 1 {
+		t.Fatalf("Get(1) = %v, %v", ratings, err)
+	}
+	if _, err := cache.Get(2); !errors.Is(err, ErrPlayerNotFound) {
+		t.Fatalf("Get(2) = %v, want ErrPlayerNotFound", err)
+	}
+
+	// Both are cached, players that weren't found too
+	clock.Advance(time.Minute - time.Second)
+	cache.Get(1)
+	if _, err := cache.Get(2); !errors.Is(err, ErrPlayerNotFound) {
+		t.Errorf("cached Get(2) = %v, want ErrPlayerNotFound", err)
+	}
+	if source.count(1) != 1 || source.count(2) != 1 {
+		t.Errorf("looked up %d and %d times before expiring, want 1", source.count(1), source.count(2))
+	}
+
+	// Ratings expire after TTL, but players that weren't found are remembered for NegativeTTL
+	clock.Advance(time.Second)
+	cache.Get(1)
+	cache.Get(2)
+	if source.count(1) != 2 || source.count(2) != 1 {
+		t.Errorf("looked up %d and %d times after TTL, want 2 and 1", source.count(1), source.count(2))
+	}
+	clock.Advance(time.Hour)
+	cache.Get(2)
+	if got := source.count(2); got != 2 {
+		t.Errorf("missing player looked up %d times after NegativeTTL, want 2", got)
+	}
+}
+
+// Expired ratings are better than none when the rating source is down
+func TestRatingCacheStale(t *testing.T) {
+	source := newTestRatingSource()
+	cache, clock := newTestRatingCache(source, RatingCacheOptions{TTL: time.Minute})
+
+	cache.Get(1)
+	clock.Advance(time.Hour)
+	source.fail = errors.New("down")
+	if ratings, err := cache.Get(1); err != nil || len(ratings) != 1 {
+		t.Errorf("Get(1) while down = %v, %v, want the expired ratings", ratings, err)
+	}
+	if _, err := cache.Get(2); err == nil {
+		t.Error("Get(2) while down didn't fail")
+	}
+}
+
+func TestRatingCacheCoalesce(t *testing.T) {
+	source := newTestRatingSource()
+	source.release = make(chan struct{})
+	cache, _ := newTestRatingCache(source, RatingCacheOptions{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ratings, err := cache.Get(1); err != nil || len(ratings) != 1 {
+				t.Errorf("Get(1) = %v, %v", ratings, err)
+			}
+		}()
+	}
+	// Let everyone pile up on the lookup before it finishes
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.options.Metrics.CacheMisses.Sum() < 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(source.release)
+	wg.Wait()
+	if got := source.count(1); got != 1 {
+		t.Errorf("looked up %d times, want 1", got)
+	}
+}
+
+func TestRatingCacheRateLimit(t *testing.T) {
+	source := newTestRatingSource()
+	// One lookup an hour is always longer to wait than ratingLookupTimeout
+	cache, _ := newTestRatingCache(source, RatingCacheOptions{Rate: 1.0 / 3600, Burst: 2})
+
+	for userID := uint64(1); userID <= 2; userID++ {
+		if _, err := cache.Get(userID); err != nil {
+			t.Errorf("Get(%d) = %v", userID, err)
+		}
+	}
+	if _, err := cache.Get(3); !errors.Is(err, ErrRatingRateLimited) {
+		t.Errorf("Get(3) = %v, want ErrRatingRateLimited", err)
+	}
+	if got := source.count(3); got != 0 {
+		t.Errorf("looked up %d times while rate limited", got)
+	}
+	// Cached players don't count against the limit
+	if _, err := cache.Get(1); err != nil {
+		t.Errorf("cached Get(1) = %v", err)
+	}
+}
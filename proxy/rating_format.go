@@ -0,0 +1,96 @@
+package proxy
+
+// How ratings are shown in place of character levels. Levels are plain numbers, so any uncertainty has to be encoded in the number.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// RatingFormatter returns the number shown in place of a character level
+type RatingFormatter func(rating Rating) int
+
+// Display modes for -rating-display
+const (
+	RatingDisplayRating      = "rating"      // Rating as is. 1523.
+	RatingDisplayBucket      = "bucket"      // Rating rounded to the nearest bucket. 1500.
+	RatingDisplayProvisional = "provisional" // Rating as is, with a leading 1 if the deviation is too high to trust. 11523.
+	RatingDisplayDeviation   = "deviation"   // Rating followed by 3 digits of deviation. 1523085 is 1523 ±85.
+)
+
+const (
+	DefaultRatingBucket               = 100
+	DefaultRatingProvisionalDeviation = 75.0
+)
+
+// FormatRating shows the rating as is
+func FormatRating(rating Rating) int {
+	return int(math.Round(rating.Value))
+}
+
+// BucketRatingFormatter rounds ratings to the nearest multiple of bucket
+func BucketRatingFormatter(bucket int) RatingFormatter {
+	return func(rating Rating) int {
+		return int(math.Round(rating.Value/float64(bucket))) * bucket
+	}
+}
+
+// ProvisionalRatingFormatter adds 10000 to ratings with a deviation over maxDeviation, so they show up as 5 digits starting with 1.
+// Ratings are kept within 0-9999 so a trusted rating never looks provisional and a provisional one never gets a 6th digit.
+func ProvisionalRatingFormatter(maxDeviation float64) RatingFormatter {
+	return func(rating Rating) int {
+		value := FormatRating(rating)
+		if value < 0 {
+			value = 0
+		} else if value > 9999 {
+			value = 9999
+		}
+		if rating.Deviation > maxDeviation {
+			return 10000 + value
+		}
+		return value
+	}
+}
+
+// FormatRatingDeviation shows the rating followed by the deviation as 3 digits, capped at 999
+func FormatRatingDeviation(rating Rating) int {
+	deviation := int(math.Round(rating.Deviation))
+	if deviation > 999 {
+		deviation = 999
+	}
+	return FormatRating(rating)*1000 + deviation
+}
+
+// NewRatingFormatter creates the formatter for the -rating-display options
+func (o *StriveAPIProxyOptions) NewRatingFormatter() (RatingFormatter, error) {
+	bucket := o.RatingBucket
+	if bucket <= 0 {
+		bucket = DefaultRatingBucket
+	}
+	maxDeviation := o.RatingProvisionalDeviation
+	if maxDeviation <= 0 {
+		maxDeviation = DefaultRatingProvisionalDeviation
+	}
+
+	formatters := map[string]RatingFormatter{
+		RatingDisplayRating:      FormatRating,
+		RatingDisplayBucket:      BucketRatingFormatter(bucket),
+		RatingDisplayProvisional: ProvisionalRatingFormatter(maxDeviation),
+		RatingDisplayDeviation:   FormatRatingDeviation,
+	}
+	if o.RatingDisplay == "" {
+		return FormatRating, nil
+	}
+	formatter, ok := formatters[o.RatingDisplay]
+	if !ok {
+		modes := make([]string, 0, len(formatters))
+		for mode := range formatters {
+			modes = append(modes, mode)
+		}
+		sort.Strings(modes)
+		return nil, fmt.Errorf("invalid rating display %q: must be one of %s", o.RatingDisplay, strings.Join(modes, ", "))
+	}
+	return formatter, nil
+}
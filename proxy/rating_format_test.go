@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRatingFormatters(t *testing.T) {
+	bucket := BucketRatingFormatter(100)
+	provisional := ProvisionalRatingFormatter(75)
+	tests := []struct {
+		name      string
+		formatter RatingFormatter
+		rating    Rating
+		want      int
+	}{
+		{"rating rounds", FormatRating, Rating{Value: 1523.5}, 1524},
+		{"bucket below midpoint", bucket, Rating{Value: 1549.9}, 1500},
+		{"bucket at midpoint", bucket, Rating{Value: 1550}, 1600},
+		{"bucket above midpoint", bucket, Rating{Value: 1550.1}, 1600},
+		{"bucket exact", bucket, Rating{Value: 1500}, 1500},
+		{"bucket below first", bucket, Rating{Value: 49.9}, 0},
+		{"bucket of 25", BucketRatingFormatter(25), Rating{Value: 1512.5}, 1525},
+		{"provisional under threshold", provisional, Rating{Value: 1523, Deviation: 74.9}, 1523},
+		{"provisional at threshold", provisional, Rating{Value: 1523, Deviation: 75}, 1523},
+		{"provisional over threshold", provisional, Rating{Value: 1523, Deviation: 75.1}, 11523},
+		{"provisional rounds", provisional, Rating{Value: 1523.5, Deviation: 200}, 11524},
+		{"provisional 4 digits", provisional, Rating{Value: 9999.4, Deviation: 200}, 19999},
+		{"provisional 5 digits", provisional, Rating{Value: 10250, Deviation: 200}, 19999},
+		{"trusted 5 digits", provisional, Rating{Value: 10250, Deviation: 50}, 9999},
+		{"trusted rounds up to 5 digits", provisional, Rating{Value: 9999.5, Deviation: 50}, 9999},
+		{"provisional negative", provisional, Rating{Value: -20, Deviation: 200}, 10000},
+		{"trusted negative", provisional, Rating{Value: -20, Deviation: 50}, 0},
+		{"deviation", FormatRatingDeviation, Rating{Value: 1523, Deviation: 85.4}, 1523085},
+		{"deviation capped", FormatRatingDeviation, Rating{Value: 1523, Deviation: 1200}, 1523999},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.formatter(tt.rating); got != tt.want {
+				t.Errorf("%+v = %d, want %d", tt.rating, got, tt.want)
+			}
+		})
+	}
+}
+
+// Provisional ratings are always 5 digits starting with 1, and trusted ones never are
+func TestProvisionalRatingDigits(t *testing.T) {
+	provisional := ProvisionalRatingFormatter(75)
+	for value := -1000.0; value <= 30000; value += 0.5 {
+		if got := provisional(Rating{Value: value, Deviation: 200}); got < 10000 || got > 19999 {
+			t.Fatalf("provisional %v = %d", value, got)
+		}
+		if got := provisional(Rating{Value: value, Deviation: 50}); got < 0 || got > 9999 {
+			t.Fatalf("trusted %v = %d", value, got)
+		}
+	}
+}
+
+func TestNewRatingFormatter(t *testing.T) {
+	tests := []struct {
+		options StriveAPIProxyOptions
+		want    int
+	}{
+		{StriveAPIProxyOptions{}, 1523},
+		{StriveAPIProxyOptions{RatingDisplay: RatingDisplayRating}, 1523},
+		{StriveAPIProxyOptions{RatingDisplay: RatingDisplayBucket}, 1500},
+		{StriveAPIProxyOptions{RatingDisplay: RatingDisplayBucket, RatingBucket: 50}, 1500},
+		{StriveAPIProxyOptions{RatingDisplay: RatingDisplayProvisional}, 11523},
+		{StriveAPIProxyOptions{RatingDisplay: RatingDisplayProvisional, RatingProvisionalDeviation: 100}, 1523},
+		{StriveAPIProxyOptions{RatingDisplay: RatingDisplayDeviation}, 1523080},
+	}
+	for _, tt := range tests {
+		formatter, err := tt.options.NewRatingFormatter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatter(Rating{Value: 1523, Deviation: 80}); got != tt.want {
+			t.Errorf("%q = %d, want %d", tt.options.RatingDisplay, got, tt.want)
+		}
+	}
+
+	options := StriveAPIProxyOptions{RatingDisplay: "stars"}
+	if _, err := options.NewRatingFormatter(); err == nil || !strings.Contains(err.Error(), "bucket, deviation, provisional, rating") {
+		t.Errorf("invalid display = %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+// Where -rating-update gets ratings from. ratingupdate.info by default, but anything that speaks its format works.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RatingProvider looks up players' ratings
+type RatingProvider interface {
+	// FetchRatings returns a player's ratings indexed by Characters(). ErrPlayerNotFound if the player isn't known.
+	FetchRatings(ctx context.Context, userID uint64) (Ratings, error)
+	// Characters maps character codes to indexes in Ratings
+	Characters() CharacterTable
+}
+
+// DefaultRatingSource is ratingupdate.info
+const DefaultRatingSource = "ratingupdate.info"
+
+const ratingUpdateURL = "http://ratingupdate.info/api/player_rating/{hex}"
+
+// HTTPRatingProvider gets ratings in the ratingupdate.info format from URL.
+// {id} in URL is replaced with the 18 digit user ID and {hex} with the user ID as 16 hex digits.
+type HTTPRatingProvider struct {
+	URL        string
+	client     http.Client
+	characters CharacterTable
+}
+
+func NewHTTPRatingProvider(url string, characters CharacterTable) *HTTPRatingProvider {
+	return &HTTPRatingProvider{
+		URL:        url,
+		characters: characters,
+		client: http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:    1,
+				MaxConnsPerHost: 2,
+				IdleConnTimeout: 30 * time.Second,
+			},
+		},
+	}
+}
+
+func (p *HTTPRatingProvider) Characters() CharacterTable {
+	return p.characters
+}
+
+func (p *HTTPRatingProvider) FetchRatings(ctx context.Context, userID uint64) (Ratings, error) {
+	url := strings.NewReplacer("{id}", strconv.FormatUint(userID, 10), "{hex}", convertUser(userID)).Replace(p.URL)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrPlayerNotFound
+	}
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("HTTP error: %s. URL: %s", resp.Status, url)
+	}
+	d := json.NewDecoder(resp.Body)
+
+	ratings := &Ratings{}
+	err = d.Decode(ratings)
+	if err != nil {
+		return nil, err
+	}
+
+	return (*ratings), nil
+}
+
+// FileRatingProvider gets ratings from a JSON file of 18 digit user IDs to ratings in the ratingupdate.info format, e.g.
+// {"210611081234567890": [{"value": 1500, "deviation": 80}, ...]}. The file is read again whenever it changes.
+type FileRatingProvider struct {
+	path       string
+	characters CharacterTable
+	lock       sync.Mutex
+	modTime    time.Time
+	ratings    map[string]Ratings
+}
+
+// NewFileRatingProvider reads ratings from path
+func NewFileRatingProvider(path string, characters CharacterTable) (*FileRatingProvider, error) {
+	p := &FileRatingProvider{path: path, characters: characters}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	err := p.reload()
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Must hold lock
+func (p *FileRatingProvider) reload() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return fmt.Errorf("could not read ratings: %w", err)
+	}
+	if info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	buf, err := os.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("could not read ratings: %w", err)
+	}
+	ratings := make(map[string]Ratings)
+	err = json.Unmarshal(buf, &ratings)
+	if err != nil {
+		return fmt.Errorf("could not read ratings %s: %w", p.path, err)
+	}
+	p.ratings = ratings
+	p.modTime = info.ModTime()
+	return nil
+}
+
+func (p *FileRatingProvider) Characters() CharacterTable {
+	return p.characters
+}
+
+func (p *FileRatingProvider) FetchRatings(ctx context.Context, userID uint64) (Ratings, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	err := p.reload()
+	if err != nil {
+		return nil, err
+	}
+	ratings, ok := p.ratings[strconv.FormatUint(userID, 10)]
+	if !ok {
+		return nil, ErrPlayerNotFound
+	}
+	return ratings, nil
+}
+
+// NewRatingProvider creates the provider for the -rating-source option. One of:
+//   - ratingupdate.info
+//   - local, see RatingTracker
+//   - file:<path>, see FileRatingProvider
+//   - An http:// or https:// URL, see HTTPRatingProvider
+func (o *StriveAPIProxyOptions) NewRatingProvider() (RatingProvider, error) {
+	characters := o.Characters
+	if characters == nil {
+		var err error
+		characters, err = o.LoadCharacterTable()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	source := o.RatingSource
+	switch {
+	case source == "" || source == DefaultRatingSource:
+		return NewHTTPRatingProvider(ratingUpdateURL, characters), nil
+	case source == LocalRatingSource:
+		return o.newRatingTracker(characters)
+	case strings.HasPrefix(source, "file:"):
+		return NewFileRatingProvider(strings.TrimPrefix(source, "file:"), characters)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		if !strings.Contains(source, "{id}") && !strings.Contains(source, "{hex}") {
+			return nil, fmt.Errorf("invalid rating source %q: URL must contain {id} or {hex}", source)
+		}
+		return NewHTTPRatingProvider(source, characters), nil
+	}
+	return nil, fmt.Errorf("invalid rating source %q: must be %s, %s, file:<path> or a URL", source, DefaultRatingSource, LocalRatingSource)
+}
+
+func convertUser(userID uint64) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, userID)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 210611081234567890 as 16 hex digits
+const testUserHex = "02EC3DA99ABF52D2"
+
+func TestHTTPRatingProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/id/210611081234567890", "/hex/" + testUserHex:
+			w.Write([]byte(`[{"value": 1500.5, "deviation": 80}, {"value": 1200, "deviation": 150}]`))
+		case "/id/210611080000000001":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/id/210611080000000002":
+			w.Write([]byte(`{"not": "ratings"`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name    string
+		url     string
+		userID  uint64
+		want    Ratings
+		wantErr error // Any error if errAny
+		errAny  bool
+	}{
+		{name: "id", url: server.URL + "/id/{id}", userID: 210611081234567890, want: Ratings{{1500.5, 80, false}, {1200, 150, false}}},
+		{name: "hex", url: server.URL + "/hex/{hex}", userID: 210611081234567890, want: Ratings{{1500.5, 80, false}, {1200, 150, false}}},
+		{name: "not found", url: server.URL + "/id/{id}", userID: 210611089876543210, wantErr: ErrPlayerNotFound},
+		{name: "server error", url: server.URL + "/id/{id}", userID: 210611080000000001, errAny: true},
+		{name: "bad json", url: server.URL + "/id/{id}", userID: 210611080000000002, errAny: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewHTTPRatingProvider(tt.url, DefaultCharacterTable()).FetchRatings(context.Background(), tt.userID)
+			switch {
+			case tt.errAny:
+				if err == nil || errors.Is(err, ErrPlayerNotFound) {
+					t.Errorf("FetchRatings() = %v, %v, want an error", got, err)
+				}
+				return
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("FetchRatings() = %v, want %v", err, tt.wantErr)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("FetchRatings() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("FetchRatings() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFileRatingProviderReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	write := func(content string, modTime time.Time) {
+		err := os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Some filesystems only keep mod times to the second
+		err = os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write(`{"210611081234567890": [{"value": 1500, "deviation": 80}]}`, start)
+
+	provider, err := NewFileRatingProvider(path, DefaultCharacterTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratings, err := provider.FetchRatings(context.Background(), 210611081234567890)
+	if err != nil || len(ratings) != 1 || ratings[0].Value != 1500 {
+		t.Fatalf("FetchRatings() = %v, %v", ratings, err)
+	}
+	if _, err := provider.FetchRatings(context.Background(), 210611089876543210); !errors.Is(err, ErrPlayerNotFound) {
+		t.Errorf("unknown player = %v, want ErrPlayerNotFound", err)
+	}
+
+	write(`{"210611081234567890": [{"value": 1600, "deviation": 70}], "210611089876543210": [{"value": 1400, "deviation": 90}]}`, start.Add(time.Minute))
+	ratings, err = provider.FetchRatings(context.Background(), 210611081234567890)
+	if err != nil || len(ratings) != 1 || ratings[0].Value != 1600 {
+		t.Errorf("FetchRatings() after change = %v, %v, want 1600", ratings, err)
+	}
+	if _, err := provider.FetchRatings(context.Background(), 210611089876543210); err != nil {
+		t.Errorf("new player = %v", err)
+	}
+
+	// A broken file is an error, not an empty table
+	write(`{"210611081234567890": [`, start.Add(2*time.Minute))
+	if _, err := provider.FetchRatings(context.Background(), 210611081234567890); err == nil || errors.Is(err, ErrPlayerNotFound) {
+		t.Errorf("FetchRatings() from a broken file = %v, want an error", err)
+	}
+}
+
+func TestNewRatingProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	err := os.WriteFile(path, []byte(`{}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		source string
+		want   string // Type of the provider, or the start of the error
+	}{
+		{"", "*proxy.HTTPRatingProvider"},
+		{DefaultRatingSource, "*proxy.HTTPRatingProvider"},
+		{"file:" + path, "*proxy.FileRatingProvider"},
+		{"https://example.com/ratings/{hex}", "*proxy.HTTPRatingProvider"},
+		{"http://example.com/ratings/{id}", "*proxy.HTTPRatingProvider"},
+		{"file:" + path + ".missing", "could not read ratings"},
+		{"https://example.com/ratings", "invalid rating source"},
+		{"ftp://example.com/{id}", "invalid rating source"},
+		{"ratingupdate", "invalid rating source"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			options := StriveAPIProxyOptions{RatingSource: tt.source, Characters: DefaultCharacterTable()}
+			provider, err := options.NewRatingProvider()
+			var got string
+			if err != nil {
+				got = err.Error()
+			} else {
+				got = fmt.Sprintf("%T", provider)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("NewRatingProvider() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
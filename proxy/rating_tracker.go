@@ -0,0 +1,497 @@
+package proxy
+
+// Rates players from the replays GGST looks at and the results GGST uploads, so -rating-update keeps working without
+// ratingupdate.info.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+// LocalRatingSource is the -rating-source for ratings computed by a RatingTracker
+const LocalRatingSource = "local"
+
+// Match results in statistics/set uploads. The battle record GGST uploads after a match has running totals, so a finished
+// match shows up as one more battle. tus/write data isn't decoded, so it isn't used.
+// The key names haven't been checked against a real upload yet. If they're wrong nothing is rated from uploads, and
+// the keys that are there are logged at debug level.
+const (
+	battleRecordBattles   = "TotalBattle"
+	battleRecordWins      = "TotalWin"
+	uploadOpponentTimeout = 30 * time.Minute // Someone whose R-Code was loaded this recently is taken as the opponent
+	uploadReplayWindow    = 10 * time.Minute // A replay this close to a result from an upload is the same match
+	uploadedResultMaxAge  = 24 * time.Hour   // Replays of results from uploads are looked for this long
+)
+
+const (
+	maxRatedReplays = 100000           // Oldest rated replays are forgotten past this, see trackedRatings.ReplaysBefore
+	ratingSaveDelay = 10 * time.Second // Changes are saved this long after the first one, so a burst is one write
+)
+
+// Ratings of one player by character index
+type trackedPlayer struct {
+	Name          string                `json:"name"`
+	Characters    map[int]*GlickoRating `json:"characters"`
+	Updated       time.Time             `json:"updated"`
+	LastCharacter int                   `json:"last_character"` // Character in their newest replay. Results from uploads are rated for it.
+	LastPlayed    time.Time             `json:"last_played"`
+}
+
+// Battle record totals a player last uploaded
+type battleRecord struct {
+	Battles int `json:"battles"`
+	Wins    int `json:"wins"`
+}
+
+// A result rated from an upload. That player's side of the same match isn't rated again when its replay is seen.
+type uploadedResult struct {
+	UserID     string    `json:"user_id"`
+	OpponentID string    `json:"opponent_id,omitempty"` // Empty if the opponent wasn't known
+	Time       time.Time `json:"time"`
+}
+
+// Replay IDs already rated, with when they were played
+type ratedReplays map[uint64]time.Time
+
+// Files from before replay times were kept have true instead, which are forgotten first
+func (r *ratedReplays) UnmarshalJSON(data []byte) error {
+	var replays map[uint64]json.RawMessage
+	err := json.Unmarshal(data, &replays)
+	if err != nil {
+		return err
+	}
+	*r = make(ratedReplays, len(replays))
+	for id, raw := range replays {
+		var played time.Time
+		if string(raw) != "true" {
+			err = json.Unmarshal(raw, &played)
+			if err != nil {
+				return err
+			}
+		}
+		(*r)[id] = played
+	}
+	return nil
+}
+
+// What's saved to disk
+type trackedRatings struct {
+	Players       map[string]*trackedPlayer `json:"players"`            // By 18 digit User ID
+	Replays       ratedReplays              `json:"replays"`            // Replays already rated
+	ReplaysBefore time.Time                 `json:"replays_before"`     // Replays played before this were forgotten from Replays, so aren't rated
+	Records       map[string]*battleRecord  `json:"records,omitempty"`  // Last uploaded battle record by User ID
+	Uploaded      []uploadedResult          `json:"uploaded,omitempty"` // Results from uploads whose replay hasn't been seen
+}
+
+// RatingTracker computes a Glicko-2 rating per player and character from replays. It's a RatingProvider.
+// Safe for concurrent use.
+type RatingTracker struct {
+	lock         sync.Mutex
+	path         string
+	ratings      trackedRatings
+	opponent     string      // Other player whose R-Code was loaded last
+	opponentTime time.Time   // When
+	saveTimer    *time.Timer // Pending save. nil if everything is saved.
+	maxReplays   int
+	characters   CharacterTable
+	logger       *slog.Logger
+}
+
+// NewRatingTracker loads ratings from path, if it exists, and saves them there shortly after every update. Close saves
+// anything that's still pending.
+func NewRatingTracker(path string, characters CharacterTable, logger *slog.Logger) (*RatingTracker, error) {
+	t := &RatingTracker{
+		path: path,
+		ratings: trackedRatings{
+			Players: make(map[string]*trackedPlayer),
+			Replays: make(ratedReplays),
+			Records: make(map[string]*battleRecord),
+		},
+		maxReplays: maxRatedReplays,
+		characters: characters,
+		logger:     logger,
+	}
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(buf, &t.ratings)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read local ratings: %w", err)
+	}
+	if t.ratings.Players == nil {
+		t.ratings.Players = make(map[string]*trackedPlayer)
+	}
+	if t.ratings.Replays == nil {
+		t.ratings.Replays = make(ratedReplays)
+	}
+	if t.ratings.Records == nil {
+		t.ratings.Records = make(map[string]*battleRecord)
+	}
+	return t, nil
+}
+
+// Default local ratings file is next to the exe
+func DefaultRatingTrackerFile() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exePath), "ratings.json"), nil
+}
+
+// NewRatingTracker creates the tracker for -track-ratings
+func (o *StriveAPIProxyOptions) NewRatingTracker() (*RatingTracker, error) {
+	characters := o.Characters
+	if characters == nil {
+		var err error
+		characters, err = o.LoadCharacterTable()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return o.newRatingTracker(characters)
+}
+
+func (o *StriveAPIProxyOptions) newRatingTracker(characters CharacterTable) (*RatingTracker, error) {
+	path := o.LocalRatingsFile
+	if path == "" {
+		var err error
+		path, err = DefaultRatingTrackerFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	logger := o.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return NewRatingTracker(path, characters, logger.With("subsystem", "rating_tracker"))
+}
+
+// Must hold lock
+func (t *RatingTracker) rating(player ggst.ReplayPlayer, character int) *GlickoRating {
+	p, ok := t.ratings.Players[player.UserID]
+	if !ok {
+		p = &trackedPlayer{Characters: make(map[int]*GlickoRating)}
+		t.ratings.Players[player.UserID] = p
+	}
+	if player.Name != "" {
+		p.Name = player.Name
+	}
+	r, ok := p.Characters[character]
+	if !ok {
+		rating := NewGlickoRating()
+		r = &rating
+		p.Characters[character] = r
+	}
+	return r
+}
+
+// AddReplays rates the replays that haven't been rated yet. Returns how many were new.
+func (t *RatingTracker) AddReplays(replays []ggst.Replay) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	added := 0
+	for _, replay := range replays {
+		if _, ok := t.ratings.Replays[replay.ID]; ok || replay.Players[0].UserID == replay.Players[1].UserID ||
+			replay.Time.Before(t.ratings.ReplaysBefore) {
+			continue
+		}
+		t.ratings.Replays[replay.ID] = replay.Time
+		added++
+
+		r1 := t.rating(replay.Players[0], replay.Characters[0])
+		r2 := t.rating(replay.Players[1], replay.Characters[1])
+		score := 0.0
+		if replay.Winner == 1 {
+			score = 1
+		}
+		new1, new2 := r1.Update(*r2, score), r2.Update(*r1, 1-score)
+
+		now := time.Now()
+		for i, r := range []*GlickoRating{r1, r2} {
+			player := replay.Players[i]
+			p := t.ratings.Players[player.UserID]
+			if !t.takeUploadedResult(player.UserID, replay.Players[1-i].UserID, replay.Time) {
+				*r = []GlickoRating{new1, new2}[i]
+				p.Updated = now
+			}
+			if !replay.Time.Before(p.LastPlayed) {
+				p.LastCharacter = replay.Characters[i]
+				p.LastPlayed = replay.Time
+			}
+		}
+	}
+	if added > 0 {
+		t.pruneReplays()
+		t.saveSoon()
+	}
+	return added
+}
+
+// Whether userID's result in a replay against opponentID at time was already rated from an upload. Forgets the result if so.
+// Must hold lock
+func (t *RatingTracker) takeUploadedResult(userID string, opponentID string, at time.Time) bool {
+	for i, result := range t.ratings.Uploaded {
+		if result.UserID != userID || (result.OpponentID != "" && result.OpponentID != opponentID) {
+			continue
+		}
+		if d := result.Time.Sub(at); d > -uploadReplayWindow && d < uploadReplayWindow {
+			t.ratings.Uploaded = append(t.ratings.Uploaded[:i:i], t.ratings.Uploaded[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SetOpponent remembers the other player whose R-Code was just loaded. Results uploaded soon after are against them.
+func (t *RatingTracker) SetOpponent(userID string, at time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.opponent = userID
+	t.opponentTime = at
+}
+
+// AddBattleRecord rates the match userID just finished, if their uploaded battle record totals show exactly one new
+// match since the last upload. It's rated for the character in their newest replay, against the last opponent from
+// SetOpponent. Returns whether a match was rated.
+func (t *RatingTracker) AddBattleRecord(userID string, battles int, wins int, at time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	last := t.ratings.Records[userID]
+	t.ratings.Records[userID] = &battleRecord{Battles: battles, Wins: wins}
+	if last == nil || *last != *t.ratings.Records[userID] {
+		t.saveSoon()
+	}
+	if last == nil || battles != last.Battles+1 {
+		return false
+	}
+	p, ok := t.ratings.Players[userID]
+	if !ok {
+		t.logger.Debug("Not rating uploaded result, no replays to tell the character from", "user", userID)
+		return false
+	}
+	r, ok := p.Characters[p.LastCharacter]
+	if !ok {
+		return false
+	}
+
+	result := uploadedResult{UserID: userID, Time: at}
+	opponent := NewGlickoRating()
+	if t.opponent != "" && t.opponent != userID && at.Sub(t.opponentTime) < uploadOpponentTimeout {
+		result.OpponentID = t.opponent
+		if o, ok := t.ratings.Players[t.opponent]; ok {
+			opponent = o.bestKnown()
+		}
+	}
+	score := 0.0
+	if wins == last.Wins+1 {
+		score = 1
+	}
+	*r = r.Update(opponent, score)
+	p.Updated = at
+	t.ratings.Uploaded = append(t.ratings.Uploaded, result)
+	return true
+}
+
+// The rating of the player's character with the lowest deviation, since the character they played isn't known
+func (p *trackedPlayer) bestKnown() GlickoRating {
+	best := NewGlickoRating()
+	for _, r := range p.Characters {
+		if r.Deviation < best.Deviation {
+			best = *r
+		}
+	}
+	return best
+}
+
+// Forgets the oldest rated replays past maxRatedReplays. Replays played before the newest one forgotten aren't rated
+// any more, so none are rated twice.
+// Must hold lock
+func (t *RatingTracker) pruneReplays() {
+	extra := len(t.ratings.Replays) - t.maxReplays
+	if extra <= 0 {
+		return
+	}
+	ids := make([]uint64, 0, len(t.ratings.Replays))
+	for id := range t.ratings.Replays {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return t.ratings.Replays[ids[i]].Before(t.ratings.Replays[ids[j]]) })
+	for _, id := range ids[:extra] {
+		if played := t.ratings.Replays[id]; played.After(t.ratings.ReplaysBefore) {
+			t.ratings.ReplaysBefore = played
+		}
+		delete(t.ratings.Replays, id)
+	}
+}
+
+// Must hold lock
+func (t *RatingTracker) saveSoon() {
+	if t.saveTimer != nil {
+		return
+	}
+	t.saveTimer = time.AfterFunc(ratingSaveDelay, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		t.saveNow()
+	})
+}
+
+// Must hold lock
+func (t *RatingTracker) saveNow() {
+	if t.saveTimer == nil {
+		return // Already saved by Close
+	}
+	t.saveTimer.Stop()
+	t.saveTimer = nil
+	err := t.save()
+	if err != nil {
+		t.logger.Error("Could not save local ratings", "err", err)
+	}
+}
+
+// Close saves any changes that haven't been saved yet
+func (t *RatingTracker) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.saveNow()
+}
+
+// Must hold lock
+func (t *RatingTracker) save() error {
+	// Replays of old results from uploads aren't going to show up any more
+	kept := t.ratings.Uploaded[:0]
+	for _, result := range t.ratings.Uploaded {
+		if time.Since(result.Time) < uploadedResultMaxAge {
+			kept = append(kept, result)
+		}
+	}
+	t.ratings.Uploaded = kept
+
+	buf, err := json.Marshal(&t.ratings)
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	err = os.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path) // Never leave a half written file behind
+}
+
+func (t *RatingTracker) Characters() CharacterTable {
+	return t.characters
+}
+
+// FetchRatings returns the player's ratings. Characters they haven't been seen playing are Unrated.
+func (t *RatingTracker) FetchRatings(ctx context.Context, userID uint64) (Ratings, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p, ok := t.ratings.Players[strconv.FormatUint(userID, 10)]
+	if !ok {
+		return nil, ErrPlayerNotFound
+	}
+	size := 0
+	for _, index := range t.characters {
+		if index >= size {
+			size = index + 1
+		}
+	}
+	ratings := make(Ratings, size)
+	for i := range ratings {
+		if r, ok := p.Characters[i]; ok {
+			ratings[i] = Rating{Value: r.Rating, Deviation: r.Deviation}
+		} else {
+			ratings[i] = Rating{Unrated: true}
+		}
+	}
+	return ratings, nil
+}
+
+// TrackHandler rates the replays in catalog/get_replay responses and the results in statistics/set uploads, and
+// remembers whose R-Code was loaded last for the uploads. Needs ClassifyHandler.
+func (t *RatingTracker) TrackHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := classifiedRequest(r)
+		if c == nil || (c.Kind != ggst.GetReplay && c.Kind != ggst.StatGet && c.Kind != ggst.StatSet) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := &CachingResponseWriter{w: w, code: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		if rw.code != http.StatusOK {
+			return
+		}
+
+		switch c.Kind {
+		case ggst.GetReplay:
+			replays, err := ggst.ParseReplays(rw.buf.Bytes())
+			if err != nil {
+				t.logger.Debug("Could not read replays", "err", err)
+				return
+			}
+			if added := t.AddReplays(replays); added > 0 {
+				t.logger.Info("Rated replays", "count", added)
+			}
+		case ggst.StatGet:
+			if p, ok := c.StatGet(); ok && p.OtherUserID != "" && ggst.StatGetType(p.Type) == ggst.StatGetLevels {
+				t.SetOpponent(p.OtherUserID, time.Now())
+			}
+		case ggst.StatSet:
+			p, ok := c.Payload.(*ggst.StatSetReqPayload)
+			if !ok {
+				return
+			}
+			for _, item := range p.Items {
+				if ggst.StatGetType(item.Type) != ggst.StatGetBattleRecord {
+					continue
+				}
+				battles, ok1 := rawJSONInt(&item.JSON, battleRecordBattles)
+				wins, ok2 := rawJSONInt(&item.JSON, battleRecordWins)
+				if !ok1 || !ok2 {
+					// The key names are a guess, so say what's actually there
+					t.logger.Debug("Battle record upload without totals, not rating it", "keys", item.JSON.Keys())
+					continue
+				}
+				if t.AddBattleRecord(c.Header.UserID, battles, wins, time.Now()) {
+					t.logger.Info("Rated uploaded result")
+				}
+			}
+		}
+	})
+}
+
+// Integer value of key
+func rawJSONInt(j *ggst.RawJSON, key string) (int, bool) {
+	v, ok := j.Get(key)
+	if !ok {
+		return 0, false
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return int(i), err == nil
+}
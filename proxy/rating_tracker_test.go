@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+func newTestRatingTracker(t *testing.T, path string) *RatingTracker {
+	t.Helper()
+	tracker, err := NewRatingTracker(path, DefaultCharacterTable(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tracker.Close)
+	return tracker
+}
+
+func testFetchRatings(t *testing.T, tracker *RatingTracker, player ggst.ReplayPlayer) Ratings {
+	t.Helper()
+	id, _ := strconv.ParseUint(player.UserID, 10, 64)
+	ratings, err := tracker.FetchRatings(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ratings
+}
+
+func TestRatingTrackerReplays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	tracker := newTestRatingTracker(t, path)
+	replays := []ggst.Replay{
+		testReplay(1, testSelf, 0, testOpponent, 1, 1),
+		testReplay(2, testSelf, 0, testOpponent, 1, 1),
+	}
+	if added := tracker.AddReplays(replays); added != 2 {
+		t.Errorf("rated %d replays, want 2", added)
+	}
+	if added := tracker.AddReplays(replays); added != 0 {
+		t.Errorf("rated %d replays again", added)
+	}
+
+	// Only characters seen played are rated
+	tracker.Close()
+	ratings := testFetchRatings(t, newTestRatingTracker(t, path), testSelf)
+	if ratings[0].Unrated || ratings[0].Value <= glickoDefaultRating {
+		t.Errorf("SOL = %+v, want rated above %v after 2 wins", ratings[0], glickoDefaultRating)
+	}
+	for i := 1; i < len(ratings); i++ {
+		if !ratings[i].Unrated {
+			t.Errorf("character %d = %+v, want unrated", i, ratings[i])
+		}
+	}
+	if ratings := testFetchRatings(t, tracker, testOpponent); ratings[1].Unrated || ratings[1].Value >= glickoDefaultRating {
+		t.Errorf("opponent KYK = %+v, want rated below %v after 2 losses", ratings[1], glickoDefaultRating)
+	}
+
+	id, _ := strconv.ParseUint(testStranger.UserID, 10, 64)
+	if _, err := tracker.FetchRatings(context.Background(), id); err != ErrPlayerNotFound {
+		t.Errorf("unknown player: err = %v, want ErrPlayerNotFound", err)
+	}
+}
+
+// Results from battle record uploads are rated for the character in the newest replay, and not again when their replay is seen
+func TestRatingTrackerBattleRecord(t *testing.T) {
+	tracker := newTestRatingTracker(t, filepath.Join(t.TempDir(), "ratings.json"))
+	tracker.AddReplays([]ggst.Replay{
+		testReplay(1, testSelf, 0, testStranger, 1, 1), // Older, as SOL
+		testReplay(2, testSelf, 2, testStranger, 1, 1), // Newest, as MAY
+	})
+	before := testFetchRatings(t, tracker, testSelf)
+
+	now := time.Now()
+	if tracker.AddBattleRecord(testSelf.UserID, 40, 20, now) {
+		t.Error("first upload rated without a previous total")
+	}
+	tracker.SetOpponent(testOpponent.UserID, now.Add(-time.Minute))
+	if !tracker.AddBattleRecord(testSelf.UserID, 41, 21, now) {
+		t.Fatal("win not rated")
+	}
+	if tracker.AddBattleRecord(testSelf.UserID, 41, 21, now) {
+		t.Error("same totals rated again")
+	}
+	after := testFetchRatings(t, tracker, testSelf)
+	if after[2].Value <= before[2].Value || after[0] != before[0] {
+		t.Errorf("MAY %.2f -> %.2f, SOL %.2f -> %.2f, want only MAY up", before[2].Value, after[2].Value, before[0].Value, after[0].Value)
+	}
+
+	// The replay of the same match only rates the opponent
+	match := testReplay(3, testSelf, 2, testOpponent, 4, 1)
+	match.Time = now.Add(-2 * time.Minute)
+	tracker.AddReplays([]ggst.Replay{match})
+	if again := testFetchRatings(t, tracker, testSelf); again[2] != after[2] {
+		t.Errorf("MAY %.2f -> %.2f, want unchanged", after[2].Value, again[2].Value)
+	}
+	if opponent := testFetchRatings(t, tracker, testOpponent); opponent[4].Unrated {
+		t.Error("opponent not rated from the replay")
+	}
+}
+
+func TestRatingTrackerPruneReplays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	tracker := newTestRatingTracker(t, path)
+	tracker.maxReplays = 3
+	for id := uint64(1); id <= 5; id++ {
+		tracker.AddReplays([]ggst.Replay{testReplay(id, testSelf, 0, testOpponent, 1, 1)})
+	}
+	tracker.Close()
+
+	tracker = newTestRatingTracker(t, path)
+	if n := len(tracker.ratings.Replays); n != 3 {
+		t.Errorf("%d replays kept, want 3", n)
+	}
+	// Forgotten replays and older ones aren't rated again, newer ones are
+	before := testFetchRatings(t, tracker, testSelf)[0]
+	if added := tracker.AddReplays([]ggst.Replay{testReplay(1, testSelf, 0, testOpponent, 1, 1), testReplay(0, testSelf, 0, testOpponent, 1, 1)}); added != 0 {
+		t.Errorf("rated %d forgotten replays", added)
+	}
+	if testFetchRatings(t, tracker, testSelf)[0] != before {
+		t.Error("rating changed by a forgotten replay")
+	}
+	if added := tracker.AddReplays([]ggst.Replay{testReplay(6, testSelf, 0, testOpponent, 1, 1)}); added != 1 {
+		t.Errorf("rated %d new replays, want 1", added)
+	}
+}
+
+// Rated replays used to be saved without when they were played
+func TestRatingTrackerOldFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	err := os.WriteFile(path, []byte(`{"players": {}, "replays": {"1": true, "2": true}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := newTestRatingTracker(t, path)
+	if added := tracker.AddReplays([]ggst.Replay{testReplay(1, testSelf, 0, testOpponent, 1, 1), testReplay(3, testSelf, 0, testOpponent, 1, 1)}); added != 1 {
+		t.Errorf("rated %d replays, want only the new one", added)
+	}
+}
+
+// Changes are saved together after a delay, or on Close
+func TestRatingTrackerSaveDelay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ratings.json")
+	tracker := newTestRatingTracker(t, path)
+	tracker.AddBattleRecord(testSelf.UserID, 40, 20, time.Now())
+	tracker.AddBattleRecord(testOpponent.UserID, 10, 5, time.Now())
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("saved straight away: %v", err)
+	}
+	tracker.Close()
+	if records := newTestRatingTracker(t, path).ratings.Records; len(records) != 2 {
+		t.Errorf("saved records = %v, want 2", records)
+	}
+}
+
+// The battle record in an upload is read by TrackHandler. The statistics/set fixture isn't captured from a real upload,
+// so this only shows the keys are read the way the fixture has them, see battleRecordBattles.
+func TestRatingTrackerStatSetUpload(t *testing.T) {
+	text, err := os.ReadFile(filepath.Join("..", "ggst", "testdata", "statistics_set_request.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := newTestRatingTracker(t, filepath.Join(t.TempDir(), "ratings.json"))
+	tracker.AddReplays([]ggst.Replay{testReplay(1, testSelf, 0, testStranger, 1, 1)})
+	handler := ClassifyHandler(discardLogger())(tracker.TrackHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	handler.ServeHTTP(httptest.NewRecorder(), apiRequest("statistics/set", strings.TrimSpace(string(text))))
+
+	// The fixture has 41 battles and 20 wins
+	record := tracker.ratings.Records[testSelf.UserID]
+	if record == nil || *record != (battleRecord{Battles: 41, Wins: 20}) {
+		t.Fatalf("battle record = %+v, want 41 battles and 20 wins", record)
+	}
+	tracker.SetOpponent(testOpponent.UserID, time.Now())
+	if !tracker.AddBattleRecord(testSelf.UserID, 42, 20, time.Now()) {
+		t.Error("next match after the upload not rated")
+	}
+}
@@ -2,12 +2,9 @@ package proxy
 
 import (
 	"bytes"
-	"encoding/binary"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"math"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,57 +12,15 @@ import (
 	"time"
 
 	"github.com/optix2000/totsugeki/ggst"
-	"github.com/vmihailenco/msgpack/v5"
 )
 
-const ratingUpdateURL = "http://ratingupdate.info/api/player_rating/%s"
-
-// var characters = map[string]string{
-// 	// "SOL": "SO",
-// 	// "KYK": "KY",
-// 	// "MAY": "MA",
-// 	// "AXL": "AX",
-// 	// "CHP": "CH",
-// 	// "POT": "PO",
-// 	// "FAU": "FA",
-// 	"MLL": "MI",
-// 	"ZAT": "ZT",
-// 	// "RAM": "RA",
-// 	// "LEO": "LE",
-// 	// "NAG": "NA",
-// 	// "GIO": "GI",
-// 	// "ANJ": "AN",
-// 	// "INO": "IN",
-// 	"GLD": "GO",
-// 	"JKO": "JC",
-// }
-
-var characters = map[string]int{
-	"SOL": 0,
-	"KYK": 1,
-	"MAY": 2,
-	"AXL": 3,
-	"CHP": 4,
-	"POT": 5,
-	"FAU": 6,
-	"MLL": 7,
-	"ZAT": 8,
-	"RAM": 9,
-	"LEO": 10,
-	"NAG": 11,
-	"GIO": 12,
-	"ANJ": 13,
-	"INO": 14,
-	"GLD": 15,
-	"JKO": 16,
-	"COS": 17,
-	"BKN": 18,
-	"TST": 19,
-	"BGT": 20,
-}
-
 type RatingUpdate struct {
-	client http.Client
+	logger    *slog.Logger
+	metrics   *Metrics
+	formatter RatingFormatter
+	provider  RatingProvider
+	cache     *RatingCache
+	lookups   *recentList[RatingLookup] // For the dashboard
 }
 
 func (ru *RatingUpdate) RatingUpdateHandler(next http.Handler) http.Handler {
@@ -78,47 +33,47 @@ func (ru *RatingUpdate) RatingUpdateHandler(next http.Handler) http.Handler {
 	})
 }
 
-func NewRatingUpdate() *RatingUpdate {
+func NewRatingUpdate(logger *slog.Logger, metrics *Metrics, formatter RatingFormatter, provider RatingProvider, cacheOptions RatingCacheOptions) *RatingUpdate {
+	cacheOptions.Logger = logger
+	cacheOptions.Metrics = metrics
 	return &RatingUpdate{
-		client: http.Client{
-			Timeout: 10 * time.Second,
-			Transport: &http.Transport{
-				MaxIdleConns:    1,
-				MaxConnsPerHost: 2,
-				IdleConnTimeout: 30 * time.Second,
-			},
-		},
+		logger:    logger,
+		metrics:   metrics,
+		formatter: formatter,
+		provider:  provider,
+		cache:     NewRatingCache(provider.FetchRatings, cacheOptions),
+		lookups:   newRecentList[RatingLookup](dashboardRatingLookups),
 	}
 }
 
 func (ru *RatingUpdate) InjectRating(next http.Handler, w http.ResponseWriter, r *http.Request) {
-	reqBody := &bytes.Buffer{}
-	r.Body = io.NopCloser(io.TeeReader(r.Body, reqBody)) // Tee body so it can be read multiple times
-
-	parsedReq := &ggst.StatGetRequest{}
-	err := ggst.ParseReq(r, parsedReq)
-	r.Body = io.NopCloser(reqBody) // Reset request body for next handler
-	if err != nil ||
-		parsedReq.Payload.Type != 7 || // We only care about injecting ratings into character levels
-		parsedReq.Payload.OtherUserID == "" { // Abort if we are fetching our own rating. Injecting our own rating will break our R-Code.
-		if err != nil {
-			fmt.Println(err)
-		}
+	c := classifiedRequest(r)
+	if c == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	payload, ok := c.StatGet()
+	if !ok ||
+		ggst.StatGetType(payload.Type) != ggst.StatGetLevels || // We only care about injecting ratings into character levels
+		payload.OtherUserID == "" { // Abort if we are fetching our own rating. Injecting our own rating will break our R-Code.
 		next.ServeHTTP(w, r)
 		return
 	}
 
-	userID, err := strconv.ParseUint(parsedReq.Payload.OtherUserID, 10, 64)
+	userID, err := strconv.ParseUint(payload.OtherUserID, 10, 64)
 	if err != nil {
-		fmt.Println(err)
+		ru.logger.Warn("Invalid user ID", "user_id", payload.OtherUserID, "err", err)
 		next.ServeHTTP(w, r)
+		return
 	}
+	logger := ru.logger.With("user_id", payload.OtherUserID)
 
 	wg := sync.WaitGroup{}
 	var ratings Ratings
+	var fetchErr error
 	wg.Add(1)
 	go func() {
-		ratings, err = ru.FetchRatings(uint64(userID))
+		ratings, fetchErr = ru.cache.Get(userID)
 		wg.Done()
 	}()
 
@@ -130,12 +85,6 @@ func (ru *RatingUpdate) InjectRating(next http.Handler, w http.ResponseWriter, r
 
 	next.ServeHTTP(ww, r)
 
-	if err != nil {
-		fmt.Println(err)
-		w.Write(ww.Body.Bytes())
-		return
-	}
-
 	for k, v := range ww.Header() { // Copy headers across
 		if k == "Content-Length" {
 			continue
@@ -145,36 +94,54 @@ func (ru *RatingUpdate) InjectRating(next http.Handler, w http.ResponseWriter, r
 
 	parsedResp, err := ggst.UnmarshalStatResp(ww.Body.Bytes())
 	if err != nil {
-		fmt.Println(err)
+		logger.Warn("Could not parse response", "err", err)
 		w.Write(ww.Body.Bytes())
 		return
 	}
 
 	wg.Wait() // Wait for fetchRatings to finish
-	for k := range parsedResp.Payload.JSON {
-		if strings.HasSuffix(k, "Lv") {
+	lookup := RatingLookup{Time: time.Now(), UserID: payload.OtherUserID, Result: RatingLookupOK}
+	if v, ok := parsedResp.Payload.JSON.Get("NAME"); ok {
+		lookup.Name, _ = v.(string)
+	}
+	if errors.Is(fetchErr, ErrPlayerNotFound) {
+		lookup.Result = RatingLookupNotFound
+	} else if fetchErr != nil {
+		lookup.Result = RatingLookupFailed
+		lookup.Error = fetchErr.Error()
+	}
+	ru.lookups.Add(lookup)
 
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			idx := convertCharacter(k[0:3])
-			if idx == -1 {
-				fmt.Println("Unknown character:", k[0:3])
+	if errors.Is(fetchErr, ErrPlayerNotFound) {
+		logger.Debug("Player has no ratings")
+		w.Write(ww.Body.Bytes())
+		return
+	}
+	if fetchErr != nil {
+		ru.metrics.RatingFetchFailures.Inc()
+		logger.Error("Could not fetch ratings", "err", fetchErr)
+		w.Write(ww.Body.Bytes())
+		return
+	}
+	for _, k := range parsedResp.Payload.JSON.Keys() {
+		if strings.HasSuffix(k, "Lv") {
+			idx, ok := ru.provider.Characters().Index(k[0:3])
+			if !ok {
+				logger.Warn("Unknown character", "character", k[0:3])
 				continue
 			}
-			if len(ratings) <= idx {
-				fmt.Println("No rating for:", k[0:3])
+			if len(ratings) <= idx || ratings[idx].Unrated {
+				logger.Debug("No rating for character", "character", k[0:3])
 				continue
 			}
 			rating := ratings[idx]
-			parsedResp.Payload.JSON[k] = int(math.Round(rating.Value))
+			parsedResp.Payload.JSON.Set(k, ru.formatter(rating))
 		}
 	}
 
-	out, err := msgpack.Marshal(parsedResp)
+	out, err := ggst.Marshal(parsedResp) // Only the stats are re-encoded, everything else is as ASW sent it
 	if err != nil {
-		fmt.Println(err)
+		logger.Error("Could not encode response", "err", err)
 	}
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(out)))
 	w.Write(out)
@@ -185,38 +152,5 @@ type Ratings []Rating
 type Rating struct {
 	Value     float64
 	Deviation float64
-}
-
-func (ru *RatingUpdate) FetchRatings(userID uint64) (Ratings, error) {
-	url := fmt.Sprintf(ratingUpdateURL, convertUser(userID))
-	resp, err := ru.client.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode > 299 {
-		return nil, fmt.Errorf("HTTP error: %s. URL: %s", resp.Status, url)
-	}
-	d := json.NewDecoder(resp.Body)
-
-	ratings := &Ratings{}
-	err = d.Decode(ratings)
-	if err != nil {
-		return nil, err
-	}
-
-	return (*ratings), nil
-}
-
-func convertCharacter(character string) int {
-	if val, ok := characters[character]; ok {
-		return val
-	} else {
-		return -1
-	}
-}
-
-func convertUser(userID uint64) string {
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, userID)
-	return strings.ToUpper(hex.EncodeToString(b))
+	Unrated   bool `json:"-"` // No rating for this character. Its level is left as is.
 }
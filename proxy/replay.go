@@ -0,0 +1,141 @@
+package proxy
+
+// Answers requests from a capture file made with -record instead of the ASW servers.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+// ReplayTransport is a http.RoundTripper that serves recorded responses.
+// Requests are matched on path and payload. The login hash in the request header is ignored as it changes every session.
+// Requests that were never recorded get a 404, unless Fallback is set.
+type ReplayTransport struct {
+	Fallback  bool // Answer requests that were never recorded with the first recorded response for the same path
+	lock      sync.Mutex
+	responses map[string][]*CaptureEntry // Recorded responses for each request, in the order they were recorded
+	served    map[string]int             // How many times each request has been served
+	fallback  map[string]*CaptureEntry   // First recorded response for each path, for requests that were never recorded
+	logger    *slog.Logger
+}
+
+func NewReplayTransport(path string, logger *slog.Logger) (*ReplayTransport, error) {
+	entries, err := ReadCapture(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &ReplayTransport{
+		responses: make(map[string][]*CaptureEntry),
+		served:    make(map[string]int),
+		fallback:  make(map[string]*CaptureEntry),
+		logger:    logger,
+	}
+	for i := range entries {
+		entry := &entries[i]
+		key := replayKey(entry.Path, entry.RequestBody)
+		t.responses[key] = append(t.responses[key], entry)
+		if _, ok := t.fallback[entry.Path]; !ok {
+			t.fallback[entry.Path] = entry
+		}
+	}
+	return t, nil
+}
+
+// Len returns the number of recorded responses
+func (t *ReplayTransport) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var n int
+	for _, entries := range t.responses {
+		n += len(entries)
+	}
+	return n
+}
+
+// Key requests on path and payload, ignoring volatile header fields
+func replayKey(path string, body []byte) string {
+	data, err := ggst.DecodeRequestBody(body)
+	if err != nil || len(data) == 0 {
+		return path + "|" + string(body)
+	}
+	req, err := ggst.UnmarshalAny(data)
+	if err != nil {
+		return path + "|" + string(body)
+	}
+
+	// Requests are [header, payload]. Header is [UserID, Hash, ...]
+	if msg, ok := req.([]interface{}); ok && len(msg) > 0 {
+		if header, ok := msg[0].([]interface{}); ok && len(header) > 1 {
+			header[1] = ""
+		}
+	}
+	normalized, err := ggst.Marshal(req)
+	if err != nil {
+		return path + "|" + string(body)
+	}
+	return path + "|" + hex.EncodeToString(normalized)
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	key := replayKey(req.URL.Path, body)
+
+	t.lock.Lock()
+	var entry *CaptureEntry
+	if entries := t.responses[key]; len(entries) > 0 {
+		// Serve responses in the order they were recorded, then keep repeating the last one
+		i := t.served[key]
+		if i >= len(entries) {
+			i = len(entries) - 1
+		}
+		entry = entries[i]
+		t.served[key]++
+	} else if fallback, ok := t.fallback[req.URL.Path]; ok && t.Fallback {
+		t.logger.Warn("No recorded response, replaying another response for the same path.", "path", req.URL.Path)
+		entry = fallback
+	}
+	t.lock.Unlock()
+
+	if entry == nil {
+		t.logger.Warn("No recorded response", "path", req.URL.Path)
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", http.StatusNotFound, http.StatusText(http.StatusNotFound)),
+			StatusCode: http.StatusNotFound,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       io.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        entry.ResponseHeader.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(entry.ResponseBody)),
+		ContentLength: int64(len(entry.ResponseBody)),
+		Request:       req,
+	}, nil
+}
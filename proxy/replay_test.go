@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Header with a different login hash than testHeaderData
+const testOtherHashHeaderData = "9295b2303030303030303030303030303030303030ad7a7a7a7a7a7a7a7a7a7a7a7a7a02a5302e312e3103"
+
+func writeTestCapture(t *testing.T, entries ...CaptureEntry) string {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	var lines []string
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(line))
+	}
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func replayEntry(path string, data string, code int, body string) CaptureEntry {
+	return CaptureEntry{
+		Method:         "POST",
+		Path:           path,
+		RequestBody:    []byte("data=" + data + "\x00"),
+		StatusCode:     code,
+		ResponseHeader: http.Header{},
+		ResponseBody:   []byte(body),
+	}
+}
+
+func TestReplayTransport(t *testing.T) {
+	capture := writeTestCapture(t,
+		replayEntry("/api/statistics/get", testHeaderData+"96a007ffffffff", http.StatusOK, "first"),
+		replayEntry("/api/statistics/get", testHeaderData+"96a007ffffffff", http.StatusOK, "second"),
+		replayEntry("/api/statistics/get", testHeaderData+"96a009ffffffff", http.StatusServiceUnavailable, "down"),
+	)
+	tests := []struct {
+		name     string
+		fallback bool
+		data     []string
+		want     []string
+		wantCode []int
+	}{
+		{
+			name:     "in recorded order then repeat",
+			data:     []string{testHeaderData + "96a007ffffffff", testOtherHashHeaderData + "96a007ffffffff", testHeaderData + "96a007ffffffff"},
+			want:     []string{"first", "second", "second"},
+			wantCode: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:     "recorded status",
+			data:     []string{testHeaderData + "96a009ffffffff"},
+			want:     []string{"down"},
+			wantCode: []int{http.StatusServiceUnavailable},
+		},
+		{
+			name:     "not recorded",
+			data:     []string{testHeaderData + "96a008ff00ffff"},
+			want:     []string{""},
+			wantCode: []int{http.StatusNotFound},
+		},
+		{
+			name:     "not recorded with fallback",
+			fallback: true,
+			data:     []string{testHeaderData + "96a008ff00ffff"},
+			want:     []string{"first"},
+			wantCode: []int{http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := NewReplayTransport(capture, discardLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport.Fallback = tt.fallback
+			for i, data := range tt.data {
+				req, err := http.NewRequest("POST", "http://127.0.0.1/api/statistics/get", strings.NewReader("data="+data+"\x00"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp, err := transport.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != tt.wantCode[i] || string(body) != tt.want[i] {
+					t.Errorf("request %d = %d %q, want %d %q", i, resp.StatusCode, body, tt.wantCode[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -1,33 +1,245 @@
 package proxy
 
-import "net/http"
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultCacheMaxSize = 16 * 1024 * 1024
 
 type CachedResponse struct {
-	response *http.Response
-	body     []byte
+	Request    string      `json:"request"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	Time       time.Time   `json:"time"`
+}
+
+type ResponseCacheOptions struct {
+	Dir     string                   // Directory to persist responses to. Not persisted if empty.
+	TTLs    map[string]time.Duration // How long responses are valid for. Only requests with a TTL are persisted. Responses without a TTL never expire.
+	MaxSize int64                    // Max size of all persisted bodies. Oldest responses are removed first.
+	Logger  *slog.Logger             // slog.Default() if nil
+	Metrics *Metrics                 // Counts hits and misses. Not exposed anywhere if nil.
 }
 
+// ResponseCache is safe for concurrent use. CachedResponses returned from it must not be modified.
 type ResponseCache struct {
+	lock      sync.RWMutex
 	responses map[string]*CachedResponse
+	options   ResponseCacheOptions
+}
+
+// NewResponseCache creates a cache and loads any unexpired responses persisted in options.Dir
+func NewResponseCache(options ResponseCacheOptions) *ResponseCache {
+	c := &ResponseCache{
+		responses: make(map[string]*CachedResponse),
+		options:   options,
+	}
+	if c.options.MaxSize == 0 {
+		c.options.MaxSize = DefaultCacheMaxSize
+	}
+	if c.options.Logger == nil {
+		c.options.Logger = slog.Default()
+	}
+	if c.options.Metrics == nil {
+		c.options.Metrics = NewMetrics()
+	}
+	if c.options.Dir != "" {
+		c.lock.Lock()
+		err := c.load()
+		c.lock.Unlock()
+		if err != nil {
+			c.options.Logger.Error("Could not load cached responses", "dir", c.options.Dir, "err", err)
+		}
+	}
+	return c
+}
+
+// Default cache directory is next to the exe
+func DefaultCacheDir() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exePath), "cache"), nil
+}
+
+func (c *ResponseCache) expired(response *CachedResponse) bool {
+	ttl, ok := c.options.TTLs[response.Request]
+	return ok && time.Since(response.Time) > ttl
+}
+
+func (c *ResponseCache) persisted(request string) bool {
+	_, ok := c.options.TTLs[request]
+	return ok && c.options.Dir != ""
+}
+
+// Serve writes the cached response to w
+func (r *CachedResponse) Serve(w http.ResponseWriter) {
+	for name, values := range r.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(r.StatusCode)
+	w.Write(r.Body)
 }
 
 func (c *ResponseCache) ResponseExists(request string) bool {
-	_, exists := c.responses[request]
+	_, exists := c.getResponse(request)
 	return exists
 }
 
-func (c *ResponseCache) GetResponse(request string) (http.Response, []byte) {
-	response := c.responses[request]
-	return *response.response, response.body
+// GetResponse returns the cached response for request if there is one that hasn't expired.
+func (c *ResponseCache) GetResponse(request string) (*CachedResponse, bool) {
+	response, exists := c.getResponse(request)
+	if exists {
+		c.options.Metrics.CacheHits.Inc(request)
+	} else {
+		c.options.Metrics.CacheMisses.Inc(request)
+	}
+	return response, exists
+}
+
+func (c *ResponseCache) getResponse(request string) (*CachedResponse, bool) {
+	c.lock.RLock()
+	response, exists := c.responses[request]
+	c.lock.RUnlock()
+	if !exists {
+		return nil, false
+	}
+	if c.expired(response) {
+		c.lock.Lock()
+		if c.responses[request] == response { // Don't remove a fresh response added in between the locks
+			c.removeResponse(request)
+		}
+		c.lock.Unlock()
+		return nil, false
+	}
+	return response, true
 }
 
 func (c *ResponseCache) AddResponse(request string, response *http.Response, body []byte) {
-	c.responses[request] = &CachedResponse{
-		response: response,
-		body:     body,
+	cached := &CachedResponse{
+		Request:    request,
+		StatusCode: response.StatusCode,
+		Header:     response.Header.Clone(),
+		Body:       body,
+		Time:       time.Now(),
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.responses[request] = cached
+
+	if c.persisted(request) {
+		err := c.save(cached)
+		if err != nil {
+			c.options.Logger.Error("Could not persist cached response", "endpoint", request, "err", err)
+		}
 	}
 }
 
 func (c *ResponseCache) RemoveResponse(request string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.removeResponse(request)
+}
+
+func (c *ResponseCache) removeResponse(request string) {
 	delete(c.responses, request)
+
+	if c.persisted(request) {
+		err := os.Remove(c.path(request))
+		if err != nil && !os.IsNotExist(err) {
+			c.options.Logger.Error("Could not remove cached response", "endpoint", request, "err", err)
+		}
+	}
+}
+
+func (c *ResponseCache) path(request string) string {
+	return filepath.Join(c.options.Dir, strings.ReplaceAll(request, "/", "_")+".json")
+}
+
+func (c *ResponseCache) save(response *CachedResponse) error {
+	err := os.MkdirAll(c.options.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create cache directory: %w", err)
+	}
+	buf, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file first so a crash doesn't leave a half written response behind
+	tmp := c.path(response.Request) + ".tmp"
+	err = os.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write cached response: %w", err)
+	}
+	err = os.Rename(tmp, c.path(response.Request))
+	if err != nil {
+		return fmt.Errorf("could not write cached response: %w", err)
+	}
+
+	c.evict()
+	return nil
+}
+
+// Remove the oldest persisted responses until everything fits in MaxSize. Must hold lock.
+func (c *ResponseCache) evict() {
+	var persisted []*CachedResponse
+	var size int64
+	for request, response := range c.responses {
+		if c.persisted(request) {
+			persisted = append(persisted, response)
+			size += int64(len(response.Body))
+		}
+	}
+	sort.Slice(persisted, func(i, j int) bool {
+		return persisted[i].Time.Before(persisted[j].Time)
+	})
+	for _, response := range persisted {
+		if size <= c.options.MaxSize {
+			break
+		}
+		size -= int64(len(response.Body))
+		c.removeResponse(response.Request)
+	}
+}
+
+// Must hold lock
+func (c *ResponseCache) load() error {
+	files, err := filepath.Glob(filepath.Join(c.options.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			c.options.Logger.Error("Could not read cached response", "file", file, "err", err)
+			continue
+		}
+		response := &CachedResponse{}
+		err = json.Unmarshal(buf, response)
+		if err != nil || file != c.path(response.Request) {
+			c.options.Logger.Warn("Removing invalid cached response", "file", file)
+			os.Remove(file)
+			continue
+		}
+		if !c.persisted(response.Request) || c.expired(response) {
+			os.Remove(file)
+			continue
+		}
+		c.responses[response.Request] = response
+	}
+	c.evict()
+	return nil
 }
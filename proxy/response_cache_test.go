@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func testResponse(code int) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": {"application/x-msgpack"}},
+	}
+}
+
+// Prediction workers add get_follow and get_block while GGST reads them and follows people. Run with -race.
+func TestResponseCacheConcurrent(t *testing.T) {
+	requests := []string{"catalog/get_follow", "catalog/get_block"}
+	for _, persist := range []bool{false, true} {
+		t.Run(fmt.Sprintf("persist=%v", persist), func(t *testing.T) {
+			options := ResponseCacheOptions{Logger: discardLogger(), MaxSize: 64}
+			if persist {
+				options.Dir = t.TempDir()
+				options.TTLs = map[string]time.Duration{"catalog/get_follow": time.Hour, "catalog/get_block": time.Millisecond}
+			}
+			cache := NewResponseCache(options)
+			s := &StriveAPIProxy{responseCache: cache}
+			handler := s.CacheInvalidationHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var wg sync.WaitGroup
+			for worker := 0; worker < StatsGetWorkers; worker++ {
+				wg.Add(1)
+				go func(worker int) {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						request := requests[i%len(requests)]
+						cache.AddResponse(request, testResponse(http.StatusOK), []byte(fmt.Sprintf("%s %d %d", request, worker, i)))
+					}
+				}(worker)
+			}
+			for reader := 0; reader < 3; reader++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 200; i++ {
+						request := requests[i%len(requests)]
+						if cached, ok := cache.GetResponse(request); ok {
+							if cached.Request != request || !bytes.HasPrefix(cached.Body, []byte(request)) {
+								t.Errorf("GetResponse(%q) = %q for %q", request, cached.Body, cached.Request)
+							}
+							cached.Serve(httptest.NewRecorder())
+						}
+						cache.ResponseExists(request)
+					}
+				}()
+			}
+			for _, path := range []string{"/api/follow/follow_user", "/api/follow/unfollow_user", "/api/follow/block_user", "/api/follow/unblock_user"} {
+				wg.Add(1)
+				go func(path string) {
+					defer wg.Done()
+					for i := 0; i < 100; i++ {
+						handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, nil))
+					}
+				}(path)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					cache.RemoveResponse(requests[i%len(requests)])
+				}
+			}()
+			wg.Wait()
+
+			// Whatever is left must be served intact and survive a restart
+			cache.AddResponse("catalog/get_follow", testResponse(http.StatusOK), []byte("catalog/get_follow last"))
+			if cached, ok := cache.GetResponse("catalog/get_follow"); !ok || string(cached.Body) != "catalog/get_follow last" {
+				t.Fatalf("GetResponse after concurrent use = %v, %v", cached, ok)
+			}
+			if persist {
+				reloaded := NewResponseCache(options)
+				if cached, ok := reloaded.GetResponse("catalog/get_follow"); !ok || string(cached.Body) != "catalog/get_follow last" {
+					t.Errorf("reloaded GetResponse = %v, %v", cached, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		path    string
+		removed string
+		kept    string
+	}{
+		{"/api/follow/follow_user", "catalog/get_follow", "catalog/get_block"},
+		{"/api/follow/unfollow_user", "catalog/get_follow", "catalog/get_block"},
+		{"/api/follow/block_user", "catalog/get_block", "catalog/get_follow"},
+		{"/api/follow/unblock_user", "catalog/get_block", "catalog/get_follow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			cache := NewResponseCache(ResponseCacheOptions{Logger: discardLogger()})
+			s := &StriveAPIProxy{responseCache: cache}
+			cache.AddResponse("catalog/get_follow", testResponse(http.StatusOK), []byte("follow"))
+			cache.AddResponse("catalog/get_block", testResponse(http.StatusOK), []byte("block"))
+
+			called := false
+			handler := s.CacheInvalidationHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if cache.ResponseExists(tt.removed) {
+					t.Errorf("%s still cached when the request is proxied", tt.removed)
+				}
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", tt.path, nil))
+			if !called {
+				t.Error("next handler not called")
+			}
+			if !cache.ResponseExists(tt.kept) {
+				t.Errorf("%s removed too", tt.kept)
+			}
+		})
+	}
+}
+
+// A cached error is served with its own status code, including after loading it from disk
+func TestCachedResponseStatusCode(t *testing.T) {
+	codes := []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError, http.StatusServiceUnavailable}
+	for _, code := range codes {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			options := ResponseCacheOptions{
+				Dir:    t.TempDir(),
+				TTLs:   map[string]time.Duration{"sys/get_news": time.Hour},
+				Logger: discardLogger(),
+			}
+			body := []byte(http.StatusText(code))
+			cache := NewResponseCache(options)
+			cache.AddResponse("sys/get_news", testResponse(code), body)
+
+			for name, cache := range map[string]*ResponseCache{"memory": cache, "disk": NewResponseCache(options)} {
+				cached, ok := cache.GetResponse("sys/get_news")
+				if !ok {
+					t.Fatalf("%s: not cached", name)
+				}
+				w := httptest.NewRecorder()
+				cached.Serve(w)
+				if w.Code != code {
+					t.Errorf("%s: status = %d, want %d", name, w.Code, code)
+				}
+				if got := w.Header().Get("Content-Type"); got != "application/x-msgpack" {
+					t.Errorf("%s: Content-Type = %q", name, got)
+				}
+				if !bytes.Equal(w.Body.Bytes(), body) {
+					t.Errorf("%s: body = %q, want %q", name, w.Body.Bytes(), body)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	options := ResponseCacheOptions{
+		Dir:    t.TempDir(),
+		TTLs:   map[string]time.Duration{"sys/get_news": time.Millisecond},
+		Logger: discardLogger(),
+	}
+	cache := NewResponseCache(options)
+	cache.AddResponse("sys/get_news", testResponse(http.StatusOK), []byte("news"))
+	cache.AddResponse("catalog/get_follow", testResponse(http.StatusOK), []byte("follow"))
+	time.Sleep(10 * time.Millisecond)
+
+	if cache.ResponseExists("sys/get_news") {
+		t.Error("expired response still served")
+	}
+	if !cache.ResponseExists("catalog/get_follow") {
+		t.Error("response without a TTL expired")
+	}
+	if NewResponseCache(options).ResponseExists("sys/get_news") {
+		t.Error("expired response loaded from disk")
+	}
+}
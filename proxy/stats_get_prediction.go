@@ -4,42 +4,74 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
 )
 
 const StatsGetWorkers = 5
 
+// How long predicted calls are kept around for GGST to ask for them
+const PredictionTimeout = 2 * time.Minute
+
 type StatsGetTask struct {
-	data         string
+	data         string // Hex of the payload. For R-Code calls, the part after the other user's ID.
 	path         string
-	request      string
+	request      string // Hex of the whole request. The data field without the trailing \0.
 	response     chan *http.Response
 	responseBody []byte
 }
 
+// StatsGetPrediction is safe for concurrent use. All state is guarded by lock.
 type StatsGetPrediction struct {
 	GGStriveAPIURL  string
+	PredictReplay   bool
+	Timeout         time.Duration // How long predicted calls are kept around. PredictionTimeout by default.
+	lock            sync.Mutex
 	predictionState PredictionState
 	statsGetTasks   map[string]*StatsGetTask
+	unfetched       int // Tasks in the current round that workers haven't finished yet
+	round           int // Incremented every time predictions are started so stale workers and timers can be ignored
+	expiry          *time.Timer
 	client          *http.Client
-	PredictReplay   bool
 	skipNext        bool
 	responseCache   *ResponseCache
+	logger          *slog.Logger
+	metrics         *Metrics
 }
 
 type PredictionState int
 
 // Declare typed constants each with type of status
 const (
-	ready PredictionState = iota
-	sending_calls
+	idle        PredictionState = iota // Nothing predicted
+	prefetching                        // Workers are fetching predicted calls
+	draining                           // All predicted calls are fetched and waiting for GGST to ask for them
+	expired                            // GGST didn't ask for the remaining predicted calls in time so they were dropped
 )
 
+func (p PredictionState) String() string {
+	switch p {
+	case idle:
+		return "idle"
+	case prefetching:
+		return "prefetching"
+	case draining:
+		return "draining"
+	case expired:
+		return "expired"
+	}
+	return fmt.Sprintf("PredictionState(%d)", int(p))
+}
+
 type StatsGetType int
 
 const (
@@ -70,7 +102,6 @@ func (rw *CachingResponseWriter) Write(data []byte) (int, error) {
 func (s *StatsGetPrediction) proxyRequest(r *http.Request) (*http.Response, error) {
 	apiURL, err := url.Parse(s.GGStriveAPIURL)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	apiURL.Path = r.URL.Path
@@ -81,21 +112,28 @@ func (s *StatsGetPrediction) proxyRequest(r *http.Request) (*http.Response, erro
 	return s.client.Do(r)
 }
 
+// State returns the current state of the prediction
+func (s *StatsGetPrediction) State() PredictionState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.predictionState
+}
+
 func (s *StatsGetPrediction) StatsGetStateHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		switch path {
 		case "/api/user/create":
 			// statistics/get doesn't happen as expected on account creation
+			s.lock.Lock()
 			s.skipNext = true
+			s.lock.Unlock()
 			next.ServeHTTP(w, r)
 		case "/api/statistics/get":
-			body, _ := io.ReadAll(r.Body)
-			r.Body = io.NopCloser(bytes.NewBuffer(body))
-			if strings.HasSuffix(string(body), ExpectedTitleScreenCalls()[0].data+"\x00") {
-				s.AsyncGetStats(body, title_screen)
-			} else if strings.HasSuffix(string(body), ExpectedRCodeCalls()[0].data+"\x00") {
-				s.AsyncGetStats(body, r_code)
+			if c := classifiedRequest(r); c != nil {
+				if reqType, ok := predictionTrigger(c); ok {
+					s.AsyncGetStats(c, reqType)
+				}
 			}
 			next.ServeHTTP(w, r)
 		default:
@@ -104,130 +142,210 @@ func (s *StatsGetPrediction) StatsGetStateHandler(next http.Handler) http.Handle
 	})
 }
 
-// Proxy getstats
-func (s *StatsGetPrediction) HandleGetStats(w http.ResponseWriter, r *http.Request) bool {
-	if s.predictionState == sending_calls {
-		bodyBytes, _ := io.ReadAll(r.Body)
-		r.Body.Close()                                    //  must close
-		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes)) // Reset Body as the request gets reused by catchall if this has an error.
-		req := string(bodyBytes)
-		if strings.HasSuffix(r.RequestURI, "catalog/get_replay") {
-			regex := regexp.MustCompile(`940100059aff00.*$`)
-			for _, data := range []string{"940100059aff00636390ffff000001\x00", "940100059aff00636390ffff010001\x00", "940100059aff00636390ffff020001\x00"} {
-				possibleReq := regex.ReplaceAllString(req, data)
-				if _, ok := s.statsGetTasks[possibleReq]; ok {
-					req = possibleReq
-					break
-				}
-			}
-		}
-		if task, ok := s.statsGetTasks[req]; ok {
-			resp := <-task.response
-			if resp == nil {
-				fmt.Println("Cache Error!")
-				delete(s.statsGetTasks, req)
-				return false
-			}
-			// Copy headers
-			for name, values := range resp.Header {
-				w.Header()[name] = values
+// Take the predicted task for c out of the current round. Returns nil if there isn't one.
+func (s *StatsGetPrediction) takeTask(c *ggst.ClassifiedRequest) *StatsGetTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.predictionState != prefetching && s.predictionState != draining {
+		return nil
+	}
+
+	req := c.Data
+	if isDefaultReplayQuery(c) {
+		// Any page of the default replay search is answered by the first predicted page left
+		for _, task := range ExpectedTitleScreenCalls() {
+			if task.path != "catalog/get_replay" {
+				continue
 			}
-			w.WriteHeader(resp.StatusCode)
-			w.Write(task.responseBody)
-			delete(s.statsGetTasks, req)
-			if len(s.statsGetTasks) == 0 {
-				s.predictionState = ready
-				fmt.Println("Done looking up stats")
+			if _, ok := s.statsGetTasks[c.HeaderData+task.data]; ok {
+				req = c.HeaderData + task.data
+				break
 			}
-			return true
 		}
-		fmt.Println("Cache miss! " + req)
+	}
+
+	task, ok := s.statsGetTasks[req]
+	if !ok {
+		s.metrics.PredictionMisses.Inc()
+		s.logger.Debug("Cache miss!", "endpoint", c.Endpoint, "request", c.String(), "data", req)
+		return nil
+	}
+	delete(s.statsGetTasks, req)
+	s.metrics.PredictionHits.Inc()
+	s.finishIfDone()
+	return task
+}
+
+// Go back to idle once every predicted call has been fetched and used. Must hold lock.
+func (s *StatsGetPrediction) finishIfDone() {
+	if len(s.statsGetTasks) == 0 && s.unfetched == 0 {
+		s.predictionState = idle
+		s.expiry.Stop()
+		s.logger.Info("Done looking up stats", "round", s.round)
+	}
+}
+
+// Proxy getstats
+func (s *StatsGetPrediction) HandleGetStats(w http.ResponseWriter, r *http.Request) bool {
+	if s.State() == idle {
+		return false
+	}
+
+	c := classifiedRequest(r)
+	if c == nil {
+		return false
+	}
+	task := s.takeTask(c)
+	if task == nil {
 		return false
 	}
-	return false
+
+	resp := <-task.response // Wait for a worker to fetch it
+	if resp == nil {
+		s.logger.Warn("Cache Error!", "endpoint", endpoint(r))
+		return false
+	}
+	// Copy headers
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(task.responseBody)
+	return true
+}
+
+// Record that a worker is done with a task from round
+func (s *StatsGetPrediction) taskFetched(round int, item *StatsGetTask, res *http.Response, cached bool) {
+	s.lock.Lock()
+	if round == s.round {
+		if cached {
+			delete(s.statsGetTasks, item.request)
+		}
+		s.unfetched--
+		if s.unfetched == 0 && s.predictionState == prefetching {
+			s.predictionState = draining
+			s.finishIfDone()
+		}
+	}
+	s.lock.Unlock()
+
+	item.response <- res // Buffered, never blocks
 }
 
 // Process the filled queue, then exit when it's empty
-func (s *StatsGetPrediction) ProcessStatsQueue(queue chan *StatsGetTask) {
+func (s *StatsGetPrediction) ProcessStatsQueue(queue chan *StatsGetTask, round int) {
 	for {
 		select {
 		case item := <-queue:
-			reqBytes := bytes.NewBuffer([]byte(item.request))
+			reqBytes := bytes.NewBufferString("data=" + item.request + "\x00")
 			req, err := http.NewRequest("POST", s.GGStriveAPIURL+item.path, reqBytes)
 			if err != nil {
-				fmt.Print("Req error: ")
-				fmt.Println(err)
-				item.response <- nil
+				s.logger.Error("Could not create predicted request", "endpoint", item.path, "err", err)
+				s.taskFetched(round, item, nil, false)
 				continue
 			}
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 			req.Header.Set("Cache-Control", "no-cache")
 			req.Header.Set("User-Agent", "Steam")
 
-			apiURL, err := url.Parse(s.GGStriveAPIURL) // TODO: Const this
+			res, err := s.proxyRequest(req)
 			if err != nil {
-				fmt.Print("Url error: ")
-				fmt.Println(err)
-				item.response <- nil
+				s.logger.Error("Predicted request failed", "endpoint", item.path, "err", err)
+				s.taskFetched(round, item, nil, false)
 				continue
 			}
-			apiURL.Path = req.URL.Path
-
-			req.URL = apiURL
-			req.Host = ""
-			req.RequestURI = ""
-			res, err := s.client.Do(req)
 
+			buf, err := io.ReadAll(res.Body)
+			res.Body.Close()
 			if err != nil {
-				fmt.Print("Res error: ")
-				fmt.Println(err)
-				item.response <- nil
-			} else {
-				buf, err := io.ReadAll(res.Body)
-				res.Body.Close()
-				if err != nil {
-					fmt.Println(err)
-					item.response <- nil
-				} else {
-					//add get_follow and get_block to the generic response cache instead of the prediction queue
-					if strings.HasSuffix(req.URL.Path, "catalog/get_follow") {
-						s.responseCache.AddResponse("catalog/get_follow", res, buf)
-						delete(s.statsGetTasks, item.request)
-					} else if strings.HasSuffix(req.URL.Path, "catalog/get_block") {
-						s.responseCache.AddResponse("catalog/get_block", res, buf)
-						delete(s.statsGetTasks, item.request)
-					} else {
-						item.responseBody = buf
-						item.response <- res
-					}
+				s.logger.Error("Could not read predicted response", "endpoint", item.path, "err", err)
+				s.taskFetched(round, item, nil, false)
+				continue
+			}
+
+			//add get_follow and get_block to the generic response cache instead of the prediction queue
+			cached := false
+			if strings.HasSuffix(req.URL.Path, "catalog/get_follow") {
+				if res.StatusCode == http.StatusOK {
+					s.responseCache.AddResponse("catalog/get_follow", res, buf)
 				}
+				cached = true
+			} else if strings.HasSuffix(req.URL.Path, "catalog/get_block") {
+				if res.StatusCode == http.StatusOK {
+					s.responseCache.AddResponse("catalog/get_block", res, buf)
+				}
+				cached = true
 			}
+			item.responseBody = buf
+			s.taskFetched(round, item, res, cached)
 		default:
-			fmt.Println("Empty queue, shutting down")
+			s.logger.Debug("Empty queue, shutting down", "round", round)
 			return
 
 		}
 	}
 }
 
-func (s *StatsGetPrediction) AsyncGetStats(body []byte, reqType StatsGetType) {
+// Which set of calls a statistics/get request is the first of, if any
+func predictionTrigger(c *ggst.ClassifiedRequest) (StatsGetType, bool) {
+	p, ok := c.StatGet()
+	if !ok {
+		return 0, false
+	}
+	levels := ggst.StatGetReqPayload{OtherUserID: p.OtherUserID, Type: int(ggst.StatGetLevels), Unk2: -1, Page: -1, Unk3: -1, Unk4: -1}
+	if *p != levels {
+		return 0, false
+	}
+	if p.OtherUserID == "" {
+		return title_screen, true
+	}
+	return r_code, true
+}
+
+// Whether c is a search for the replays shown on the title screen
+func isDefaultReplayQuery(c *ggst.ClassifiedRequest) bool {
+	p, ok := c.Payload.(*ggst.GetReplayReqPayload)
+	return ok && p.Unk1 == 1 && p.Unk2 == 0 && p.PageSize == 5 && p.Query.Unk1 == -1 && p.Query.Unk2 == 0
+}
+
+// Hex of the part of an R-Code payload before the data in ExpectedRCodeCalls. An array of 6 then the other user's ID.
+func rCodePrefix(otherUserID string) (string, error) {
+	id, err := ggst.Marshal(otherUserID)
+	if err != nil {
+		return "", err
+	}
+	return "96" + hex.EncodeToString(id), nil
+}
+
+func (s *StatsGetPrediction) AsyncGetStats(c *ggst.ClassifiedRequest, reqType StatsGetType) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if s.skipNext {
 		s.skipNext = false
 		return
 	}
 
 	var reqs []StatsGetTask
+	prefix := c.HeaderData
 	if reqType == title_screen {
 		reqs = ExpectedTitleScreenCalls()
 	} else {
 		reqs = ExpectedRCodeCalls()
+		p, _ := c.StatGet()
+		payloadPrefix, err := rCodePrefix(p.OtherUserID)
+		if err != nil {
+			s.logger.Error("Could not predict R-Code calls", "err", err)
+			return
+		}
+		prefix += payloadPrefix
 	}
-	bodyConst := strings.Replace(string(body), reqs[0].data+"\x00", "", 1)
 
 	//Clear requests from previous round
-	for id := range s.statsGetTasks {
-		delete(s.statsGetTasks, id)
-	}
+	s.statsGetTasks = make(map[string]*StatsGetTask)
+	s.round++
+	round := s.round
 
 	queue := make(chan *StatsGetTask, len(reqs)+1)
 	for i := range reqs {
@@ -237,7 +355,7 @@ func (s *StatsGetPrediction) AsyncGetStats(body []byte, reqType StatsGetType) {
 			continue
 		}
 
-		id := bodyConst + task.data + "\x00"
+		id := prefix + task.data
 		task.request = id
 		task.response = make(chan *http.Response, 1)
 
@@ -245,22 +363,42 @@ func (s *StatsGetPrediction) AsyncGetStats(body []byte, reqType StatsGetType) {
 		queue <- &task
 	}
 
-	s.predictionState = sending_calls
+	s.unfetched = len(queue)
+	s.predictionState = prefetching
+	s.logger.Info("Predicting stats", "calls", s.unfetched, "round", round)
+	s.expiry.Stop()
+	s.expiry = time.AfterFunc(s.Timeout, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.round != round || s.predictionState == idle {
+			return
+		}
+		s.logger.Info("Dropping predicted calls that were never used.", "count", len(s.statsGetTasks), "round", round)
+		s.metrics.PredictionDropped.Add(uint64(len(s.statsGetTasks)))
+		s.statsGetTasks = make(map[string]*StatsGetTask)
+		s.predictionState = expired
+	})
 
 	for i := 0; i < StatsGetWorkers; i++ {
-		go s.ProcessStatsQueue(queue)
+		go s.ProcessStatsQueue(queue, round)
 	}
 }
 
-func CreateStatsGetPrediction(GGStriveAPIURL string, client *http.Client, responseCache *ResponseCache) StatsGetPrediction {
-	return StatsGetPrediction{
+func CreateStatsGetPrediction(GGStriveAPIURL string, client *http.Client, responseCache *ResponseCache, logger *slog.Logger, metrics *Metrics) *StatsGetPrediction {
+	expiry := time.NewTimer(0)
+	expiry.Stop()
+	return &StatsGetPrediction{
 		GGStriveAPIURL:  GGStriveAPIURL,
-		predictionState: ready,
+		predictionState: idle,
 		statsGetTasks:   make(map[string]*StatsGetTask),
+		expiry:          expiry,
 		client:          client,
 		PredictReplay:   false,
+		Timeout:         PredictionTimeout,
 		skipNext:        false,
 		responseCache:   responseCache,
+		logger:          logger,
+		metrics:         metrics,
 	}
 }
 
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/optix2000/totsugeki/mockasw"
+)
+
+// Hex of a request header, including the array the header and payload are in
+const testHeaderData = "9295b2303030303030303030303030303030303030ad61626364656667686a6b6c6d6e02a5302e312e3103"
+
+// User ID of the R-Code being opened
+const testOtherUserID = "210611081234567890"
+
+// Not predicted, so the real proxy would send it upstream
+const statusNotPredicted = http.StatusTeapot
+
+func apiRequest(path string, data string) *http.Request {
+	r := httptest.NewRequest("POST", "/api/"+path, strings.NewReader("data="+data+"\x00"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+type predictionTest struct {
+	prediction *StatsGetPrediction
+	handler    http.Handler
+	cache      *ResponseCache
+	metrics    *Metrics
+	upstream   *mockasw.Server
+}
+
+// Prediction in front of mockasw. Requests that aren't answered from predictions get statusNotPredicted.
+// upstream wraps the mockasw handler if not nil.
+func newPredictionTest(t *testing.T, upstream func(http.Handler) http.Handler) *predictionTest {
+	asw := mockasw.NewServer("", mockasw.Options{})
+	var handler http.Handler = asw.Handler()
+	if upstream != nil {
+		handler = upstream(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	metrics := NewMetrics()
+	cache := NewResponseCache(ResponseCacheOptions{Logger: discardLogger(), Metrics: metrics})
+	p := CreateStatsGetPrediction(server.URL+"/api/", server.Client(), cache, discardLogger(), metrics)
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.HandleGetStats(w, r) {
+			w.WriteHeader(statusNotPredicted)
+		}
+	})
+	return &predictionTest{
+		prediction: p,
+		handler:    ClassifyHandler(discardLogger())(p.StatsGetStateHandler(fallback)),
+		cache:      cache,
+		metrics:    metrics,
+		upstream:   asw,
+	}
+}
+
+func (pt *predictionTest) do(path string, data string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	pt.handler.ServeHTTP(w, apiRequest(path, data))
+	return w
+}
+
+// Send every call in tasks at once like GGST does, and return the status codes
+func (pt *predictionTest) burst(prefix string, tasks []StatsGetTask) []int {
+	codes := make([]int, len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		wg.Add(1)
+		go func(i int, task StatsGetTask) {
+			defer wg.Done()
+			codes[i] = pt.do(task.path, prefix+task.data).Code
+		}(i, task)
+	}
+	wg.Wait()
+	return codes
+}
+
+func (pt *predictionTest) waitForState(t *testing.T, want PredictionState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for pt.prediction.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %v, want %v", pt.prediction.State(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Calls that are answered from predictions. get_follow and get_block go to the response cache instead.
+func predictedCalls(tasks []StatsGetTask, replay bool) []StatsGetTask {
+	var predicted []StatsGetTask
+	for _, task := range tasks {
+		if task.path == "catalog/get_follow" || task.path == "catalog/get_block" || (task.path == "catalog/get_replay" && !replay) {
+			continue
+		}
+		predicted = append(predicted, task)
+	}
+	return predicted
+}
+
+func rCodeTestPrefix(t *testing.T) string {
+	prefix, err := rCodePrefix(testOtherUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testHeaderData + prefix
+}
+
+func TestStatsGetPredictionBursts(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   func(t *testing.T) string
+		tasks    []StatsGetTask
+		replay   bool
+		upstream int // Requests sent upstream
+	}{
+		{name: "title screen", prefix: func(t *testing.T) string { return testHeaderData }, tasks: ExpectedTitleScreenCalls(), upstream: len(ExpectedTitleScreenCalls()) - 3},
+		{name: "title screen with replays", prefix: func(t *testing.T) string { return testHeaderData }, tasks: ExpectedTitleScreenCalls(), replay: true, upstream: len(ExpectedTitleScreenCalls())},
+		{name: "R-Code", prefix: rCodeTestPrefix, tasks: ExpectedRCodeCalls(), upstream: len(ExpectedRCodeCalls())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pt := newPredictionTest(t, nil)
+			pt.prediction.PredictReplay = tt.replay
+			prefix := tt.prefix(t)
+			predicted := predictedCalls(tt.tasks, tt.replay)
+
+			// The first call starts the prediction and is answered from it
+			if code := pt.do(predicted[0].path, prefix+predicted[0].data).Code; code != http.StatusOK {
+				t.Fatalf("first call = %d, want %d", code, http.StatusOK)
+			}
+			for i, code := range pt.burst(prefix, predicted[1:]) {
+				if code != http.StatusOK {
+					t.Errorf("%s %s = %d, want %d", predicted[i+1].path, predicted[i+1].data, code, http.StatusOK)
+				}
+			}
+
+			pt.waitForState(t, idle)
+			if hits := pt.metrics.PredictionHits.Sum(); hits != uint64(len(predicted)) {
+				t.Errorf("hits = %d, want %d", hits, len(predicted))
+			}
+			if misses := pt.metrics.PredictionMisses.Sum(); misses != 0 {
+				t.Errorf("misses = %d, want 0", misses)
+			}
+			if requests := pt.upstream.Requests(); requests != uint64(tt.upstream) {
+				t.Errorf("upstream requests = %d, want %d", requests, tt.upstream)
+			}
+			for _, request := range []string{"catalog/get_follow", "catalog/get_block"} {
+				if pt.cache.ResponseExists(request) != (tt.upstream > len(predicted)) {
+					t.Errorf("%s cached = %v", request, pt.cache.ResponseExists(request))
+				}
+			}
+			// Nothing is left over once everything was used
+			if code := pt.do(predicted[1].path, prefix+predicted[1].data).Code; code != statusNotPredicted {
+				t.Errorf("call after prediction finished = %d, want %d", code, statusNotPredicted)
+			}
+		})
+	}
+}
+
+// Calls that aren't part of a prediction go upstream, and don't disturb it
+func TestStatsGetPredictionMiss(t *testing.T) {
+	pt := newPredictionTest(t, nil)
+	tasks := predictedCalls(ExpectedTitleScreenCalls(), false)
+	pt.do(tasks[0].path, testHeaderData+tasks[0].data)
+
+	if code := pt.do("statistics/get", testHeaderData+"96a001ff00ffff").Code; code != statusNotPredicted {
+		t.Errorf("unpredicted call = %d, want %d", code, statusNotPredicted)
+	}
+	if misses := pt.metrics.PredictionMisses.Sum(); misses != 1 {
+		t.Errorf("misses = %d, want 1", misses)
+	}
+	for i, code := range pt.burst(testHeaderData, tasks[1:]) {
+		if code != http.StatusOK {
+			t.Errorf("%s = %d, want %d", tasks[i+1].data, code, http.StatusOK)
+		}
+	}
+	pt.waitForState(t, idle)
+}
+
+func TestStatsGetPredictionExpiry(t *testing.T) {
+	pt := newPredictionTest(t, nil)
+	pt.prediction.Timeout = 50 * time.Millisecond
+	tasks := predictedCalls(ExpectedTitleScreenCalls(), false)
+
+	pt.do(tasks[0].path, testHeaderData+tasks[0].data)
+	pt.waitForState(t, expired)
+	if dropped := pt.metrics.PredictionDropped.Sum(); dropped != uint64(len(tasks)-1) {
+		t.Errorf("dropped = %d, want %d", dropped, len(tasks)-1)
+	}
+	if code := pt.do(tasks[1].path, testHeaderData+tasks[1].data).Code; code != statusNotPredicted {
+		t.Errorf("call after expiry = %d, want %d", code, statusNotPredicted)
+	}
+
+	// A new round starts over after expiring
+	if code := pt.do(tasks[0].path, testHeaderData+tasks[0].data).Code; code != http.StatusOK {
+		t.Errorf("first call of new round = %d, want %d", code, http.StatusOK)
+	}
+	if state := pt.prediction.State(); state == expired || state == idle {
+		t.Errorf("state after new round = %v", state)
+	}
+}
+
+// The timer of a replaced round doesn't expire the round that replaced it
+func TestStatsGetPredictionExpiryReplaced(t *testing.T) {
+	pt := newPredictionTest(t, nil)
+	pt.prediction.Timeout = 200 * time.Millisecond
+	title := predictedCalls(ExpectedTitleScreenCalls(), false)
+	rCode := ExpectedRCodeCalls()
+	prefix := rCodeTestPrefix(t)
+
+	pt.do(title[0].path, testHeaderData+title[0].data)
+	time.Sleep(120 * time.Millisecond)
+	pt.do(rCode[0].path, prefix+rCode[0].data)
+	time.Sleep(120 * time.Millisecond) // Past the first round's expiry
+
+	if state := pt.prediction.State(); state == expired {
+		t.Fatal("second round expired with the first round's timer")
+	}
+	if code := pt.do(rCode[1].path, prefix+rCode[1].data).Code; code != http.StatusOK {
+		t.Errorf("call from second round = %d, want %d", code, http.StatusOK)
+	}
+	pt.waitForState(t, expired)
+	if dropped := pt.metrics.PredictionDropped.Sum(); dropped != uint64(len(rCode)-2) {
+		t.Errorf("dropped = %d, want %d", dropped, len(rCode)-2)
+	}
+}
+
+// Opening an R-Code while the title screen calls are still waiting to be used replaces them
+func TestStatsGetPredictionReplaceDraining(t *testing.T) {
+	pt := newPredictionTest(t, nil)
+	title := predictedCalls(ExpectedTitleScreenCalls(), false)
+	rCode := ExpectedRCodeCalls()
+	prefix := rCodeTestPrefix(t)
+
+	pt.do(title[0].path, testHeaderData+title[0].data)
+	pt.waitForState(t, draining)
+	pt.burst(testHeaderData, title[1:5])
+
+	pt.do(rCode[0].path, prefix+rCode[0].data)
+	if code := pt.do(title[5].path, testHeaderData+title[5].data).Code; code != statusNotPredicted {
+		t.Errorf("call from replaced round = %d, want %d", code, statusNotPredicted)
+	}
+	for i, code := range pt.burst(prefix, rCode[1:]) {
+		if code != http.StatusOK {
+			t.Errorf("%s = %d, want %d", rCode[i+1].data, code, http.StatusOK)
+		}
+	}
+	pt.waitForState(t, idle)
+	if hits := pt.metrics.PredictionHits.Sum(); hits != uint64(5+len(rCode)) {
+		t.Errorf("hits = %d, want %d", hits, 5+len(rCode))
+	}
+}
+
+// Workers from a replaced round that finish late don't count towards the new round
+func TestStatsGetPredictionReplacePrefetching(t *testing.T) {
+	gate := make(chan struct{})
+	var once sync.Once
+	release := func() { once.Do(func() { close(gate) }) }
+	defer release()
+	pt := newPredictionTest(t, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-gate
+			next.ServeHTTP(w, r)
+		})
+	})
+	title := predictedCalls(ExpectedTitleScreenCalls(), false)
+	rCode := ExpectedRCodeCalls()
+	prefix := rCodeTestPrefix(t)
+
+	// GGST waits on the title screen call while the upstream is stuck
+	done := make(chan int)
+	go func() { done <- pt.do(title[0].path, testHeaderData+title[0].data).Code }()
+	pt.waitForState(t, prefetching)
+
+	rCodeDone := make(chan []int)
+	go func() {
+		codes := []int{pt.do(rCode[0].path, prefix+rCode[0].data).Code}
+		rCodeDone <- append(codes, pt.burst(prefix, rCode[1:])...)
+	}()
+	time.Sleep(10 * time.Millisecond) // Let the R-Code round start
+	release()
+
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("call that started the replaced round = %d, want %d", code, http.StatusOK)
+	}
+	for i, code := range <-rCodeDone {
+		if code != http.StatusOK {
+			t.Errorf("%s = %d, want %d", rCode[i].data, code, http.StatusOK)
+		}
+	}
+	pt.waitForState(t, idle)
+}
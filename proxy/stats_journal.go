@@ -0,0 +1,217 @@
+package proxy
+
+// Keeps async statistics/set and tus/write requests on disk until ASW confirms them, so R-Code updates survive crashes.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+// Entries that keep failing are moved to the failed directory in the journal instead of being retried forever
+const (
+	StatsJournalMaxAttempts = 3                  // Runs that gave up on uploading an entry
+	StatsJournalMaxAge      = 7 * 24 * time.Hour // ASW is unlikely to take stats older than this
+)
+
+// StatsJournalEntry is a pending upload. Each entry is stored as its own JSON file.
+type StatsJournalEntry struct {
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	Time     time.Time   `json:"time"`
+	Attempts int         `json:"attempts,omitempty"` // Runs that gave up on uploading it
+	file     string      // Journal file, empty if not journaled
+}
+
+// Request creates a new request for the entry. Each call returns a fresh body so retries send the full request.
+func (e *StatsJournalEntry) Request() (*http.Request, error) {
+	req, err := http.NewRequest(e.Method, e.Path, bytes.NewReader(e.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = e.Header.Clone()
+	return req, nil
+}
+
+// WithHeader returns a copy of the entry sent with the request header of c, for uploading with a newer login hash.
+// Fails if the entry is from a different user than c.
+func (e *StatsJournalEntry) WithHeader(c *ggst.ClassifiedRequest) (*StatsJournalEntry, error) {
+	old, err := ggst.ClassifyRequest(e.Path, e.Body)
+	if err != nil {
+		return nil, err
+	}
+	if old.Header.UserID != c.Header.UserID {
+		return nil, fmt.Errorf("stats are from user %s, not %s", old.Header.UserID, c.Header.UserID)
+	}
+	entry := *e
+	entry.Body = []byte("data=" + c.HeaderData + old.PayloadData + "\x00")
+	return &entry, nil
+}
+
+// StatsJournal is safe for concurrent use.
+type StatsJournal struct {
+	dir    string
+	lock   sync.Mutex
+	seq    int
+	logger *slog.Logger
+}
+
+// NewStatsJournal creates dir if needed and journals to it
+func NewStatsJournal(dir string, logger *slog.Logger) (*StatsJournal, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create stats journal directory: %w", err)
+	}
+	return &StatsJournal{dir: dir, logger: logger}, nil
+}
+
+// Default journal directory is next to the exe
+func DefaultStatsJournalDir() (string, error) {
+	exePath, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(exePath), "stats-journal"), nil
+}
+
+// Add durably writes entry to the journal. Returns once the entry is synced to disk.
+func (j *StatsJournal) Add(entry *StatsJournalEntry) error {
+	j.lock.Lock()
+	j.seq++
+	// Sortable by time so pending entries are replayed in order
+	name := fmt.Sprintf("%020d-%06d.json", entry.Time.UnixNano(), j.seq)
+	j.lock.Unlock()
+
+	path := filepath.Join(j.dir, name)
+	err := writeJournalEntry(path, entry)
+	if err != nil {
+		return err
+	}
+	entry.file = path
+	return nil
+}
+
+// Durably write entry to path, replacing what's there
+func writeJournalEntry(path string, entry *StatsJournalEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write stats journal: %w", err)
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path) // Never leave a half written entry behind
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write stats journal: %w", err)
+	}
+	return nil
+}
+
+// Remove deletes an uploaded entry from the journal
+func (j *StatsJournal) Remove(entry *StatsJournalEntry) {
+	if entry.file == "" {
+		return
+	}
+	err := os.Remove(entry.file)
+	if err != nil && !os.IsNotExist(err) {
+		j.logger.Error("Could not remove uploaded stats from journal", "file", entry.file, "err", err)
+	}
+}
+
+// Failed records that this run gave up on uploading entry. Once it has failed StatsJournalMaxAttempts times it's moved aside.
+func (j *StatsJournal) Failed(entry *StatsJournalEntry) {
+	if entry.file == "" {
+		return
+	}
+	entry.Attempts++
+	if entry.Attempts >= StatsJournalMaxAttempts {
+		j.moveAside(entry, "too many failed uploads")
+		return
+	}
+	err := writeJournalEntry(entry.file, entry)
+	if err != nil {
+		j.logger.Error("Could not update stats journal", "file", entry.file, "err", err)
+	}
+}
+
+// Move an entry that won't be uploaded to the failed directory, so it's kept for the user but not retried
+func (j *StatsJournal) moveAside(entry *StatsJournalEntry, reason string) {
+	dir := j.FailedDir()
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(entry.file, filepath.Join(dir, filepath.Base(entry.file)))
+	}
+	if err != nil {
+		j.logger.Error("Could not move failed stats out of the journal", "file", entry.file, "err", err)
+		return
+	}
+	j.logger.Warn("Stopped trying to upload stats.", "reason", reason, "time", entry.Time, "dir", dir)
+}
+
+// FailedDir is where entries that won't be uploaded are moved to
+func (j *StatsJournal) FailedDir() string {
+	return filepath.Join(j.dir, "failed")
+}
+
+// Pending returns the entries that were never confirmed by ASW, oldest first. Entries older than StatsJournalMaxAge are moved aside.
+func (j *StatsJournal) Pending() ([]*StatsJournalEntry, error) {
+	files, err := filepath.Glob(filepath.Join(j.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	// Clean up entries that were never finished writing
+	if tmps, err := filepath.Glob(filepath.Join(j.dir, "*.json.tmp")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+
+	var entries []*StatsJournalEntry
+	for _, file := range files {
+		buf, err := os.ReadFile(file)
+		if err != nil {
+			j.logger.Error("Could not read stats journal", "file", file, "err", err)
+			continue
+		}
+		entry := &StatsJournalEntry{}
+		err = json.Unmarshal(buf, entry)
+		if err != nil {
+			j.logger.Warn("Skipping invalid stats journal entry", "file", file, "err", err)
+			continue
+		}
+		entry.file = file
+		if time.Since(entry.Time) > StatsJournalMaxAge {
+			j.moveAside(entry, "too old")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
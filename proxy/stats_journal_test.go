@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/optix2000/totsugeki/ggst"
+)
+
+func testJournalEntry(data string, at time.Time) *StatsJournalEntry {
+	return &StatsJournalEntry{
+		Method: "POST",
+		Path:   "/api/statistics/set",
+		Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:   []byte("data=" + data + "\x00"),
+		Time:   at,
+	}
+}
+
+func TestStatsJournalPending(t *testing.T) {
+	journal, err := NewStatsJournal(t.TempDir(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	newer := testJournalEntry(testHeaderData+"91a0", now.Add(-time.Minute))
+	older := testJournalEntry(testHeaderData+"91a1", now.Add(-time.Hour))
+	stale := testJournalEntry(testHeaderData+"91a2", now.Add(-StatsJournalMaxAge-time.Hour))
+	for _, entry := range []*StatsJournalEntry{newer, older, stale} {
+		if err := journal.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err := journal.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || string(pending[0].Body) != string(older.Body) || string(pending[1].Body) != string(newer.Body) {
+		t.Fatalf("Pending = %v, want the 2 recent entries oldest first", pending)
+	}
+	if _, err := os.Stat(filepath.Join(journal.FailedDir(), filepath.Base(stale.file))); err != nil {
+		t.Errorf("stale entry not moved aside: %v", err)
+	}
+}
+
+func TestStatsJournalFailed(t *testing.T) {
+	journal, err := NewStatsJournal(t.TempDir(), discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = journal.Add(testJournalEntry(testHeaderData+"91a0", time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every run loads the entry again and gives up on it
+	for run := 1; run <= StatsJournalMaxAttempts; run++ {
+		pending, err := journal.Pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 {
+			t.Fatalf("run %d: %d pending entries, want 1", run, len(pending))
+		}
+		if pending[0].Attempts != run-1 {
+			t.Errorf("run %d: attempts = %d, want %d", run, pending[0].Attempts, run-1)
+		}
+		journal.Failed(pending[0])
+	}
+
+	pending, err := journal.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("%d entries still pending after %d failed runs", len(pending), StatsJournalMaxAttempts)
+	}
+	if failed, _ := filepath.Glob(filepath.Join(journal.FailedDir(), "*.json")); len(failed) != 1 {
+		t.Errorf("failed entries = %v, want 1", failed)
+	}
+}
+
+func TestStatsJournalEntryWithHeader(t *testing.T) {
+	entry := testJournalEntry(testHeaderData+"92a3616263a0", time.Now())
+	login, err := ggst.ClassifyRequest("/api/statistics/get", []byte("data="+testOtherHashHeaderData+"96a007ffffffff\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := entry.WithHeader(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "data=" + testOtherHashHeaderData + "92a3616263a0\x00"; string(rewritten.Body) != want {
+		t.Errorf("body = %q, want %q", rewritten.Body, want)
+	}
+	if string(entry.Body) != "data="+testHeaderData+"92a3616263a0\x00" {
+		t.Errorf("original entry changed to %q", entry.Body)
+	}
+
+	// Stats from someone else are never sent with this user's login
+	otherUser := "9295b2313131313131313131313131313131313131ad7a7a7a7a7a7a7a7a7a7a7a7a7a02a5302e312e3103"
+	other, err := ggst.ClassifyRequest("/api/statistics/get", []byte("data="+otherUser+"96a007ffffffff\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := entry.WithHeader(other); err == nil {
+		t.Error("WithHeader accepted a different user")
+	}
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsSetTemplateKeepsEncoding(t *testing.T) {
+	// Header with the int as uint8 and a version as str8, payload result as int16
+	const (
+		before = "9298ad363261336638653263316430" + "62cc00" + "b3"
+		after  = "d905302e312e32a5302e302e32a5302e302e32a0a091d10000"
+	)
+	body, _ := hex.DecodeString(before + hex.EncodeToString([]byte("2024/01/02 03:04:05")) + after)
+	template := NewStatsSetTemplate(discardLogger())
+	template.Learn("/api/statistics/set", http.Header{"Server": {"ASW"}}, body)
+
+	_, resp, err := template.Response("/api/statistics/set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := hex.EncodeToString(resp)
+	if !strings.HasPrefix(got, before) || !strings.HasSuffix(got, after) {
+		t.Fatalf("response = %s, want %s<timestamp>%s", got, before, after)
+	}
+	timestamp, _ := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(got, before), after))
+	if _, err := time.Parse(responseTimeLayout, string(timestamp)); err != nil {
+		t.Errorf("timestamp %q: %v", timestamp, err)
+	}
+}